@@ -0,0 +1,14 @@
+import "sort"
+
+// Foreign functions can call Oak functions by name with `CallOak`,
+// which returns the cells that the Oak function returns
+func __oak_sort_by(vm *machine) {
+	addr := int(vm.Pop())
+	n := int(vm.Pop())
+	less := vm.ReadString(int(vm.Pop()))
+
+	nums := vm.Memory()[addr : addr+n]
+	sort.SliceStable(nums, func(i, j int) bool {
+		return vm.CallOak(less, nums[i], nums[j])[0] != 0
+	})
+}
@@ -0,0 +1,6 @@
+// This file is included with the prefix `celsius_`, so
+// `extern fn convert` calls `celsius_convert`
+func celsius_convert(vm *machine) {
+	fahrenheit := vm.Pop()
+	vm.Push((fahrenheit - 32) * 5 / 9)
+}
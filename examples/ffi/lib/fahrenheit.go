@@ -0,0 +1,6 @@
+// This file is included with the prefix `fahrenheit_`, so
+// `extern fn convert` calls `fahrenheit_convert`
+func fahrenheit_convert(vm *machine) {
+	celsius := vm.Pop()
+	vm.Push(celsius*9/5 + 32)
+}
@@ -9,4 +9,11 @@ void __oak_add(machine *vm) {
     int b = machine_pop(vm);
     printf("This should print %d => ", a + b);
     machine_push(vm, a + b);
-}
\ No newline at end of file
+}
+
+void __oak_divmod(machine *vm) {
+    int a = machine_pop(vm);
+    int b = machine_pop(vm);
+    machine_push(vm, a / b);
+    machine_push(vm, a % b);
+}
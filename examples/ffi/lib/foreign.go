@@ -1,11 +1,21 @@
+import "fmt"
 
 func test(vm *machine) {
 	fmt.Println("This is a Go foreign function!")
 }
 
 func __oak_add(vm *machine) {
-	a := vm.pop()
-	b := vm.pop()
+	a := vm.Pop()
+	b := vm.Pop()
 	fmt.Printf("This should print %v => ", a+b)
-	vm.push(float64(a + b))
-}
\ No newline at end of file
+	vm.Push(float64(a + b))
+}
+
+// Foreign functions can return structures, by pushing
+// each of their members in order
+func __oak_divmod(vm *machine) {
+	a := int(vm.Pop())
+	b := int(vm.Pop())
+	vm.Push(float64(a / b))
+	vm.Push(float64(a % b))
+}
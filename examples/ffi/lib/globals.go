@@ -0,0 +1,16 @@
+import "runtime"
+
+var verbose = 0.0
+
+// Foreign globals are mirrored into cells of the machine's memory,
+// which the program reads and writes through pointers
+func init() {
+	RegisterForeignGlobal("cpus", func() float64 {
+		return float64(runtime.NumCPU())
+	}, nil)
+	RegisterForeignGlobal("verbose", func() float64 {
+		return verbose
+	}, func(n float64) {
+		verbose = n
+	})
+}
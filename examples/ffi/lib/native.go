@@ -0,0 +1,17 @@
+import "strings"
+
+func add(a, b float64) float64 {
+	return a + b
+}
+
+func shout(s string) string {
+	return strings.ToUpper(s) + "!"
+}
+
+func sum(nums ...float64) float64 {
+	total := 0.0
+	for _, n := range nums {
+		total += n
+	}
+	return total
+}
@@ -0,0 +1,9 @@
+//oak:require github.com/google/uuid v1.6.0
+
+import "github.com/google/uuid"
+
+// Foreign files that import packages from other modules require
+// them with `//oak:require`, and the program is built with `--module`
+func __oak_uuid(vm *machine) {
+	vm.Push(float64(vm.AllocString(uuid.NewString())))
+}
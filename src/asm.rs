@@ -3,7 +3,7 @@ use crate::{
     Identifier, StringLiteral,
 };
 use std::{
-    collections::BTreeMap,
+    collections::{BTreeMap, BTreeSet},
     fmt::{Debug, Display, Error, Formatter},
     fs::read_to_string,
     path::PathBuf,
@@ -14,6 +14,9 @@ pub enum AsmError {
     NonExistantExternFile(String),
     VariableNotDefined(Identifier),
     FunctionNotDefined(Identifier),
+    IndirectCallUnsupported,
+    NativeCallUnsupported(Identifier),
+    ForeignFileUnsupported(String),
     NoEntryPoint,
 }
 
@@ -25,6 +28,22 @@ impl Display for AsmError {
             }
             Self::FunctionNotDefined(name) => write!(f, "function '{}' is not defined", name),
             Self::VariableNotDefined(name) => write!(f, "variable '{}' is not defined", name),
+            Self::IndirectCallUnsupported => {
+                write!(
+                    f,
+                    "the target does not support calling functions indirectly"
+                )
+            }
+            Self::NativeCallUnsupported(name) => write!(
+                f,
+                "the target does not support calling native function '{}'",
+                name
+            ),
+            Self::ForeignFileUnsupported(filename) => write!(
+                f,
+                "the target does not support the foreign file '{}'",
+                filename
+            ),
             Self::NoEntryPoint => write!(f, "no entry point defined"),
         }
     }
@@ -85,9 +104,64 @@ impl Debug for AsmType {
     }
 }
 
+/// The types that a native function's parameters and return value
+/// are converted to and from, when they are passed to it.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub enum AsmNativeType {
+    /// A number
+    Number,
+    /// A character
+    Character,
+    /// A boolean
+    Boolean,
+    /// The string at a `&char`
+    String,
+    /// No value
+    Void,
+}
+
+/// A plain function in the target language that is bound with
+/// `extern fn native::name`. The target generates an adapter for it,
+/// which pops its arguments off of the stack, converts them to the
+/// target's types, and pushes its result back.
+#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+pub struct AsmNativeFn {
+    pub name: Identifier,
+    pub params: Vec<AsmNativeType>,
+    /// The type of the trailing variadic parameter, if there is one.
+    /// Its arguments follow a cell with their count on the stack.
+    pub variadic: Option<AsmNativeType>,
+    pub return_type: AsmNativeType,
+}
+
+impl AsmNativeFn {
+    /// The prefix of foreign names that bind native functions
+    pub const PREFIX: &'static str = "native::";
+
+    pub fn new(
+        name: Identifier,
+        params: Vec<AsmNativeType>,
+        variadic: Option<AsmNativeType>,
+        return_type: AsmNativeType,
+    ) -> Self {
+        Self {
+            name,
+            params,
+            variadic,
+            return_type,
+        }
+    }
+
+    /// The name of the foreign function that calls this function
+    pub fn adapter_name(&self) -> Identifier {
+        format!("__oak_native__{}", self.name)
+    }
+}
+
 #[derive(Clone, Debug)]
 pub struct AsmProgram {
     externs: Vec<PathBuf>,
+    natives: Vec<AsmNativeFn>,
     funcs: Vec<AsmFunction>,
     memory_size: i32,
 }
@@ -95,9 +169,15 @@ pub struct AsmProgram {
 impl AsmProgram {
     const ENTRY_POINT: &'static str = "main";
 
-    pub fn new(externs: Vec<PathBuf>, funcs: Vec<AsmFunction>, memory_size: i32) -> Self {
+    pub fn new(
+        externs: Vec<PathBuf>,
+        natives: Vec<AsmNativeFn>,
+        funcs: Vec<AsmFunction>,
+        memory_size: i32,
+    ) -> Self {
         Self {
             externs,
+            natives,
             funcs,
             memory_size,
         }
@@ -111,8 +191,13 @@ impl AsmProgram {
         for filename in &self.externs {
             // Find them in the current working directory
             if let Ok(contents) = read_to_string(filename.clone()) {
-                // Add the contents of the file to the result
-                result += &contents
+                // Add the contents of the file to the result, in the
+                // form that the target includes it in
+                let name = filename.to_string_lossy().into_owned();
+                match target.foreign_file(&name, contents) {
+                    Some(code) => result += &code,
+                    None => return Err(AsmError::ForeignFileUnsupported(name)),
+                }
             } else {
                 // If the file doesn't exist, throw an error
                 if let Ok(name) = filename.clone().into_os_string().into_string() {
@@ -123,24 +208,50 @@ impl AsmProgram {
             }
         }
 
+        // Add an adapter for each native function, once per name
+        let mut adapted = BTreeSet::new();
+        for native in &self.natives {
+            if adapted.insert(native.name.clone()) {
+                match target.native_adapter(native) {
+                    Some(adapter) => result += &adapter,
+                    None => return Err(AsmError::NativeCallUnsupported(native.name.clone())),
+                }
+            }
+        }
+
+        // Call the functions that trivial functions pass their
+        // arguments on to directly, if the target wants that
+        let inlined;
+        let program = if target.inline_calls() {
+            inlined = self.inline_calls();
+            &inlined
+        } else {
+            self
+        };
+
+        // Only the functions that the program can call are assembled
+        let funcs = program.reachable_funcs(target);
+
         // Store the IDs of each function
         let mut func_ids = BTreeMap::new();
-        // The number of cells to preemptively allocate on the stack before the program starts
-        let mut global_scope_size = 0;
-        for (id, func) in self.funcs.iter().enumerate() {
+        // The program's data segment. These are the cells to preemptively
+        // allocate on the stack before the program starts, such as the
+        // characters of string literals.
+        let mut data_segment = Vec::new();
+        for (id, func) in funcs.iter().enumerate() {
             // Store the function's ID
             func_ids.insert(func.name.clone(), id as i32);
             // Add the function header to the output code
-            result += &target.fn_header(AsmFunction::get_assembled_name(id as i32));
+            result += &target.fn_header(target.fn_name(id as i32, &func.name));
         }
 
         // It is very important that the entry point is assembled last.
         // This is because of the way things are allocated on the stack.
         let mut entry_point = None;
-        for func in &self.funcs {
+        for func in &funcs {
             // Compile the function
             if !func.is_entry_point() {
-                result += &func.assemble(&func_ids, &mut global_scope_size, target)?;
+                result += &func.assemble(&func_ids, &mut data_segment, target)?;
             } else {
                 // Store the entry point for use later
                 // This has the side effect of ignoring multiple definitions
@@ -152,11 +263,26 @@ impl AsmProgram {
         if let Some(func) = entry_point {
             if let Some(main_id) = func_ids.get(Self::ENTRY_POINT) {
                 // Assemble the entry point code
-                result += &func.assemble(&func_ids, &mut global_scope_size, target)?;
+                result += &func.assemble(&func_ids, &mut data_segment, target)?;
+
+                // Add the contents of the data segment to the output code
+                result += &target.data_segment(&data_segment);
+
+                // Add the table of each function's output code name and
+                // original name to the output code, indexed by function ID.
+                let mut names = Vec::new();
+                for (id, func) in funcs.iter().enumerate() {
+                    names.push((target.fn_name(id as i32, &func.name), func.name.clone()));
+                }
+                result += &target.function_table(&names);
+
+                // Add the file each function is defined in, indexed by function ID
+                let files: Vec<String> = funcs.iter().map(|func| func.get_file()).collect();
+                result += &target.file_table(&files);
 
                 // Call the entry point
-                result += &target.begin_entry_point(global_scope_size, self.memory_size);
-                result += &target.call_fn(AsmFunction::get_assembled_name(*main_id));
+                result += &target.begin_entry_point(data_segment.len() as i32, self.memory_size);
+                result += &target.call_entry_point(target.fn_name(*main_id, Self::ENTRY_POINT));
                 result += &target.end_entry_point();
 
                 Ok(result)
@@ -167,11 +293,94 @@ impl AsmProgram {
             Err(AsmError::NoEntryPoint)
         }
     }
+
+    /// Find the functions that can be called from the entry point, so
+    /// that unused functions, such as most of the standard library, are
+    /// left out of the output code. If the target looks functions up by
+    /// their name at runtime, such as for `set_trap`, a function whose
+    /// name is used as a string literal is kept as well. If the target
+    /// exports every function, they are all kept.
+    fn reachable_funcs(&self, target: &impl Target) -> Vec<&AsmFunction> {
+        if target.exports_fns() {
+            return self.funcs.iter().collect();
+        }
+
+        let mut funcs_by_name = BTreeMap::new();
+        for func in &self.funcs {
+            funcs_by_name.insert(func.name.clone(), func);
+        }
+
+        let mut reachable = BTreeSet::new();
+        let mut names = vec![Self::ENTRY_POINT.to_string()];
+        while let Some(name) = names.pop() {
+            if let Some(func) = funcs_by_name.get(&name) {
+                if reachable.insert(name) {
+                    for stmt in &func.body {
+                        stmt.get_references(target.finds_fns_by_name(), &mut names);
+                    }
+                }
+            }
+        }
+
+        self.funcs
+            .iter()
+            .filter(|func| reachable.contains(&func.name))
+            .collect()
+    }
+
+    /// Replace each call to a function that only passes its arguments on
+    /// to another function, like the standard library's wrappers around
+    /// foreign functions, with a call to that function. The replaced
+    /// functions are then left out of the output code if nothing else
+    /// refers to them.
+    fn inline_calls(&self) -> Self {
+        let mut funcs_by_name = BTreeMap::new();
+        for func in &self.funcs {
+            funcs_by_name.insert(func.name.clone(), func);
+        }
+
+        let mut forwarded = BTreeMap::new();
+        for func in &self.funcs {
+            if !func.is_entry_point() {
+                if let Some(call) = func.forwarded_call(&funcs_by_name) {
+                    forwarded.insert(func.name.clone(), call);
+                }
+            }
+        }
+
+        // A function may forward its arguments to another function that
+        // forwards them again, so follow each call to the end of the chain.
+        // Functions that forward to each other in a cycle never return,
+        // so where the chain stops for them doesn't matter.
+        let mut inlined = BTreeMap::new();
+        for (name, call) in &forwarded {
+            let mut call = call;
+            for _ in 0..forwarded.len() {
+                match call {
+                    AsmExpression::Call(next) if forwarded.contains_key(next) => {
+                        call = &forwarded[next]
+                    }
+                    _ => break,
+                }
+            }
+            inlined.insert(name.clone(), call.clone());
+        }
+
+        let mut result = self.clone();
+        for func in &mut result.funcs {
+            for stmt in &mut func.body {
+                stmt.inline_calls(&inlined);
+            }
+        }
+        result
+    }
 }
 
 #[derive(Clone, Debug)]
 pub struct AsmFunction {
     name: Identifier,
+    /// The function's signature in the source code, for comments in the output code
+    signature: String,
     args: Vec<(Identifier, AsmType)>,
     return_type: AsmType,
     body: Vec<AsmStatement>,
@@ -180,12 +389,14 @@ pub struct AsmFunction {
 impl AsmFunction {
     pub fn new(
         name: Identifier,
+        signature: String,
         args: Vec<(Identifier, AsmType)>,
         return_type: AsmType,
         body: Vec<AsmStatement>,
     ) -> Self {
         Self {
             name,
+            signature,
             args,
             return_type,
             body,
@@ -196,17 +407,68 @@ impl AsmFunction {
         self.name == AsmProgram::ENTRY_POINT
     }
 
-    /// Use the function's ID to get the output code's name of the function.
-    /// An ID is used to prevent invalid output code function names, or names
-    /// that clash with standard library names such as "printf" or "malloc".
-    fn get_assembled_name(id: i32) -> String {
-        format!("fn{}", id)
+    /// The file that the function is defined in, if it is known
+    fn get_file(&self) -> String {
+        for stmt in &self.body {
+            if let AsmStatement::Location(file, _) = stmt {
+                return file.clone();
+            }
+        }
+        String::new()
+    }
+
+    /// Does the body of this function contain a tail call?
+    fn has_tail_call(&self) -> bool {
+        self.body.iter().any(AsmStatement::has_tail_call)
+    }
+
+    /// If this function does nothing but push its arguments in the order
+    /// it received them and call another function, which returns the
+    /// same number of cells, get that call. A call to this function can
+    /// be replaced with it, because the stack is already set up for it.
+    fn forwarded_call(&self, funcs: &BTreeMap<Identifier, &AsmFunction>) -> Option<AsmExpression> {
+        let mut exprs = Vec::new();
+        for stmt in &self.body {
+            match stmt {
+                AsmStatement::Expression(stmt_exprs) => exprs.extend(stmt_exprs),
+                AsmStatement::Location(_, _) => {}
+                _ => return None,
+            }
+        }
+
+        // The first argument is pushed last, so that it is on top of the stack
+        let (call, args) = exprs.split_last()?;
+        if args.len() != self.args.len() {
+            return None;
+        }
+        for ((name, _), arg) in self.args.iter().rev().zip(args) {
+            match arg {
+                AsmExpression::Variable(arg_name) if arg_name == name => {}
+                _ => return None,
+            }
+        }
+
+        // A call to another function in tail position is still a plain
+        // call where this function's calls are replaced with it
+        let (call, return_size) = match call {
+            AsmExpression::Call(name) | AsmExpression::MutualTailCall(name, _, _) => (
+                AsmExpression::Call(name.clone()),
+                funcs.get(name)?.return_type.get_size(),
+            ),
+            AsmExpression::ForeignCall(_, _, return_size) => ((*call).clone(), *return_size),
+            _ => return None,
+        };
+        if return_size == self.return_type.get_size() {
+            Some(call)
+        } else {
+            None
+        }
     }
 
     fn assemble(
         &self,
         func_ids: &BTreeMap<String, i32>,
-        global_scope_size: &mut i32,
+        data_segment: &mut Vec<f64>,
         target: &impl Target,
     ) -> Result<String, AsmError> {
         let mut result = String::new();
@@ -228,14 +490,14 @@ impl AsmFunction {
             result += &AsmStatement::Define(arg_name.clone(), *arg_type).assemble(
                 func_ids,
                 &mut vars,
-                global_scope_size,
+                data_segment,
                 &mut local_scope_size,
                 target,
             )?;
             result += &AsmStatement::Assign(*arg_type).assemble(
                 func_ids,
                 &mut vars,
-                global_scope_size,
+                data_segment,
                 &mut local_scope_size,
                 target,
             )?;
@@ -246,18 +508,26 @@ impl AsmFunction {
             result += &stmt.assemble(
                 func_ids,
                 &mut vars,
-                global_scope_size,
+                data_segment,
                 &mut local_scope_size,
                 target,
             )?;
         }
 
-        let start = target.establish_stack_frame(arg_size, local_scope_size);
-        result += &target.end_stack_frame(self.return_type.get_size(), local_scope_size);
+        // Tail calls jump back to the beginning of the function body
+        if self.has_tail_call() {
+            result = target.begin_tail_calls() + &result + &target.end_tail_calls();
+        }
 
         // Write the function as output code
         if let Some(id) = func_ids.get(&self.name) {
-            Ok(target.fn_definition(Self::get_assembled_name(*id), start + &result))
+            let start =
+                target.enter_fn(*id) + &target.establish_stack_frame(arg_size, local_scope_size);
+            result += &target.end_stack_frame(self.return_type.get_size(), local_scope_size);
+            result += &target.exit_fn(*id);
+
+            Ok(target.fn_comment(&self.signature)
+                + &target.fn_definition(target.fn_name(*id, &self.name), start + &result))
         } else {
             Err(AsmError::FunctionNotDefined(self.name.clone()))
         }
@@ -270,14 +540,99 @@ pub enum AsmStatement {
     Define(Identifier, AsmType),
     Assign(AsmType),
     Expression(Vec<AsmExpression>),
+    /// The file and line of the statement that follows
+    Location(String, usize),
 }
 
 impl AsmStatement {
+    /// Add the names of the functions this statement refers to to `names`,
+    /// along with the string literals it uses if `strings` is set, since
+    /// those may also name functions
+    fn get_references(&self, strings: bool, names: &mut Vec<Identifier>) {
+        match self {
+            Self::For(pre, cond, post, body) => {
+                for stmt in pre.iter().chain(cond).chain(post).chain(body) {
+                    stmt.get_references(strings, names)
+                }
+            }
+            Self::Expression(exprs) => {
+                for expr in exprs {
+                    match expr {
+                        AsmExpression::Call(name)
+                        | AsmExpression::TailCall(name, _)
+                        | AsmExpression::MutualTailCall(name, _, _)
+                        | AsmExpression::FunctionRef(name)
+                        | AsmExpression::MakeClosure(name, _) => names.push(name.clone()),
+                        AsmExpression::String(name) if strings => names.push(name.clone()),
+                        _ => {}
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Replace each call to a function in `inlined` with the call it forwards to
+    fn inline_calls(&mut self, inlined: &BTreeMap<Identifier, AsmExpression>) {
+        match self {
+            Self::For(pre, cond, post, body) => {
+                for stmt in pre.iter_mut().chain(cond).chain(post).chain(body) {
+                    stmt.inline_calls(inlined)
+                }
+            }
+            Self::Expression(exprs) => {
+                for expr in exprs {
+                    match expr {
+                        AsmExpression::Call(name) => {
+                            if let Some(call) = inlined.get(name) {
+                                *expr = call.clone();
+                            }
+                        }
+                        // The forwarded call takes the same arguments, so it
+                        // can still be a tail call if it is to an Oak function
+                        AsmExpression::MutualTailCall(name, own_arg_size, arg_size) => {
+                            match inlined.get(name) {
+                                Some(AsmExpression::Call(next)) => {
+                                    *expr = AsmExpression::MutualTailCall(
+                                        next.clone(),
+                                        *own_arg_size,
+                                        *arg_size,
+                                    )
+                                }
+                                Some(call) => *expr = call.clone(),
+                                None => {}
+                            }
+                        }
+                        _ => {}
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Does this statement contain a tail call?
+    fn has_tail_call(&self) -> bool {
+        match self {
+            Self::For(pre, cond, post, body) => pre
+                .iter()
+                .chain(cond)
+                .chain(post)
+                .chain(body)
+                .any(Self::has_tail_call),
+            Self::Expression(exprs) => exprs.iter().any(|expr| match expr {
+                AsmExpression::TailCall(_, _) | AsmExpression::MutualTailCall(_, _, _) => true,
+                _ => false,
+            }),
+            _ => false,
+        }
+    }
+
     fn assemble(
         &self,
         func_ids: &BTreeMap<String, i32>,
         vars: &mut BTreeMap<String, (i32, AsmType)>,
-        global_scope_size: &mut i32,
+        data_segment: &mut Vec<f64>,
         local_scope_size: &mut i32,
         target: &impl Target,
     ) -> Result<String, AsmError> {
@@ -295,6 +650,8 @@ impl AsmStatement {
             // Pop an address off of the stack, pop an item of size `data_type`
             // off of the stack, and store the item at the address
             Self::Assign(data_type) => target.store(data_type.get_size()),
+            // Record the line of the following statement for error messages
+            Self::Location(file, line) => target.set_line(file, *line),
             Self::For(pre, cond, post, body) => {
                 let mut result = String::new();
                 // Run the code that preps the for loop
@@ -302,7 +659,7 @@ impl AsmStatement {
                     result += &stmt.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -312,7 +669,7 @@ impl AsmStatement {
                     result += &expr.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -324,7 +681,7 @@ impl AsmStatement {
                     result += &stmt.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -334,7 +691,7 @@ impl AsmStatement {
                     result += &stmt.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -344,7 +701,7 @@ impl AsmStatement {
                     result += &expr.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -359,7 +716,7 @@ impl AsmStatement {
                     result += &expr.assemble(
                         func_ids,
                         vars,
-                        global_scope_size,
+                        data_segment,
                         local_scope_size,
                         target,
                     )?;
@@ -370,17 +727,40 @@ impl AsmStatement {
     }
 }
 
-#[derive(Clone, Debug)]
+#[derive(Clone, Debug, PartialEq)]
 pub enum AsmExpression {
     String(StringLiteral),
     Character(char),
     Float(f64),
     Void,
 
-    ForeignCall(Identifier),
+    /// Call a foreign function with the number of cells
+    /// it takes as arguments and returns.
+    ForeignCall(Identifier, i32, i32),
 
     Variable(Identifier),
     Call(Identifier),
+    /// Call the function being assembled, whose arguments take the given
+    /// number of cells, as the last thing it does. The call can reuse the
+    /// function's stack frame instead of establishing a new one.
+    TailCall(Identifier, i32),
+    /// Call another function, which returns as many cells as the function
+    /// being assembled, as the last thing it does. The first size is that
+    /// of the function's own arguments, and the second is the callee's.
+    /// The callee's stack frame can replace the function's.
+    MutualTailCall(Identifier, i32, i32),
+    /// Push the ID of a function, which can be called with `CallIndirect`
+    FunctionRef(Identifier),
+    /// Pop a function's ID off of the stack, and call the function.
+    /// This also calls closures, whose environment becomes the first
+    /// argument of the function.
+    CallIndirect,
+    /// Move the given number of captured cells off of the stack into an
+    /// environment on the heap, and push a closure of the function: the
+    /// address of the environment followed by the function's ID.
+    MakeClosure(Identifier, i32),
+    /// Pop a closure off of the stack, and free its environment
+    FreeClosure,
     Refer(Identifier),
     Deref(i32),
 
@@ -399,7 +779,7 @@ impl AsmExpression {
         &self,
         func_ids: &BTreeMap<String, i32>,
         vars: &mut BTreeMap<String, (i32, AsmType)>,
-        global_scope_size: &mut i32,
+        data_segment: &mut Vec<f64>,
         local_scope_size: &mut i32,
         target: &impl Target,
     ) -> Result<String, AsmError> {
@@ -407,27 +787,22 @@ impl AsmExpression {
             Self::String(s) => {
                 // The address of the string is at the current first
                 // empty spot on the stack.
-                let address = *global_scope_size;
-                // The size of the string is the length of the characters,
-                // plus 1 for the zero terminated character.
-                let size = s.len() as i32 + 1;
+                let address = data_segment.len() as i32;
 
-                // Push each character of the string onto the stack
-                let mut result = String::new();
+                // Add each character of the string to the data segment,
+                // followed by the zero terminated character.
+                let mut data = Vec::new();
                 for ch in s.chars() {
-                    result += &target.push(ch as u8 as f64);
+                    data.push(ch as u8 as f64);
                 }
-                // Push the zero terminated character
-                result += &target.push(0.0);
+                data.push(0.0);
 
                 // Store the characters at the address of the string,
                 // and push the address onto the stack.
-                result += &(target.push(address as f64)
-                    + &target.store(size)
-                    + &target.push(address as f64));
+                let result = target.store_data(address, &data) + &target.push(address as f64);
 
                 // Increment the amount of data stored on the stack
-                *global_scope_size += size;
+                data_segment.extend(data);
                 result
             }
             // Push a character onto the stack
@@ -455,14 +830,69 @@ impl AsmExpression {
             // Call a function
             Self::Call(fn_name) => {
                 if let Some(fn_id) = func_ids.get(fn_name) {
-                    target.call_fn(AsmFunction::get_assembled_name(*fn_id))
+                    target.call_fn(target.fn_name(*fn_id, fn_name))
+                } else {
+                    return Err(AsmError::FunctionNotDefined(fn_name.clone()));
+                }
+            }
+
+            // Push the ID of a function to call indirectly
+            Self::FunctionRef(fn_name) => {
+                if let Some(fn_id) = func_ids.get(fn_name) {
+                    target.push(*fn_id as f64)
+                } else {
+                    return Err(AsmError::FunctionNotDefined(fn_name.clone()));
+                }
+            }
+            // Call a function by the ID on the top of the stack
+            Self::CallIndirect => match target.call_indirect() {
+                Some(code) => code,
+                None => return Err(AsmError::IndirectCallUnsupported),
+            },
+
+            // Package a function with its captured environment
+            Self::MakeClosure(fn_name, size) => {
+                if let Some(fn_id) = func_ids.get(fn_name) {
+                    match target.make_closure(*fn_id, *size) {
+                        Some(code) => code,
+                        None => return Err(AsmError::IndirectCallUnsupported),
+                    }
+                } else {
+                    return Err(AsmError::FunctionNotDefined(fn_name.clone()));
+                }
+            }
+            // Free the environment of a closure
+            Self::FreeClosure => match target.free_closure() {
+                Some(code) => code,
+                None => return Err(AsmError::IndirectCallUnsupported),
+            },
+
+            // Call the current function in tail position
+            Self::TailCall(fn_name, arg_size) => {
+                if let Some(fn_id) = func_ids.get(fn_name) {
+                    target.tail_call(target.fn_name(*fn_id, fn_name), *arg_size)
+                } else {
+                    return Err(AsmError::FunctionNotDefined(fn_name.clone()));
+                }
+            }
+
+            // Call another function in tail position
+            Self::MutualTailCall(fn_name, own_arg_size, arg_size) => {
+                if let Some(fn_id) = func_ids.get(fn_name) {
+                    target.mutual_tail_call(
+                        target.fn_name(*fn_id, fn_name),
+                        *own_arg_size,
+                        *arg_size,
+                    )
                 } else {
                     return Err(AsmError::FunctionNotDefined(fn_name.clone()));
                 }
             }
 
             // Call a foreign function
-            Self::ForeignCall(fn_name) => target.call_foreign_fn(fn_name.clone()),
+            Self::ForeignCall(fn_name, arg_size, return_size) => {
+                target.call_foreign_fn(fn_name.clone(), *arg_size, *return_size)
+            }
 
             // Allocate data on the heap
             Self::Alloc => target.allocate(),
@@ -492,3 +922,191 @@ impl AsmExpression {
         })
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::target::Go;
+
+    fn function(name: &str, body: Vec<AsmExpression>) -> AsmFunction {
+        AsmFunction::new(
+            name.to_string(),
+            String::new(),
+            vec![],
+            AsmType::void(),
+            vec![AsmStatement::Expression(body)],
+        )
+    }
+
+    /// A function that takes `args` numbers, pushes them in `order`,
+    /// and ends with `call`, which returns `return_size` cells
+    fn wrapper(
+        name: &str,
+        args: &[&str],
+        order: &[&str],
+        call: AsmExpression,
+        return_size: i32,
+    ) -> AsmFunction {
+        let mut body: Vec<_> = order
+            .iter()
+            .map(|arg| AsmExpression::Variable(arg.to_string()))
+            .collect();
+        body.push(call);
+        AsmFunction::new(
+            name.to_string(),
+            String::new(),
+            args.iter()
+                .map(|arg| (arg.to_string(), AsmType::float()))
+                .collect(),
+            AsmType::new(return_size),
+            vec![AsmStatement::Expression(body)],
+        )
+    }
+
+    /// Inline the calls of a program made of `funcs`, and get the last
+    /// expression of the function named `name`
+    fn inlined_call(funcs: Vec<AsmFunction>, name: &str) -> AsmExpression {
+        let program = AsmProgram::new(vec![], vec![], funcs, 512).inline_calls();
+        let func = program.funcs.iter().find(|func| func.name == name).unwrap();
+        match func.body.last() {
+            Some(AsmStatement::Expression(exprs)) => exprs.last().unwrap().clone(),
+            _ => panic!("`{}` doesn't end with an expression", name),
+        }
+    }
+
+    fn call(name: &str) -> AsmExpression {
+        AsmExpression::Call(name.to_string())
+    }
+
+    fn reachable_names(program: &AsmProgram, target: &impl Target) -> Vec<Identifier> {
+        program
+            .reachable_funcs(target)
+            .iter()
+            .map(|func| func.name.clone())
+            .collect()
+    }
+
+    /// A program whose entry point calls `used`, and names `handler`
+    /// with a string literal, but never calls `handler` or `unused`
+    fn program() -> AsmProgram {
+        AsmProgram::new(
+            vec![],
+            vec![],
+            vec![
+                function("unused", vec![]),
+                function("used", vec![]),
+                function("handler", vec![]),
+                function(
+                    "main",
+                    vec![
+                        AsmExpression::Call("used".to_string()),
+                        AsmExpression::String("handler".to_string()),
+                        AsmExpression::ForeignCall("set_trap".to_string(), 1, 0),
+                    ],
+                ),
+            ],
+            512,
+        )
+    }
+
+    #[test]
+    fn unreachable_functions_are_left_out() {
+        assert_eq!(reachable_names(&program(), &C), vec!["used", "main"]);
+    }
+
+    #[test]
+    fn functions_named_by_strings_are_kept_for_go() {
+        assert_eq!(
+            reachable_names(&program(), &Go::default()),
+            vec!["used", "handler", "main"]
+        );
+    }
+
+    #[test]
+    fn every_function_is_kept_for_a_go_package() {
+        let mut go = Go::default();
+        go.package = Some("oak".to_string());
+        assert_eq!(
+            reachable_names(&program(), &go),
+            vec!["unused", "used", "handler", "main"]
+        );
+    }
+
+    #[test]
+    fn calls_to_wrappers_are_replaced_with_the_calls_they_forward() {
+        let prn = AsmExpression::ForeignCall("prn".to_string(), 1, 0);
+        let funcs = vec![
+            wrapper("putnum", &["n"], &["n"], prn.clone(), 0),
+            function("main", vec![AsmExpression::Float(1.0), call("putnum")]),
+        ];
+        assert_eq!(inlined_call(funcs, "main"), prn);
+    }
+
+    #[test]
+    fn chains_of_wrappers_are_followed_to_the_end() {
+        let funcs = vec![
+            wrapper("first", &["a", "b"], &["b", "a"], call("second"), 1),
+            wrapper("second", &["a", "b"], &["b", "a"], call("last"), 1),
+            wrapper("last", &["a", "b"], &["a", "b"], AsmExpression::Add, 1),
+            function("main", vec![call("first")]),
+        ];
+        assert_eq!(inlined_call(funcs, "main"), call("last"));
+    }
+
+    #[test]
+    fn functions_that_change_their_arguments_are_not_inlined() {
+        let funcs = vec![
+            wrapper("swapped", &["a", "b"], &["a", "b"], call("last"), 1),
+            wrapper("last", &["a", "b"], &["a", "b"], AsmExpression::Add, 1),
+            function("main", vec![call("swapped")]),
+        ];
+        assert_eq!(inlined_call(funcs, "main"), call("swapped"));
+    }
+
+    #[test]
+    fn functions_that_change_the_return_size_are_not_inlined() {
+        let funcs = vec![
+            wrapper("dropped", &["a", "b"], &["b", "a"], call("last"), 0),
+            wrapper("last", &["a", "b"], &["a", "b"], AsmExpression::Add, 1),
+            function("main", vec![call("dropped")]),
+        ];
+        assert_eq!(inlined_call(funcs, "main"), call("dropped"));
+    }
+
+    #[test]
+    fn tail_calls_to_wrappers_stay_tail_calls() {
+        let funcs = vec![
+            wrapper("wrapper", &["n"], &["n"], call("last"), 1),
+            wrapper("last", &["n"], &["n"], AsmExpression::Sign, 1),
+            wrapper(
+                "caller",
+                &["n"],
+                &["n"],
+                AsmExpression::MutualTailCall("wrapper".to_string(), 1, 1),
+                1,
+            ),
+            function("main", vec![call("caller")]),
+        ];
+        assert_eq!(
+            inlined_call(funcs, "caller"),
+            AsmExpression::MutualTailCall("last".to_string(), 1, 1)
+        );
+    }
+
+    #[test]
+    fn tail_calls_to_foreign_wrappers_become_foreign_calls() {
+        let prn = AsmExpression::ForeignCall("prn".to_string(), 1, 1);
+        let funcs = vec![
+            wrapper("putnum", &["n"], &["n"], prn.clone(), 1),
+            wrapper(
+                "caller",
+                &["n"],
+                &["n"],
+                AsmExpression::MutualTailCall("putnum".to_string(), 1, 1),
+                1,
+            ),
+            function("main", vec![call("caller")]),
+        ];
+        assert_eq!(inlined_call(funcs, "caller"), prn);
+    }
+}
@@ -1,9 +1,9 @@
 use clap::{clap_app, crate_authors, crate_version, AppSettings::ArgRequiredElseHelp};
-use oakc::{compile, generate_docs, Go, C, TS};
+use oakc::{compile, generate_docs, generate_stubs, Go, GoVm, C, TS};
 use std::{
     fs::{read_to_string, write},
     io::Result,
-    path::PathBuf,
+    path::{Path, PathBuf},
 };
 use termimad::*;
 
@@ -15,11 +15,29 @@ fn main() {
         (@group target =>
             (@arg cc: -c --cc "Compile with C backend")
             (@arg go: -g --go "Compile with Golang backend")
+            (@arg go_vm: --("go-vm") "Compile with Golang backend to bytecode for an interpreter, which builds faster")
             (@arg ts: -t --ts "Compile with TypeScript backend")
         )
         (@subcommand c =>
             (about: "Compile an Oak file")
             (@arg FILE: +required "The input file to use")
+            (@arg WRAP: --wrap +takes_value +use_delimiter "Generate bindings for Go functions, such as `strings.ToUpper,math.Hypot`")
+            (@arg MODULE: --module +takes_value "Write the Go output to a directory as a module with a go.mod, and its runtime as the core, ffi, debug and std packages under the module's oakrt directory, and build it there")
+            (@arg PPROF: --pprof +takes_value "Serve Go pprof profiles from the compiled program at an address, such as `localhost:6060`")
+            (@arg TINYGO: --tinygo "Build the Go output with TinyGo, for microcontrollers")
+            (@arg WASM: --wasm "Build the Go output as `main.wasm` for the browser, with I/O through the page")
+            (@arg PLUGIN: --plugin "Build the Go output as a plugin, `main.so`, that exports `Run(stdin io.Reader, stdout io.Writer) error`")
+            (@arg GO_PACKAGE: --("go-package") +takes_value requires[MODULE] conflicts_with[PLUGIN] conflicts_with[WASM] conflicts_with[TINYGO] conflicts_with[EMIT_TESTS] conflicts_with[RUN] conflicts_with[OUTPUT] conflicts_with[GRAPHICS] conflicts_with[EMBED] "Write the Go output to its module as a package with this name, such as `oakvm`, which Go applications import to call the program's functions with its `Machine` type")
+            (@arg EMIT_TESTS: --("emit-tests") requires[MODULE] "Write golden-output tests for the Go module, which compare its output for each input in its testdata with `go test`")
+            (@arg OUTPUT: -o --output +takes_value "Write the program that the Go output builds to this file")
+            (@arg KEEP_SOURCE: --("keep-source") "Keep the `main.go` that the Go output builds from")
+            (@arg RUN: --run conflicts_with[WASM] conflicts_with[PLUGIN] "Run the Go output with `go run` instead of building it")
+            (@arg GOOS: --goos +takes_value conflicts_with[WASM] conflicts_with[RUN] "Build the Go output for another operating system, such as `windows`")
+            (@arg GOARCH: --goarch +takes_value conflicts_with[WASM] conflicts_with[RUN] "Build the Go output for another architecture, such as `arm64`")
+            (@arg GRAPHICS: --graphics requires[MODULE] conflicts_with[TINYGO] conflicts_with[WASM] conflicts_with[PLUGIN] conflicts_with[EMIT_TESTS] "Include the graphics functions in the Go output's standard library, which draw to a window with ebiten")
+            (@arg SQLITE: --sqlite requires[MODULE] conflicts_with[TINYGO] conflicts_with[WASM] "Include the SQLite functions in the Go output's standard library, with a pure Go driver")
+            (@arg GEN_STUBS: --("gen-stubs") +takes_value "Instead of compiling, write a Go file to this path with a stub for each foreign function that the input file binds with `extern fn`")
+            (@arg EMBED: --embed "With the Go bytecode backend, embed the program as an image that the output program can swap for another with `-program`")
         )
         (@subcommand doc =>
             (about: "Generate documentation for an Oak file")
@@ -43,11 +61,69 @@ fn main() {
                     PathBuf::from("./")
                 };
 
+                // Configure the Golang backend
+                let mut go = Go::default();
+                if let Some(names) = sub_matches.values_of("WRAP") {
+                    go.wrap = names.map(String::from).collect();
+                }
+                go.pprof = sub_matches.value_of("PPROF").map(String::from);
+                go.module = sub_matches.value_of("MODULE").map(String::from);
+                go.tinygo = sub_matches.is_present("TINYGO");
+                go.wasm = sub_matches.is_present("WASM");
+                go.plugin = sub_matches.is_present("PLUGIN");
+                go.package = sub_matches.value_of("GO_PACKAGE").map(String::from);
+                go.emit_tests = sub_matches.is_present("EMIT_TESTS");
+                go.output = sub_matches.value_of("OUTPUT").map(String::from);
+                go.keep_source = sub_matches.is_present("KEEP_SOURCE");
+                go.run = sub_matches.is_present("RUN");
+                go.goos = sub_matches.value_of("GOOS").map(String::from);
+                go.goarch = sub_matches.value_of("GOARCH").map(String::from);
+                go.graphics = sub_matches.is_present("GRAPHICS");
+                go.sqlite = sub_matches.is_present("SQLITE");
+
+                // Write stubs for the foreign functions instead of compiling
+                if let Some(stubs_file) = sub_matches.value_of("GEN_STUBS") {
+                    if Path::new(stubs_file).exists() {
+                        eprintln!("error: \"{}\" already exists", stubs_file);
+                        return;
+                    }
+
+                    let stubs_result = if matches.is_present("go_vm") {
+                        generate_stubs(&input_file, contents, GoVm::new(go))
+                    } else if matches.is_present("cc") {
+                        generate_stubs(&input_file, contents, C)
+                    } else if matches.is_present("ts") {
+                        generate_stubs(&input_file, contents, TS)
+                    } else {
+                        generate_stubs(&input_file, contents, go)
+                    };
+
+                    match stubs_result {
+                        Result::Ok(stubs) => {
+                            if write(stubs_file, stubs).is_ok() {
+                                println!("stub generation successful")
+                            } else {
+                                eprintln!("error: could not write to file \"{}\"", stubs_file);
+                            }
+                        }
+                        Result::Err(error) => {
+                            if let Some(inner_error) = error.get_ref() {
+                                eprintln!("error: {}", inner_error);
+                            }
+                        }
+                    }
+                    return;
+                }
+
                 // Compile using the target backend
                 let compile_result = if matches.is_present("cc") {
                     compile(&cwd, &input_file, contents, C)
                 } else if matches.is_present("go") {
-                    compile(&cwd, &input_file, contents, Go)
+                    compile(&cwd, &input_file, contents, go)
+                } else if matches.is_present("go_vm") {
+                    let mut go_vm = GoVm::new(go);
+                    go_vm.embed = sub_matches.is_present("EMBED");
+                    compile(&cwd, &input_file, contents, go_vm)
                 } else if matches.is_present("ts") {
                     compile(&cwd, &input_file, contents, TS)
                 } else {
@@ -55,6 +131,8 @@ fn main() {
                 };
 
                 match compile_result {
+                    // The program's output is the result of running it
+                    Result::Ok(_) if sub_matches.is_present("RUN") => {}
                     Result::Ok(_) => println!("compilation successful"),
                     Result::Err(error) => {
                         if let Some(inner_error) = error.get_ref() {
@@ -85,7 +163,7 @@ fn main() {
                 let docs = if matches.is_present("cc") {
                     generate_docs(&cwd, input_file, contents, C)
                 } else if matches.is_present("go") {
-                    generate_docs(&cwd, input_file, contents, Go)
+                    generate_docs(&cwd, input_file, contents, Go::default())
                 } else {
                     generate_docs(&cwd, input_file, contents, C)
                 };
@@ -7,6 +7,7 @@ use std::{
 };
 
 use crate::{
+    asm::AsmNativeFn,
     mir::{
         MirDeclaration, MirExpression, MirFunction, MirProgram, MirStatement, MirStructure, MirType,
     },
@@ -71,6 +72,7 @@ impl HirProgram {
                 }
                 HirDeclaration::Structure(structure) => content += &structure.generate_docs(),
                 HirDeclaration::Function(function) => content += &function.generate_docs(false),
+                HirDeclaration::VariadicExtern(function) => content += &function.generate_docs(),
                 HirDeclaration::Constant(doc, name, constant) => {
                     content += &format!("### *const* **{}** = {}\n---", name, constant);
                     if let Some(s) = doc {
@@ -136,6 +138,9 @@ impl HirProgram {
                     let file_path = cwd.join(filename.clone());
                     mir_decls.push(MirDeclaration::Extern(file_path))
                 }
+                HirDeclaration::Native(native) => {
+                    mir_decls.push(MirDeclaration::Native(native.clone()))
+                }
                 HirDeclaration::Error(err) => return Err(HirError::UserError(err.clone())),
 
                 HirDeclaration::Memory(size) => {
@@ -178,6 +183,9 @@ pub enum HirError {
     /// This occurs when a literal expression is cast as a pointer.
     /// This isn't ACTUALLY bad, but it's intended to promote type correctness.
     CastLiteralAsPointer(HirType),
+    /// Calling a variadic foreign function without an argument
+    /// for each of the parameters before its variadic one
+    NotEnoughVariadicArguments(Identifier, usize),
 }
 
 impl Display for HirError {
@@ -197,6 +205,11 @@ impl Display for HirError {
             Self::FailedAssertion(assertion) => write!(f, "failed assertion '{}'", assertion),
             Self::TypeNotDefined(type_name) => write!(f, "type not defined '{}'", type_name),
             Self::CastLiteralAsPointer(t) => write!(f, "cannot cast literal to type '{}'", t),
+            Self::NotEnoughVariadicArguments(name, count) => write!(
+                f,
+                "variadic function '{}' takes at least {} argument(s)",
+                name, count
+            ),
         }
     }
 }
@@ -309,6 +322,10 @@ pub enum HirDeclaration {
     Error(String),
     /// Include a foreign file using the `extern` flag.
     Extern(String),
+    /// Call a native function bound with `extern fn native::name`
+    Native(AsmNativeFn),
+    /// Bind a foreign function with a trailing variadic parameter
+    VariadicExtern(HirVariadicExtern),
     /// Set the memory used for the stack and heap.
     Memory(i32),
     /// Mark that the standard library is required for the program
@@ -514,6 +531,112 @@ impl HirFunction {
     }
 }
 
+/// A foreign function bound by an `extern fn` declaration whose last
+/// parameter is variadic, such as `args: ...num`. Oak functions take a
+/// fixed number of arguments, so this isn't wrapped in a function like
+/// other foreign functions. Each call to it is replaced with a foreign
+/// call instead, where the variadic arguments follow a cell with their
+/// count.
+#[derive(Clone, Debug)]
+pub struct HirVariadicExtern {
+    /// The optional docstring for the function
+    doc: Option<String>,
+    /// The name of the foreign function to call
+    foreign_name: Identifier,
+    /// The name that the function is called with
+    name: Identifier,
+    /// The parameters before the variadic parameter
+    args: Vec<(Identifier, HirType)>,
+    /// The variadic parameter, whose type each variadic argument has
+    variadic: (Identifier, HirType),
+    /// The function's return type
+    return_type: HirType,
+}
+
+impl HirVariadicExtern {
+    pub fn new(
+        doc: Option<String>,
+        foreign_name: Identifier,
+        name: Identifier,
+        args: Vec<(Identifier, HirType)>,
+        variadic: (Identifier, HirType),
+        return_type: HirType,
+    ) -> Self {
+        Self {
+            doc,
+            foreign_name,
+            name,
+            args,
+            variadic,
+            return_type,
+        }
+    }
+
+    /// Generate the documentation for the function.
+    fn generate_docs(&self) -> String {
+        let mut result = format!("### *fn* **{}**(", self.name);
+        for (arg_name, arg_type) in &self.args {
+            result += &format!("*{}*: {}, ", arg_name, arg_type)
+        }
+        result += &format!("*{}*: ...{})", self.variadic.0, self.variadic.1);
+
+        if self.return_type != HirType::Void {
+            // If the function is a non-void function, add the return type
+            result += " *->* ";
+            result += &self.return_type.to_string();
+        }
+        result += "\n";
+
+        if let Some(doc) = &self.doc {
+            result += "---\n";
+            result += &(doc.trim().to_string() + "\n");
+        }
+        result
+    }
+
+    /// Convert a call to this function into a foreign call. The
+    /// arguments are cast to their parameters' types, so they must
+    /// be the same size.
+    fn to_mir_call(
+        &self,
+        arguments: &Vec<HirExpression>,
+        decls: &Vec<HirDeclaration>,
+        constants: &BTreeMap<Identifier, HirConstant>,
+    ) -> Result<MirExpression, HirError> {
+        if arguments.len() < self.args.len() {
+            return Err(HirError::NotEnoughVariadicArguments(
+                self.name.clone(),
+                self.args.len(),
+            ));
+        }
+
+        let (fixed, rest) = arguments.split_at(self.args.len());
+        let mut result = Vec::new();
+        for ((_, t), arg) in self.args.iter().zip(fixed) {
+            result.push(MirExpression::TypeCast(
+                Box::new(arg.to_mir_expr(decls, constants)?),
+                t.to_mir_type(),
+            ));
+        }
+        // The foreign function pops the count before the variadic arguments
+        result.push(MirExpression::Float(rest.len() as f64));
+        for arg in rest {
+            result.push(MirExpression::TypeCast(
+                Box::new(arg.to_mir_expr(decls, constants)?),
+                self.variadic.1.to_mir_type(),
+            ));
+        }
+
+        Ok(MirExpression::TypeCast(
+            Box::new(MirExpression::ForeignCall(
+                self.foreign_name.clone(),
+                result,
+            )),
+            self.return_type.to_mir_type(),
+        ))
+    }
+}
+
 /// This type represents all constant expressions.
 #[derive(Clone, Debug, PartialEq)]
 pub enum HirConstant {
@@ -781,6 +904,9 @@ pub enum HirStatement {
 
     /// Any expression
     Expression(HirExpression),
+
+    /// The file and line of the statement that follows
+    Location(String, usize),
 }
 
 impl HirStatement {
@@ -869,6 +995,7 @@ impl HirStatement {
             ),
 
             Self::Expression(expr) => MirStatement::Expression(expr.to_mir_expr(decls, constants)?),
+            Self::Location(file, line) => MirStatement::Location(file.clone(), *line),
         })
     }
 }
@@ -1088,13 +1215,22 @@ impl HirExpression {
                 t.to_mir_type(),
             ),
 
-            Self::Call(name, arguments) => MirExpression::Call(name.clone(), {
-                let mut result = Vec::new();
-                for arg in arguments {
-                    result.push(arg.to_mir_expr(decls, constants)?);
+            Self::Call(name, arguments) => {
+                for decl in decls {
+                    if let HirDeclaration::VariadicExtern(function) = decl {
+                        if &function.name == name {
+                            return function.to_mir_call(arguments, decls, constants);
+                        }
+                    }
                 }
-                result
-            }),
+                MirExpression::Call(name.clone(), {
+                    let mut result = Vec::new();
+                    for arg in arguments {
+                        result.push(arg.to_mir_expr(decls, constants)?);
+                    }
+                    result
+                })
+            }
 
             Self::ForeignCall(name, arguments) => MirExpression::ForeignCall(name.clone(), {
                 let mut result = Vec::new();
@@ -1,9 +1,9 @@
 #![allow(warnings, clippy, unknown_lints)]
 use std::{
-    collections::BTreeMap,
+    collections::{BTreeMap, BTreeSet},
     env::consts::{FAMILY, OS},
     fmt::Display,
-    io::Result,
+    io::{self, ErrorKind, Result},
     path::PathBuf,
     process::exit,
 };
@@ -18,7 +18,7 @@ use hir::{HirConstant, HirProgram};
 use tir::TirProgram;
 
 mod target;
-pub use target::{Go, Target, C, TS};
+pub use target::{Go, GoVm, Target, C, TS};
 
 use asciicolor::Colorize;
 use comment::cpp::strip;
@@ -99,6 +99,39 @@ pub fn generate_docs(
     )
 }
 
+/// Generate stubs in the target language for the foreign functions
+/// that a file's `extern fn` declarations bind, for the user to fill in
+pub fn generate_stubs(
+    // The name of the input file to generate stubs for
+    filename: &str,
+    // The code to generate stubs for
+    input: impl ToString,
+    // The target to generate the stubs for
+    target: impl Target,
+) -> Result<String> {
+    // A foreign function may be bound more than once
+    let mut names = BTreeSet::new();
+    let program = parse(filename, input);
+    let foreign_fns: Vec<_> = program
+        .foreign_fns()
+        .into_iter()
+        .filter(|foreign_fn| names.insert(foreign_fn.foreign_name.clone()))
+        .collect();
+    if foreign_fns.is_empty() {
+        return Err(io::Error::new(
+            ErrorKind::Other,
+            format!("`{}` doesn't bind any foreign functions", filename),
+        ));
+    }
+    match target.foreign_stubs(filename, &foreign_fns, &program.foreign_structs()) {
+        Some(stubs) => Ok(stubs),
+        None => Err(io::Error::new(
+            ErrorKind::Other,
+            "the target cannot generate foreign function stubs",
+        )),
+    }
+}
+
 fn print_compile_error(e: impl Display) -> ! {
     eprintln!("compilation error: {}", e.bright_red().underline());
     exit(1);
@@ -137,6 +170,19 @@ pub fn compile(
         .get_declarations(),
     );
 
+    // Add the bindings generated by the target to the users code
+    let (oak_bindings, foreign_bindings) = match target.generate_bindings() {
+        Ok(bindings) => bindings,
+        Err(e) => print_compile_error(e),
+    };
+    hir.extend_declarations(
+        match parse("bindings.ok", oak_bindings).compile(cwd, &mut constants) {
+            Ok(output) => output,
+            Err(e) => print_compile_error(e),
+        }
+        .get_declarations(),
+    );
+
     // If the user specifies that they want to include the standard library
     if hir.use_std() {
         // Then add the standard library code to the users code
@@ -155,9 +201,13 @@ pub fn compile(
         Ok(mir) => match mir.assemble() {
             Ok(asm) => match asm.assemble(&target) {
                 Ok(result) => target.compile(if hir.use_std() {
-                    target.core_prelude() + &target.std() + &result + &target.core_postlude()
+                    target.core_prelude()
+                        + &target.std()
+                        + &foreign_bindings
+                        + &result
+                        + &target.core_postlude()
                 } else {
-                    target.core_prelude() + &result + &target.core_postlude()
+                    target.core_prelude() + &foreign_bindings + &result + &target.core_postlude()
                 }),
                 Err(e) => print_compile_error(e),
             },
@@ -174,7 +224,7 @@ pub fn parse(filename: &str, input: impl ToString) -> TirProgram {
     // Parse the users code and return the resulting TIR
     match parser::ProgramParser::new().parse(filename, &code, code) {
         // if the parser succeeds, build will succeed
-        Ok(parsed) => parsed,
+        Ok(mut parsed) => parsed.prefix_foreign_fns().clone(),
         // if the parser succeeds, annotate code with comments
         Err(e) => {
             eprintln!("{}", format_error(&code, e));
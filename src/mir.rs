@@ -5,7 +5,7 @@ use std::{
 };
 
 use crate::{
-    asm::{AsmExpression, AsmFunction, AsmProgram, AsmStatement, AsmType},
+    asm::{AsmExpression, AsmFunction, AsmNativeFn, AsmProgram, AsmStatement, AsmType},
     Identifier, StringLiteral,
 };
 
@@ -410,6 +410,7 @@ impl MirProgram {
     pub fn assemble(&self) -> Result<AsmProgram, MirError> {
         let Self(decls, memory_size) = self.clone();
         let mut externs = Vec::new();
+        let mut natives = Vec::new();
         let mut funcs = BTreeMap::new();
         let mut structs = BTreeMap::new();
         let mut result = Vec::new();
@@ -420,6 +421,7 @@ impl MirProgram {
                     structure.declare(&mut funcs, &mut structs)?
                 }
                 MirDeclaration::Extern(filename) => externs.push(filename.clone()),
+                MirDeclaration::Native(native) => natives.push(native.clone()),
             }
         }
 
@@ -427,7 +429,7 @@ impl MirProgram {
             result.extend(decl.assemble(&mut funcs, &mut structs)?);
         }
 
-        Ok(AsmProgram::new(externs, result, memory_size))
+        Ok(AsmProgram::new(externs, natives, result, memory_size))
     }
 }
 
@@ -436,6 +438,7 @@ pub enum MirDeclaration {
     Structure(MirStructure),
     Function(MirFunction),
     Extern(PathBuf),
+    Native(AsmNativeFn),
 }
 
 impl MirDeclaration {
@@ -627,12 +630,25 @@ impl MirFunction {
             stmt.type_check(&vars, funcs, structs)?
         }
 
+        let mut asm_drops = Vec::new();
+        let mut has_drops = false;
         for var_name in vars.clone().keys() {
             let var_drop =
                 MirExpression::Variable(var_name.clone()).call_drop(&vars, funcs, structs)?;
-            asm_body.extend(var_drop.assemble(&mut vars, funcs, structs, &mut instance_count, &mut 0)?);
+            has_drops = has_drops || var_drop != MirExpression::Void;
+            asm_drops.extend(var_drop.assemble(&mut vars, funcs, structs, &mut instance_count, &mut 0)?);
         }
 
+        // If nothing is dropped at the end of the function, a call
+        // in the last statement of the body is a tail call.
+        if !has_drops {
+            if let Some(stmt) = self.body.last() {
+                let arg_size = asm_args.iter().map(|(_, t)| t.get_size()).sum();
+                stmt.mark_tail_calls(self, arg_size, funcs, structs, &mut asm_body);
+            }
+        }
+        asm_body.extend(asm_drops);
+
         // Check return type
         let mut has_returned = false;
         for (i, stmt) in self.body.iter().enumerate() {
@@ -656,12 +672,44 @@ impl MirFunction {
 
         Ok(AsmFunction::new(
             self.name.clone(),
+            self.signature(),
             asm_args,
             self.return_type.to_asm_type(structs)?,
             asm_body,
         ))
     }
 
+    /// The function's signature as it is written in Oak, such as `fn square(n: num) -> num`
+    fn signature(&self) -> String {
+        let args: Vec<String> = self
+            .args
+            .iter()
+            .map(|(name, t)| format!("{}: {}", name, t))
+            .collect();
+        format!("fn {}({}) -> {}", self.name, args.join(", "), self.return_type)
+    }
+
+    /// If the function `name` returns as many cells as this function, so
+    /// that this function can end with a tail call to it, get the number
+    /// of cells that its arguments take
+    fn tail_call_arg_size(
+        &self,
+        name: &Identifier,
+        funcs: &BTreeMap<Identifier, MirFunction>,
+        structs: &BTreeMap<Identifier, MirStructure>,
+    ) -> Option<i32> {
+        let callee = funcs.get(name)?;
+        let return_size = self.return_type.to_asm_type(structs).ok()?.get_size();
+        if callee.return_type.to_asm_type(structs).ok()?.get_size() != return_size {
+            return None;
+        }
+        let mut arg_size = 0;
+        for (_, arg_type) in &callee.args {
+            arg_size += arg_type.to_asm_type(structs).ok()?.get_size();
+        }
+        Some(arg_size)
+    }
+
     fn get_name(&self) -> Identifier {
         self.name.clone()
     }
@@ -702,6 +750,8 @@ pub enum MirStatement {
     Return(Vec<MirExpression>),
     /// Use a non-void expression
     Expression(MirExpression),
+    /// The file and line of the statement that follows
+    Location(String, usize),
 }
 
 impl MirStatement {
@@ -825,6 +875,72 @@ impl MirStatement {
         }
     }
 
+    /// If this statement is the last statement of the function `func`, whose
+    /// arguments take `arg_size` cells, replace the calls that it returns
+    /// with tail calls in its assembled code. `asm` is the assembled code
+    /// that ends with this statement.
+    fn mark_tail_calls(
+        &self,
+        func: &MirFunction,
+        arg_size: i32,
+        funcs: &BTreeMap<Identifier, MirFunction>,
+        structs: &BTreeMap<Identifier, MirStructure>,
+        asm: &mut Vec<AsmStatement>,
+    ) {
+        match self {
+            Self::Return(exprs) if exprs.len() == 1 => {
+                if let MirExpression::Call(name, _) = &exprs[0] {
+                    Self::mark_tail_call(name, func, arg_size, funcs, structs, asm)
+                }
+            }
+            Self::Expression(MirExpression::Call(name, _)) => {
+                Self::mark_tail_call(name, func, arg_size, funcs, structs, asm)
+            }
+            // Both branches of an if-else statement at the end of
+            // a function are assembled as the last two loops
+            Self::IfElse(_, then_body, else_body) => {
+                let len = asm.len();
+                if len < 2 {
+                    return;
+                }
+                if let [AsmStatement::For(_, _, _, asm_then_body), AsmStatement::For(_, _, _, asm_else_body)] = &mut asm[len - 2..] {
+                    if let Some(stmt) = then_body.last() {
+                        stmt.mark_tail_calls(func, arg_size, funcs, structs, asm_then_body)
+                    }
+                    if let Some(stmt) = else_body.last() {
+                        stmt.mark_tail_calls(func, arg_size, funcs, structs, asm_else_body)
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Replace the call to `name` at the end of `asm` with a tail call, if
+    /// `name` is the function being assembled, or if it returns as many
+    /// cells as that function does.
+    fn mark_tail_call(
+        name: &Identifier,
+        func: &MirFunction,
+        arg_size: i32,
+        funcs: &BTreeMap<Identifier, MirFunction>,
+        structs: &BTreeMap<Identifier, MirStructure>,
+        asm: &mut Vec<AsmStatement>,
+    ) {
+        let tail_call = if name == &func.name {
+            AsmExpression::TailCall(name.clone(), arg_size)
+        } else if let Some(callee_arg_size) = func.tail_call_arg_size(name, funcs, structs) {
+            AsmExpression::MutualTailCall(name.clone(), arg_size, callee_arg_size)
+        } else {
+            return;
+        };
+        if let Some(AsmStatement::Expression(exprs)) = asm.last_mut() {
+            if let [AsmExpression::Call(_)] = exprs.as_slice() {
+                *exprs = vec![tail_call];
+            }
+        }
+    }
+
     /// Does this statement eventually result in a return statement?
     fn has_return(&self) -> bool {
         match self {
@@ -1023,6 +1139,8 @@ impl MirStatement {
                     return Err(MirError::NonVoidExpressionNotUsed(expr.clone()));
                 }
             }
+
+            Self::Location(_, _) => {}
         }
         Ok(())
     }
@@ -1279,7 +1397,24 @@ impl MirStatement {
                 result
             }
 
+            /// A foreign call used as a statement returns nothing
+            Self::Expression(MirExpression::ForeignCall(func_name, args)) => {
+                MirExpression::assemble_foreign_call(
+                    func_name,
+                    args,
+                    0,
+                    vars,
+                    funcs,
+                    structs,
+                    instance_count,
+                    if_var_count,
+                )?
+            }
+
             Self::Expression(expr) => expr.assemble(vars, funcs, structs, instance_count, if_var_count)?,
+
+            /// Record where the following statement is in the source code
+            Self::Location(file, line) => vec![AsmStatement::Location(file.clone(), *line)],
         })
     }
 }
@@ -1478,7 +1613,12 @@ impl MirExpression {
 
                 // If the expression and cast type have different sizes,
                 // then the expression cannot be cast to this type.
-                if expr.get_type(vars, funcs, structs)?.get_size(structs) != t.get_size(structs) {
+                if let Self::ForeignCall(_, _) = **expr {
+                    // Foreign calls are the exception, because casting
+                    // one declares the type of the value it returns.
+                } else if expr.get_type(vars, funcs, structs)?.get_size(structs)
+                    != t.get_size(structs)
+                {
                     return Err(MirError::MismatchedCastSize(*expr.clone(), t.clone()));
                 }
             }
@@ -1640,6 +1780,33 @@ impl MirExpression {
         Ok(())
     }
 
+    /// Assemble a call to a foreign function that returns `return_size` cells.
+    /// The compiler cannot see inside of foreign functions, so the number of
+    /// cells they take and return is passed along for the target to check.
+    fn assemble_foreign_call(
+        func_name: &Identifier,
+        args: &Vec<Self>,
+        return_size: i32,
+        vars: &mut BTreeMap<Identifier, MirType>,
+        funcs: &BTreeMap<Identifier, MirFunction>,
+        structs: &BTreeMap<Identifier, MirStructure>,
+        instance_count: &mut i32,
+        if_var_count: &mut i32,
+    ) -> Result<Vec<AsmStatement>, MirError> {
+        let mut result = Vec::new();
+        let mut arg_size = 0;
+        for arg in args.iter().rev() {
+            arg_size += arg.get_type(vars, funcs, structs)?.get_size(structs)?;
+            result.extend(arg.assemble(vars, funcs, structs, instance_count, if_var_count)?);
+        }
+        result.push(AsmStatement::Expression(vec![AsmExpression::ForeignCall(
+            func_name.clone(),
+            arg_size,
+            return_size,
+        )]));
+        Ok(result)
+    }
+
     /// This function generates output code from an expression. Each different type of expression
     /// is disassembled and translated into corresponding code for the next layer of the backend here.
     /// This is done after type checking, though, which confirms the program is correct.
@@ -1718,8 +1885,21 @@ impl MirExpression {
 
             /// A typecast is only a way to explicitly validate
             /// some kinds of typechecks. The typecast expression
-            /// has no change on the output code.
-            Self::TypeCast(expr, _) => expr.assemble(vars, funcs, structs, instance_count, if_var_count)?,
+            /// has no change on the output code, except for foreign
+            /// calls, which return a value of the cast type.
+            Self::TypeCast(expr, t) => match &**expr {
+                Self::ForeignCall(func_name, args) => Self::assemble_foreign_call(
+                    func_name,
+                    args,
+                    t.get_size(structs)?,
+                    vars,
+                    funcs,
+                    structs,
+                    instance_count,
+                    if_var_count,
+                )?,
+                _ => expr.assemble(vars, funcs, structs, instance_count, if_var_count)?,
+            },
 
             /// Is the LHS greater than or equal the RHS?
             Self::GreaterEqual(l, r) => {
@@ -1882,17 +2062,17 @@ impl MirExpression {
                 result
             }
 
-            /// Call a foreign function
-            Self::ForeignCall(func_name, args) => {
-                let mut result = Vec::new();
-                for arg in args.iter().rev() {
-                    result.extend(arg.assemble(vars, funcs, structs, instance_count, if_var_count)?);
-                }
-                result.push(AsmStatement::Expression(vec![AsmExpression::ForeignCall(
-                    func_name.clone(),
-                )]));
-                result
-            }
+            /// Call a foreign function, which returns a `&void` by default
+            Self::ForeignCall(func_name, args) => Self::assemble_foreign_call(
+                func_name,
+                args,
+                1,
+                vars,
+                funcs,
+                structs,
+                instance_count,
+                if_var_count,
+            )?,
 
             /// Allocate data on the heap
             Self::Alloc(size_expr) => {
@@ -2207,3 +2387,62 @@ impl Display for MirExpression {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn function(name: &str, args: usize, return_type: MirType) -> MirFunction {
+        let args = (0..args)
+            .map(|i| (format!("arg{}", i), MirType::float()))
+            .collect();
+        MirFunction::new(name.to_string(), args, return_type, vec![])
+    }
+
+    /// Mark the tail calls of `func` ending with a call to `callee`,
+    /// given all the functions in the program, and get the call
+    fn mark_call(func: &MirFunction, callee: &str, funcs: &[MirFunction]) -> AsmExpression {
+        let funcs = funcs
+            .iter()
+            .map(|func| (func.name.clone(), func.clone()))
+            .collect();
+        let stmt = MirStatement::Return(vec![MirExpression::Call(callee.to_string(), vec![])]);
+        let mut asm = vec![AsmStatement::Expression(vec![AsmExpression::Call(
+            callee.to_string(),
+        )])];
+        stmt.mark_tail_calls(func, 2, &funcs, &BTreeMap::new(), &mut asm);
+        match asm.as_slice() {
+            [AsmStatement::Expression(exprs)] if exprs.len() == 1 => exprs[0].clone(),
+            _ => panic!("the call was not left at the end of the body"),
+        }
+    }
+
+    #[test]
+    fn calls_to_the_same_function_are_tail_calls() {
+        let count = function("count", 2, MirType::float());
+        match mark_call(&count, "count", &[count.clone()]) {
+            AsmExpression::TailCall(name, 2) => assert_eq!(name, "count"),
+            call => panic!("expected a tail call, found {:?}", call),
+        }
+    }
+
+    #[test]
+    fn calls_to_other_functions_are_mutual_tail_calls() {
+        let is_even = function("is_even", 2, MirType::boolean());
+        let is_odd = function("is_odd", 1, MirType::boolean());
+        match mark_call(&is_even, "is_odd", &[is_even.clone(), is_odd]) {
+            AsmExpression::MutualTailCall(name, 2, 1) => assert_eq!(name, "is_odd"),
+            call => panic!("expected a mutual tail call, found {:?}", call),
+        }
+    }
+
+    #[test]
+    fn calls_that_return_a_different_size_are_not_tail_calls() {
+        let log = function("log", 2, MirType::void());
+        let square = function("square", 1, MirType::float());
+        match mark_call(&log, "square", &[log.clone(), square]) {
+            AsmExpression::Call(name) => assert_eq!(name, "square"),
+            call => panic!("expected an ordinary call, found {:?}", call),
+        }
+    }
+}
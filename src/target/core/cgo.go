@@ -0,0 +1,33 @@
+// The bridge to foreign files written in C for the C target, which
+// the Go target compiles with cgo when a program includes one. The C
+// foreign functions get a copy of the machine laid out like the C
+// target's, because C code can't keep pointers to Go memory, and their
+// changes are copied back after they return. Errors in C, such as a
+// stack underflow, exit the program like they do on the C target.
+
+import "unsafe"
+
+// Call a C foreign function with a copy of the machine
+func call_c(vm *machine, fn func(*C.machine)) {
+	memory, allocated := vm.Memory(), vm.Allocated()
+	n := len(memory)
+	c := C.machine_new(0, C.int(n))
+	defer C.free(unsafe.Pointer(c))
+	defer C.machine_drop(c)
+
+	c_memory := (*[1 << 28]float64)(unsafe.Pointer(c.memory))[:n:n]
+	c_allocated := (*[1 << 28]bool)(unsafe.Pointer(c.allocated))[:n:n]
+	copy(c_memory, memory)
+	copy(c_allocated, allocated)
+	c.stack_ptr = C.int(vm.StackPtr())
+	c.base_ptr = C.int(vm.BasePtr())
+
+	fn(c)
+	// C's output is buffered separately from Go's
+	C.fflush(nil)
+
+	copy(memory, c_memory)
+	copy(allocated, c_allocated)
+	vm.SetStackPtr(int(c.stack_ptr))
+	vm.SetBasePtr(int(c.base_ptr))
+}
@@ -1,173 +1,890 @@
 package main
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
-var READER = bufio.NewReader(os.Stdin)
-
+// The exit codes of the errors that stop the machine.
+// Scripts may depend on these, so they must not change.
 const STACK_HEAP_COLLISION = 1
 const NO_FREE_MEMORY = 2
 const STACK_UNDERFLOW = 3
+const STACK_OVERFLOW = 4
+const NO_SUCH_BUILTIN = 5
+const INVALID_FUNCTION = 6
+const OUT_OF_BOUNDS = 7
+const ASSERTION_FAILED = 8
+const OP_LIMIT = 9
+const TIMEOUT_EXPIRED = 10
+const INVALID_FILE = 11
+const NO_WINDOW = 12
+const INVALID_BYTE = 13
+const INVALID_HANDLE = 14
+const FOREIGN_ERROR = 15
+
+// The tables of the compiled program, which its code fills in from
+// `init` functions: the literals that the global scope starts out
+// with, and the name, source file and Go function of each Oak function
+var DATA []float64
+var FN_NAMES []string
+var FN_FILES []string
+var FN_TABLE []func(*VM)
+
+// An error that stops the machine, such as running out of memory.
+// The machine raises these as Go panics, so that they unwind every
+// Oak function being called, and `RunMachine` returns them.
+type machine_error struct {
+	code    int
+	message string
+	// The trace of the Oak functions that were being called
+	trace string
+}
+
+func (e *machine_error) Error() string {
+	return e.message
+}
+
+// Raised when the Oak program exits early with a status code. This
+// unwinds the program like a machine error, but it isn't reported.
+type machine_exit struct {
+	code int
+}
 
-func panic(code int) {
-	fmt.Print("panic: ")
+func (e *machine_exit) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// Describe an error code, for the errors that don't have a more specific message
+func ErrorMessage(code int) string {
 	switch code {
 	case 1:
-		fmt.Println("stack and heap collision during push")
-		break
+		return "stack and heap collision during push"
 	case 2:
-		fmt.Println("no free memory left")
-		break
+		return "no free memory left"
 	case 3:
-		fmt.Println("stack underflow")
-		break
+		return "stack underflow"
+	case 4:
+		return "stack overflow"
+	case 5:
+		return "no extension provides the builtin"
+	case 6:
+		return "call to an invalid function"
+	case 7:
+		return "memory access out of bounds"
+	case 8:
+		return "assertion failed"
+	case 9:
+		return "exceeded the operation limit"
+	case 10:
+		return "exceeded the time limit"
+	case 11:
+		return "invalid file handle"
+	case 12:
+		return "no window is open"
+	case 13:
+		return "a cell written as a byte doesn't hold a byte"
+	case 14:
+		return "invalid handle"
+	case 15:
+		return "a foreign function failed"
 	default:
-		fmt.Println("unknown error code")
+		return "unknown error code"
 	}
-	os.Exit(code)
 }
 
-type machine struct {
+// Run the function `entry` on a new machine, and return
+// the error that stopped the machine, if there is one.
+func RunMachine(global_scope_size, capacity int, entry func(*VM)) (err error) {
+	defer RecoverError(&err)
+	return NewVM(global_scope_size, capacity).run(entry)
+}
+
+// Run the function `entry` on this machine, and return the error
+// that stopped the machine, if there is one. Go programs that embed
+// the machine can use this with `on_error` to handle errors themselves.
+func (vm *VM) run(entry func(*VM)) (err error) {
+	defer RecoverError(&err)
+	defer vm.Flush()
+	defer vm.close()
+	entry(vm)
+	vm.drop()
+	return nil
+}
+
+// Recover from a panic raised by a machine error or an exit, and store
+// the error in `err`. Other panics are not the machine's, so they continue.
+func RecoverError(err *error) {
+	if r := recover(); r != nil {
+		switch e := r.(type) {
+		case *machine_error:
+			*err = e
+		case *machine_exit:
+			*err = e
+		default:
+			panic(r)
+		}
+	}
+}
+
+// Report the error that stopped the machine to stderr, if there is
+// one, so that it doesn't mix with the program's output. Then, exit
+// with the error's code. If the program exited early, use its status.
+func ExitOnError(err error) {
+	switch e := err.(type) {
+	case *machine_error:
+		fmt.Fprintf(os.Stderr, "panic: %s\n%s", e.message, e.trace)
+		exited(e.code)
+		os.Exit(e.code)
+	case *machine_exit:
+		exited(e.code)
+		os.Exit(e.code)
+	default:
+		exited(0)
+	}
+}
+
+// The machine that runs an Oak program. The output code calls its
+// exported methods for each operation, and foreign functions call them
+// to take their arguments and return their results.
+//
+// A machine must only be used by one goroutine at a time. Separate
+// machines can run on separate goroutines, because the rest of the
+// runtime's state is only written before any machine runs, such as the
+// options and the function table, as long as each machine is given its
+// own input and output, as `RunWithIO` does. The debuggers for
+// `-debug` and `-dap` are the exception, because they expect one machine.
+//
+// The packages built on the machine, such as `debug` and `std`, keep
+// their own state for each machine. They give it hooks from `OnNewVM`,
+// and store values on it with `SetValue`.
+type VM struct {
+	machine_io
 	memory    []float64
 	allocated []bool
+	// The shadow memory used in taint mode. Each cell is marked
+	// if its value was derived from user input. This is nil
+	// when taint mode is disabled.
+	taint     []bool
 	capacity  int
 	base_ptr  int
 	stack_ptr int
+	// The number of cells at the bottom of the stack
+	// used by the program's global variables
+	global_scope_size int
+	// The IDs of the functions that are currently being called,
+	// with the innermost call last
+	call_stack []int
+	// The line of the statement being run, and the line that each
+	// function on the call stack was called from. A line is zero
+	// when it is not known.
+	line       int
+	call_lines []int
+	// The call depth that the innermost running trampoline calls
+	// functions at, or -1 if there is none, and the function that a
+	// function making a tail call at that depth left for it to call
+	trampoline_depth int
+	tail_fn          func(*VM)
+	// The Oak function to call when the machine hits an error,
+	// and whether it is currently handling an error
+	trap_handler func(*VM)
+	in_trap      bool
+	// The message of the last error that a foreign function reported
+	foreign_error string
+	// Called with the code and message of each error before it stops
+	// the machine. Go programs that embed the machine can set this to
+	// log errors, or to panic with their own value to convert them.
+	on_error func(code int, message string)
+	// The snapshots of the stack taken before each foreign call for `-debug-ffi`
+	ffi_checkpoints [][]float64
+	// The number of pushes and pops, for the `-max-ops` limit
+	ops int
+	// Whether anything watches every push and pop, such as `-taint`,
+	// `-trace`, `-max-ops`, or a hook for each operation. The flags
+	// are read once, when the machine is created, so that otherwise
+	// pushes and pops check this and nothing else.
+	instrumented bool
+	// The hooks given to the machine, and whether any of them
+	// is called for each operation
+	hooks    []Hooks
+	op_hooks bool
+	// The values that the packages built on the machine store on it
+	values map[interface{}]interface{}
+	// When the program must stop for `-timeout`, or zero if it has no limit
+	deadline time.Time
+	// The ranges of cells whose loads and stores are reported, as
+	// the first cell and the cell after the last
+	watchpoints [][2]int
+	// The first of the cells at the top of memory that mirror the
+	// foreign globals, or the capacity if there are none
+	foreign_base int
+	// The lowest address that the heap has grown down to
+	heap_start int
 }
 
-func machine_new(global_scope_size, capacity int) *machine {
+func NewVM(global_scope_size, capacity int) *VM {
 	memory := []float64{}
 	allocated := []bool{}
 	for i := 0; i < capacity; i++ {
 		memory = append(memory, 0)
 		allocated = append(allocated, false)
 	}
-	result := &machine{memory, allocated, capacity, 0, 0}
+	result := &VM{machine_io: machine_io_new(), memory: memory, allocated: allocated, capacity: capacity, global_scope_size: global_scope_size, trampoline_depth: -1}
+	if *TAINT_MODE {
+		result.taint = make([]bool, capacity)
+	}
+	if *TIMEOUT > 0 {
+		result.deadline = time.Now().Add(*TIMEOUT)
+	}
+	result.instrumented = result.taint != nil || *TRACE_OPS || *MAX_OPS > 0 || !result.deadline.IsZero()
+	result.watchpoints = parse_watchpoints(*WATCH)
+	result.map_foreign_globals()
+	for _, fn := range new_vm_fns {
+		fn(result)
+	}
+	// The global scope starts out as a copy of the data segment, so the
+	// program's literals are in memory before any of its code runs
 	for i := 0; i < global_scope_size; i++ {
-		result.push(0)
+		if i < len(DATA) {
+			result.Push(DATA[i])
+		} else {
+			result.Push(0)
+		}
 	}
 	return result
 }
 
-func (vm *machine) drop() {
-	// fmt.Print("stack: [ ")
-	// for i:=0; i<vm.stack_ptr; i+=1 {
-	// 	fmt.Printf("%g ", vm.memory[i])
-	// }
-	// for i:=vm.stack_ptr; i<vm.capacity; i+=1 {
-	//     fmt.Print("  ")
-	// }
-	// fmt.Println("]")
-	// fmt.Print("heap:  [ ")
-	// for i:=0; i<vm.stack_ptr; i+=1 {
-	// 	fmt.Print("  ")
-	// }
-	// for i:=vm.stack_ptr; i<vm.capacity; i+=1 {
-	// 	fmt.Printf("%g ", vm.memory[i])
-	// }
-	// fmt.Println("]")
-	// fmt.Print("alloc: [ ")
-	// for i:=0; i<vm.capacity; i+=1 {
-	// 	if vm.allocated[i] {
-	// 		fmt.Printf("1 ")
-	// 	} else {
-	// 		fmt.Printf("0 ")
-	// 	}
-	// }
-	// fmt.Println("]")
-	// total := 0;
-	// for i:=0; i<vm.capacity; i+=1 {
-	//     if vm.allocated[i] {
-	// 		total += 1
-	// 	}
-	// }
-	// fmt.Println("STACK SIZE    %d\n", vm.stack_ptr);
-	// fmt.Println("TOTAL ALLOC'D %d\n", total);
-}
-
-func (vm *machine) load_base_ptr() {
+// The functions that a package built on the machine, such as `debug`,
+// gives it to call as the program runs. Any of them can be nil.
+type Hooks struct {
+	// Called with the name of each operation before it runs, including
+	// the pushes and pops that other operations make
+	Op func(vm *VM, op string)
+	// Called after the function with the given ID is called, and after it returns
+	Enter func(vm *VM, id int)
+	Exit  func(vm *VM, id int)
+	// Called with the line of each statement before it runs
+	Statement func(vm *VM, line int)
+	// Called where the Oak program asks to pause with `debug_break`
+	Break func(vm *VM)
+	// Called with the code and message of an error before it stops the machine
+	Fail func(vm *VM, code int, message string)
+	// Called when the program finishes, or exits early
+	Drop func(vm *VM)
+	// Called after the machine stops, even if it stopped with an error,
+	// to release what the hooks hold, such as files or the terminal
+	Close func(vm *VM)
+}
+
+// The functions that each new machine is given to, and the ones
+// that are called with the status of the program before it exits
+var new_vm_fns []func(*VM)
+var exit_fns []func(int)
+
+// Call `fn` with each new machine before it runs, so that it can give
+// the machine hooks and values. This is meant to be called from a
+// package's `init` function, and `fn` is only given the machines created
+// after it, so the packages built on the machine call it before any are.
+func OnNewVM(fn func(*VM)) {
+	new_vm_fns = append(new_vm_fns, fn)
+}
+
+// Call `fn` with the status that `ExitOnError` exits the program with,
+// before it exits, such as to tell a debugger that the program is finished
+func OnExit(fn func(code int)) {
+	exit_fns = append(exit_fns, fn)
+}
+
+func exited(code int) {
+	for _, fn := range exit_fns {
+		fn(code)
+	}
+}
+
+// Give the machine hooks to call as the program runs. This is meant to
+// be called from a function given to `OnNewVM`. Hooks for each operation
+// slow down every push and pop, so they should only be added when they
+// are needed, such as when an option that uses them is on.
+func (vm *VM) AddHooks(hooks Hooks) {
+	vm.hooks = append(vm.hooks, hooks)
+	if hooks.Op != nil {
+		vm.op_hooks = true
+		vm.instrumented = true
+	}
+}
+
+// Get the value stored on the machine with `key`, or nil if there is none
+func (vm *VM) Value(key interface{}) interface{} {
+	return vm.values[key]
+}
+
+// Store a value on the machine, such as the files that the standard
+// library's functions have opened. Keys are compared like map keys,
+// so each package should use keys of an unexported type of its own.
+func (vm *VM) SetValue(key, value interface{}) {
+	if vm.values == nil {
+		vm.values = map[interface{}]interface{}{}
+	}
+	vm.values[key] = value
+}
+
+// Call the hooks for an operation of the machine
+func (vm *VM) op(name string) {
+	if vm.op_hooks {
+		for _, hooks := range vm.hooks {
+			if hooks.Op != nil {
+				hooks.Op(vm, name)
+			}
+		}
+	}
+}
+
+// The state of a machine's memory, saved by `Snapshot`
+type machine_state struct {
+	Memory    []float64 `json:"memory"`
+	Allocated []bool    `json:"allocated"`
+	BasePtr   int       `json:"base_ptr"`
+	StackPtr  int       `json:"stack_ptr"`
+}
+
+// Save the memory, the allocated cells, and the base and stack pointers
+// of the machine as JSON, so that they can be restored with `Restore`
+func (vm *VM) Snapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(machine_state{vm.memory, vm.allocated, vm.base_ptr, vm.stack_ptr})
+}
+
+// Read a snapshot of a machine with the same capacity as this one
+func (vm *VM) read_snapshot(r io.Reader) (*machine_state, error) {
+	var state machine_state
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, err
+	}
+	if len(state.Memory) != vm.capacity || len(state.Allocated) != vm.capacity {
+		return nil, fmt.Errorf("the snapshot has %d cells, but the machine has %d", len(state.Memory), vm.capacity)
+	}
+	return &state, nil
+}
+
+// Restore the entire state saved by `Snapshot`. The Go functions being
+// called can't be restored, so a Go program that embeds the machine
+// should do this before running a function on it, and not during.
+func (vm *VM) Restore(r io.Reader) error {
+	state, err := vm.read_snapshot(r)
+	if err != nil {
+		return err
+	}
+	copy(vm.memory, state.Memory)
+	copy(vm.allocated, state.Allocated)
+	vm.base_ptr = state.BasePtr
+	vm.stack_ptr = state.StackPtr
+	vm.clear_taint()
+	return nil
+}
+
+// Restore the global variables and the heap saved by `Snapshot`, but
+// keep the current stack frames, so that an Oak program can restore a
+// snapshot while it is running. This fails if the saved heap overlaps
+// the current stack.
+func (vm *VM) RestoreHeap(r io.Reader) error {
+	state, err := vm.read_snapshot(r)
+	if err != nil {
+		return err
+	}
+	for i := vm.global_scope_size; i < vm.stack_ptr; i += 1 {
+		if state.Allocated[i] {
+			return fmt.Errorf("the heap in the snapshot overlaps the stack at cell %d", i)
+		}
+	}
+	copy(vm.memory[:vm.global_scope_size], state.Memory)
+	copy(vm.memory[vm.stack_ptr:], state.Memory[vm.stack_ptr:])
+	copy(vm.allocated[vm.stack_ptr:], state.Allocated[vm.stack_ptr:])
+	vm.clear_taint()
+	return nil
+}
+
+// Unmark every cell as derived from user input
+func (vm *VM) clear_taint() {
+	if vm.taint != nil {
+		vm.taint = make([]bool, vm.capacity)
+	}
+}
+
+// Stop the program early with the status `code`. The machine is
+// dropped first, so that its trace and heap checksum are still written.
+func (vm *VM) Exit(code int) {
+	vm.drop()
+	panic(&machine_exit{code})
+}
+
+func (vm *VM) drop() {
+	for _, hooks := range vm.hooks {
+		if hooks.Drop != nil {
+			hooks.Drop(vm)
+		}
+	}
+}
+
+// Release what the hooks hold, once the machine has stopped
+func (vm *VM) close() {
+	for _, hooks := range vm.hooks {
+		if hooks.Close != nil {
+			hooks.Close(vm)
+		}
+	}
+}
+
+// Record that the function with the given ID has been called
+func (vm *VM) EnterFn(id int) {
+	vm.call_stack = append(vm.call_stack, id)
+	vm.call_lines = append(vm.call_lines, vm.line)
+	for _, hooks := range vm.hooks {
+		if hooks.Enter != nil {
+			hooks.Enter(vm, id)
+		}
+	}
+	if *TRACE_OPS {
+		vm.trace_op("call", FN_NAMES[id])
+	}
+}
+
+// Record that the function with the given ID has returned
+func (vm *VM) ExitFn(id int) {
+	vm.call_stack = vm.call_stack[:len(vm.call_stack)-1]
+	// Resume the line of the statement that made the call
+	vm.line = vm.call_lines[len(vm.call_lines)-1]
+	vm.call_lines = vm.call_lines[:len(vm.call_lines)-1]
+	for _, hooks := range vm.hooks {
+		if hooks.Exit != nil {
+			hooks.Exit(vm, id)
+		}
+	}
+	if *TRACE_OPS {
+		vm.trace_op("return", FN_NAMES[id])
+	}
+}
+
+// Pop a function's ID off of the stack, and call the function
+func (vm *VM) CallIndirect() {
+	vm.op("call_indirect")
+	id := int(vm.Pop())
+	if id < 0 || id >= len(FN_TABLE) {
+		vm.fail(INVALID_FUNCTION)
+	}
+	FN_TABLE[id](vm)
+}
+
+// Pop `size` captured cells off of the stack into a new environment on
+// the heap, and push a closure: the environment's address followed by
+// the function's ID. Calling the closure with `CallIndirect` leaves the
+// environment's address on the stack as the function's first argument.
+func (vm *VM) MakeClosure(id, size int) {
+	vm.op("make_closure")
+	// The cell before the environment stores its size, so that it can be freed
+	vm.Push(float64(size + 1))
+	env := vm.Allocate() + 1
+	vm.Pop()
+	vm.memory[env-1] = float64(size)
+	for i := size - 1; i >= 0; i -= 1 {
+		tainted := vm.top_tainted(1)
+		vm.memory[env+i] = vm.Pop()
+		vm.SetTainted(env+i, tainted)
+	}
+	vm.Push(float64(env))
+	vm.Push(float64(id))
+}
+
+// Pop a closure off of the stack, and free its environment
+func (vm *VM) FreeClosure() {
+	vm.op("free_closure")
+	vm.Pop()
+	env := int(vm.Pop())
+	vm.Push(vm.memory[env-1] + 1)
+	vm.Push(float64(env - 1))
+	vm.Free()
+}
+
+func (vm *VM) LoadBasePtr() {
+	vm.op("load_base_ptr")
 	// Get the virtual machine's current base pointer value,
 	// and push it onto the stack.
-	vm.push(float64(vm.base_ptr))
+	vm.Push(float64(vm.base_ptr))
 }
 
-func (vm *machine) establish_stack_frame(arg_size, local_scope_size int) {
-	// Allocate some space to store the arguments' cells for later
-	args := make([]float64, arg_size)
-	// Pop the arguments' values off of the stack
-	for i := arg_size - 1; i >= 0; i -= 1 {
-		args[i] = vm.pop()
+func (vm *VM) EstablishStackFrame(arg_size, local_scope_size int) {
+	vm.op("establish_stack_frame")
+	if *LOG_CALLS {
+		vm.log_call(arg_size)
 	}
+	// The arguments' cells are on the top of the stack. The stack frame
+	// begins where they start, so that they can be moved in place.
+	frame := vm.stack_ptr - arg_size
+	if frame < 0 {
+		vm.fail(STACK_UNDERFLOW)
+	}
+	frame_end := vm.stack_ptr + 1 + local_scope_size
+	vm.reserve(frame_end)
+
+	// Move the arguments up past the base pointer and the local
+	// scope, so that they are on the top of the new stack frame.
+	vm.move_cells(frame+1+local_scope_size, frame, arg_size)
 
-	// Push the current base pointer onto the stack so that
+	// Store the current base pointer on the stack so that
 	// when this function returns, it will be able to resume
 	// the current stack frame
-	vm.load_base_ptr()
+	vm.memory[frame] = float64(vm.base_ptr)
+	vm.SetTainted(frame, false)
+
+	// Set the base pointer to begin the stack frame
+	// after the stored base pointer.
+	vm.base_ptr = frame + 1
+
+	// Clear the space for all the variables used in the local scope
+	vm.clear_cells(vm.base_ptr, vm.base_ptr+local_scope_size)
+	vm.stack_ptr = frame_end
+}
+
+func (vm *VM) EndStackFrame(return_size, local_scope_size int) {
+	vm.op("end_stack_frame")
+	if *LOG_CALLS {
+		vm.log_return(return_size)
+	}
+	// The returned cells are on the top of the stack, above the local
+	// scope and the parent function's base pointer.
+	returned := vm.stack_ptr - return_size
+	frame := returned - local_scope_size - 1
+	if frame < 0 {
+		vm.fail(STACK_UNDERFLOW)
+	}
+
+	// Retrieve the parent function's base pointer to resume the function
+	vm.base_ptr = int(vm.memory[frame])
 
-	// Set the base pointer to the current stack pointer to
-	// begin the stack frame at the current position on the stack.
-	vm.base_ptr = vm.stack_ptr
+	// Move the returned value down to where the stack frame began for use
+	// by the parent function, and discard the rest of the stack frame.
+	vm.move_cells(frame, returned, return_size)
+	vm.clear_cells(frame+return_size, vm.stack_ptr)
+	vm.stack_ptr = frame + return_size
+}
 
-	// Allocate space for all the variables used in the local scope on the stack
-	for i := 0; i < local_scope_size; i += 1 {
-		vm.push(0.0)
+// Reuse the current stack frame for a tail call. This is only possible
+// if the call's arguments are directly on top of the frame's local scope,
+// in which case the stack pointer is where it was when the frame was
+// established. The local scope is cleared as if the frame were new.
+func (vm *VM) ReuseStackFrame(entry, arg_size int) bool {
+	if vm.stack_ptr != entry {
+		return false
 	}
+	if *LOG_CALLS {
+		vm.log_call(arg_size)
+	}
+	vm.clear_cells(vm.base_ptr, entry-arg_size)
+	return true
+}
 
-	// Push the arguments back onto the stack for use by the current function
-	for i := 0; i < arg_size; i += 1 {
-		vm.push(args[i])
+// Discard the current stack frame for a tail call to another function,
+// leaving the call's `arg_size` cells of arguments where the frame began,
+// as if the function's caller had pushed them. This is only possible if
+// the arguments are directly on top of the frame's local scope, which
+// ends at `locals_end`. The function is exited, so it must not run any
+// more of its body if this returns true.
+func (vm *VM) LeaveStackFrame(locals_end, arg_size int) bool {
+	if vm.stack_ptr-arg_size != locals_end {
+		return false
 	}
+	if *LOG_CALLS {
+		vm.log_return(0)
+	}
+	frame := vm.base_ptr - 1
+	vm.base_ptr = int(vm.memory[frame])
+	vm.move_cells(frame, locals_end, arg_size)
+	vm.clear_cells(frame+arg_size, vm.stack_ptr)
+	vm.stack_ptr = frame + arg_size
+	vm.ExitFn(vm.call_stack[len(vm.call_stack)-1])
+	return true
 }
 
-func (vm *machine) end_stack_frame(return_size, local_scope_size int) {
-	// Allocate some space to store the returned cells for later
-	return_val := make([]float64, return_size)
-	// Pop the returned values off of the stack
-	for i := return_size - 1; i >= 0; i -= 1 {
-		return_val[i] = vm.pop()
+// Call a function that another function left its stack frame for with
+// `LeaveStackFrame`. Instead of calling the function from the one that
+// left, which would still grow Go's stack, this returns to the trampoline
+// running at the call depth that the function was called at, which calls
+// each function left to it in turn. Functions that call each other in
+// tail position can then recurse any number of times.
+func (vm *VM) Trampoline(fn func(*VM)) {
+	depth := len(vm.call_stack)
+	if depth == vm.trampoline_depth {
+		vm.tail_fn = fn
+		return
+	}
+	outer_depth := vm.trampoline_depth
+	vm.trampoline_depth = depth
+	for fn != nil {
+		vm.tail_fn = nil
+		fn(vm)
+		fn = vm.tail_fn
 	}
+	vm.trampoline_depth = outer_depth
+}
 
-	// Discard the memory setup by the stack frame
-	for i := 0; i < local_scope_size; i += 1 {
-		vm.pop()
+// Make sure that the stack can grow up to `stack_ptr`
+// without colliding with memory allocated on the heap.
+func (vm *VM) reserve(stack_ptr int) {
+	for i := vm.stack_ptr; i < stack_ptr; i += 1 {
+		if i >= vm.capacity || vm.allocated[i] {
+			vm.stack_heap_collision()
+		}
 	}
+}
 
-	// Retrieve the parent function's base pointer to resume the function
-	vm.base_ptr = int(vm.pop())
+// Report that the stack has grown into the heap. If a function is
+// recursing, this is almost certainly a stack overflow caused by the
+// recursion, so name the function instead.
+func (vm *VM) stack_heap_collision() {
+	if id, ok := vm.recursing_fn(); ok {
+		vm.Fail(STACK_OVERFLOW, fmt.Sprintf("stack overflow in recursive function `%s` at call depth %d, after using %d of %d cells", FN_NAMES[id], len(vm.call_stack), vm.stack_ptr, vm.capacity))
+	}
+	vm.fail(STACK_HEAP_COLLISION)
+}
 
-	// Finally, push the returned value back onto the stack for use by
-	// the parent function.
-	for i := 0; i < return_size; i += 1 {
-		vm.push(return_val[i])
+// Stop the machine with the given error code
+func (vm *VM) fail(code int) {
+	vm.Fail(code, ErrorMessage(code))
+}
+
+// Call the Oak program's trap handler with the error code. The handler
+// returns whether it recovered from the error, such as by freeing
+// memory, in which case the failed operation can be retried. Only
+// operations that can be retried call the handler; for any other error,
+// there is nothing it could do to keep the machine running. Errors
+// inside the trap handler itself are not handled.
+func (vm *VM) trap(code int) bool {
+	if vm.trap_handler == nil || vm.in_trap {
+		return false
 	}
+	vm.in_trap = true
+	vm.Push(float64(code))
+	vm.trap_handler(vm)
+	recovered := vm.Pop() != 0
+	vm.in_trap = false
+	return recovered
 }
 
-func (vm *machine) push(n float64) {
-	if vm.allocated[vm.stack_ptr] {
-		panic(STACK_HEAP_COLLISION)
+// Stop the machine with the given error code and a more specific
+// message, along with a trace of the Oak functions being called.
+func (vm *VM) Fail(code int, message string) {
+	// Say where the error happened, such as `at point.ok:42 in Point::new`
+	if depth := len(vm.call_stack); depth > 0 {
+		id := vm.call_stack[depth-1]
+		message += fmt.Sprintf("%s in `%s`", Location(id, vm.line), FN_NAMES[id])
+	}
+	if vm.on_error != nil {
+		vm.on_error(code, message)
+	}
+	for _, hooks := range vm.hooks {
+		if hooks.Fail != nil {
+			hooks.Fail(vm, code, message)
+		}
+	}
+	panic(&machine_error{code, message, vm.StackTrace()})
+}
+
+// Describe the Oak functions on the call stack, innermost first.
+// Consecutive calls to the same function are collapsed into a
+// single line, so that deep recursion doesn't flood the output.
+func (vm *VM) StackTrace() string {
+	if len(vm.call_stack) == 0 {
+		return ""
+	}
+	result := "stack trace:\n"
+	for i := len(vm.call_stack) - 1; i >= 0; {
+		id := vm.call_stack[i]
+		calls := 0
+		for ; i >= 0 && vm.call_stack[i] == id; i -= 1 {
+			calls += 1
+		}
+		// The function that made the outermost of these calls is the call site
+		caller := "the entry point"
+		if i >= 0 {
+			caller = fmt.Sprintf("`%s`%s", FN_NAMES[vm.call_stack[i]], Location(vm.call_stack[i], vm.call_lines[i+1]))
+		}
+		if calls > 1 {
+			result += fmt.Sprintf("    in `%s` (%d recursive calls), called from %s\n", FN_NAMES[id], calls, caller)
+		} else {
+			result += fmt.Sprintf("    in `%s`, called from %s\n", FN_NAMES[id], caller)
+		}
+	}
+	return result
+}
+
+// Describe a line in the file of the function with the given ID,
+// such as ` at point.ok:42`, if the line is known.
+func Location(id, line int) string {
+	if line == 0 || FN_FILES[id] == "" {
+		return ""
+	}
+	return fmt.Sprintf(" at %s:%d", FN_FILES[id], line)
+}
+
+// Find the innermost function that is called more than once on the call stack
+func (vm *VM) recursing_fn() (int, bool) {
+	calls := map[int]int{}
+	for _, id := range vm.call_stack {
+		calls[id] += 1
+	}
+	for i := len(vm.call_stack) - 1; i >= 0; i -= 1 {
+		if id := vm.call_stack[i]; calls[id] > 1 {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Move `size` cells from `src` to `dst`. The ranges may overlap.
+func (vm *VM) move_cells(dst, src, size int) {
+	copy(vm.memory[dst:dst+size], vm.memory[src:src+size])
+	if vm.taint != nil {
+		copy(vm.taint[dst:dst+size], vm.taint[src:src+size])
+	}
+}
+
+// Zero the cells from `start` up to, but not including, `end`.
+func (vm *VM) clear_cells(start, end int) {
+	for i := start; i < end; i += 1 {
+		vm.memory[i] = 0
+		vm.SetTainted(i, false)
+	}
+}
+
+// Count a push or pop, which every operation of the machine makes.
+// This enforces the `-max-ops` and `-timeout` limits.
+func (vm *VM) count_op() {
+	vm.ops += 1
+	if *MAX_OPS > 0 && vm.ops > *MAX_OPS {
+		vm.Fail(OP_LIMIT, fmt.Sprintf("exceeded the limit of %d operations", *MAX_OPS))
+	}
+	// Checking the time is slow, so only check it every so often
+	if vm.ops%1024 == 0 && !vm.deadline.IsZero() && time.Now().After(vm.deadline) {
+		vm.Fail(TIMEOUT_EXPIRED, fmt.Sprintf("exceeded the time limit of %s", *TIMEOUT))
+	}
+}
+
+// Call the hooks for, trace, and count a push or pop of `n`, for the
+// options that watch every operation. This is only called when one is on.
+func (vm *VM) instrument_op(op string, n float64) {
+	vm.op(op)
+	if *TRACE_OPS {
+		vm.trace_op(op, fmt.Sprint(n))
+	}
+	vm.count_op()
+}
+
+// The machine's memory, for foreign functions that work with many
+// cells at once, such as sorting an array in place. Writes to it
+// aren't checked, so check them with `CheckBounds` first.
+func (vm *VM) Memory() []float64 { return vm.memory }
+
+// Which cells of memory are allocated on the heap
+func (vm *VM) Allocated() []bool { return vm.allocated }
+
+// The address of the cell after the top of the stack
+func (vm *VM) StackPtr() int { return vm.stack_ptr }
+
+// The address of the current function's stack frame
+func (vm *VM) BasePtr() int { return vm.base_ptr }
+
+// Move the top of the stack, such as after foreign code
+// written for the C target has pushed and popped its own copy
+func (vm *VM) SetStackPtr(addr int) { vm.stack_ptr = addr }
+
+// Move the current function's stack frame, like `SetStackPtr`
+func (vm *VM) SetBasePtr(addr int) { vm.base_ptr = addr }
+
+// The number of cells at the bottom of the stack that hold the program's
+// global variables, which are the first cells that it uses
+func (vm *VM) GlobalScopeSize() int { return vm.global_scope_size }
+
+// The cells that the heap has covered, from the lowest address that it
+// has grown down to, up to the foreign globals at the top of memory.
+// Cells in this range that are no longer allocated have been freed.
+func (vm *VM) HeapExtent() (start, end int) {
+	// Cells can also be allocated without `Allocate`, such as by
+	// restoring a snapshot, or by foreign code written for the C target
+	for i := vm.stack_ptr; i < vm.heap_start; i += 1 {
+		if vm.allocated[i] {
+			vm.heap_start = i
+			break
+		}
+	}
+	return vm.heap_start, vm.foreign_base
+}
+
+// The IDs of the functions that are being called, innermost last
+func (vm *VM) CallStack() []int { return vm.call_stack }
+
+// The line that each function on the call stack was called from,
+// or zero where it is not known
+func (vm *VM) CallLines() []int { return vm.call_lines }
+
+// The line of the statement being run, or zero if it is not known
+func (vm *VM) Line() int { return vm.line }
+
+func (vm *VM) Push(n float64) {
+	if vm.stack_ptr >= vm.capacity || vm.allocated[vm.stack_ptr] {
+		vm.stack_heap_collision()
 	}
 	vm.memory[vm.stack_ptr] = n
 	vm.stack_ptr += 1
+	if vm.instrumented {
+		vm.SetTainted(vm.stack_ptr-1, false)
+		vm.instrument_op("push", n)
+	}
 }
 
-func (vm *machine) pop() float64 {
+func (vm *VM) Pop() float64 {
 	if vm.stack_ptr == 0 {
-		panic(STACK_UNDERFLOW)
+		vm.fail(STACK_UNDERFLOW)
 	}
 	vm.stack_ptr -= 1
 	result := vm.memory[vm.stack_ptr]
 	vm.memory[vm.stack_ptr] = 0
+	if vm.instrumented {
+		vm.instrument_op("pop", result)
+	}
 	return result
 }
 
-func (vm *machine) allocate() int {
-	size := int(vm.pop())
-	addr := 0
-	consecutive_free_cells := 0
+func (vm *VM) Allocate() int {
+	vm.op("allocate")
+	// Allocating a user controlled amount of memory is a sensitive operation
+	vm.TaintSink("alloc", vm.top_tainted(1))
+	size := int(vm.Pop())
+	addr := vm.find_free_cells(size)
+	// Let the trap handler free memory, and try again
+	for addr <= vm.stack_ptr && vm.trap(NO_FREE_MEMORY) {
+		addr = vm.find_free_cells(size)
+	}
+
+	if addr <= vm.stack_ptr {
+		vm.Fail(NO_FREE_MEMORY, ErrorMessage(NO_FREE_MEMORY))
+	}
+
+	for i := 0; i < size; i += 1 {
+		vm.allocated[addr+i] = true
+	}
+	if addr < vm.heap_start {
+		vm.heap_start = addr
+	}
+
+	vm.Push(float64(addr))
+	return addr
+}
 
+// Find the address of `size` consecutive free cells on the heap.
+// The address is at or below the stack pointer if there are none.
+func (vm *VM) find_free_cells(size int) int {
+	consecutive_free_cells := 0
 	for i := vm.capacity - 1; i > vm.stack_ptr; i -= 1 {
 		if !vm.allocated[i] {
 			consecutive_free_cells += 1
@@ -176,72 +893,249 @@ func (vm *machine) allocate() int {
 		}
 
 		if consecutive_free_cells == size {
-			addr = i
-			break
+			return i
 		}
 	}
+	return 0
+}
 
-	if addr <= vm.stack_ptr {
-		panic(NO_FREE_MEMORY)
-	}
+func (vm *VM) Free() {
+	vm.op("free")
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
 
 	for i := 0; i < size; i += 1 {
-		vm.allocated[addr+i] = true
+		vm.allocated[addr+i] = false
+		vm.memory[addr+i] = 0
+		vm.SetTainted(addr+i, false)
 	}
+}
 
-	vm.push(float64(addr))
-	return addr
+func (vm *VM) Load(size int) {
+	vm.op("load")
+	vm.load_from(int(vm.Pop()), size)
 }
 
-func (vm *machine) free() {
-	addr := int(vm.pop())
-	size := int(vm.pop())
+func (vm *VM) Store(size int) {
+	vm.op("store")
+	vm.store_to(int(vm.Pop()), size)
+}
 
-	for i := 0; i < size; i += 1 {
-		vm.allocated[addr+i] = false
-		vm.memory[addr+i] = 0
-	}
+// Push the address of the cell at `offset` in the current stack frame.
+// This and the other local operations below replace common sequences
+// of operations in the output code, such as pushing an offset, pushing
+// the base pointer, and adding them.
+func (vm *VM) PushLocalAddr(offset int) {
+	vm.op("push_local_addr")
+	vm.Push(float64(vm.base_ptr + offset))
+}
+
+// Push `size` cells starting at `offset` in the current stack frame
+func (vm *VM) LoadLocal(offset, size int) {
+	vm.op("load_local")
+	vm.load_from(vm.base_ptr+offset, size)
 }
 
-func (vm *machine) load(size int) {
-	addr := int(vm.pop())
+// Pop `size` cells into the current stack frame, starting at `offset`
+func (vm *VM) StoreLocal(offset, size int) {
+	vm.op("store_local")
+	vm.store_to(vm.base_ptr+offset, size)
+}
+
+// Set the cell at `offset` in the current stack frame to `n`
+func (vm *VM) SetLocal(offset int, n float64) {
+	vm.op("set_local")
+	vm.Push(n)
+	vm.store_to(vm.base_ptr+offset, 1)
+}
+
+// Push `size` cells starting at `addr`
+func (vm *VM) load_from(addr, size int) {
+	vm.CheckBounds(addr, size)
+	if *TRACE_OPS {
+		vm.trace_op("load", fmt.Sprintf("%d cells at %d", size, addr))
+	}
+	if addr+size > vm.foreign_base {
+		vm.sync_foreign_globals(addr, size, false)
+	}
+	if vm.watchpoints != nil {
+		vm.report_watched("loads", addr, size)
+	}
 	for i := 0; i < size; i += 1 {
-		vm.push(vm.memory[addr+i])
+		vm.Push(vm.memory[addr+i])
+		vm.SetTainted(vm.stack_ptr-1, vm.is_tainted(addr+i))
 	}
 }
 
-func (vm *machine) store(size int) {
-	addr := int(vm.pop())
+// Pop `size` cells into memory, starting at `addr`
+func (vm *VM) store_to(addr, size int) {
+	vm.CheckBounds(addr, size)
+	if *TRACE_OPS {
+		vm.trace_op("store", fmt.Sprintf("%d cells at %d", size, addr))
+	}
 	for i := size - 1; i >= 0; i -= 1 {
-		vm.memory[addr+i] = vm.pop()
+		tainted := vm.top_tainted(1)
+		vm.memory[addr+i] = vm.Pop()
+		vm.SetTainted(addr+i, tainted)
+	}
+	if addr+size > vm.foreign_base {
+		vm.sync_foreign_globals(addr, size, true)
+	}
+	if vm.watchpoints != nil {
+		vm.report_watched("stores", addr, size)
+	}
+}
+
+// Copy `size` cells of the data segment, starting at `addr`, into memory
+// at the same address. A literal is copied each time the code that uses
+// it runs, so a program that writes into a literal gets it back as it was
+// written in the source the next time, like with the other targets.
+func (vm *VM) StoreData(addr, size int) {
+	vm.op("store_data")
+	vm.CheckBounds(addr, size)
+	if *TRACE_OPS {
+		vm.trace_op("store_data", fmt.Sprintf("%d cells at %d", size, addr))
+	}
+	copy(vm.memory[addr:addr+size], DATA[addr:addr+size])
+	for i := addr; i < addr+size; i += 1 {
+		vm.SetTainted(i, false)
+	}
+	if vm.watchpoints != nil {
+		vm.report_watched("stores", addr, size)
+	}
+}
+
+// Make sure that `size` cells starting at `addr` are in memory
+func (vm *VM) CheckBounds(addr, size int) {
+	if addr < 0 || size < 0 || addr+size > vm.capacity {
+		vm.Fail(OUT_OF_BOUNDS, fmt.Sprintf("memory access out of bounds (address %d)", addr))
+	}
+}
+
+// Pop a destination address and a source address off of the stack,
+// and copy `size` cells from the source to the destination.
+// The ranges are allowed to overlap.
+func (vm *VM) Copy(size int) {
+	vm.op("copy")
+	dst := int(vm.Pop())
+	src := int(vm.Pop())
+	vm.CheckBounds(src, size)
+	vm.CheckBounds(dst, size)
+	if src+size > vm.foreign_base {
+		vm.sync_foreign_globals(src, size, false)
+	}
+	vm.move_cells(dst, src, size)
+	if dst+size > vm.foreign_base {
+		vm.sync_foreign_globals(dst, size, true)
+	}
+	if vm.watchpoints != nil {
+		vm.report_watched("loads", src, size)
+		vm.report_watched("stores", dst, size)
+	}
+}
+
+// Pop an address and a value off of the stack, and
+// set `size` cells at the address to the value.
+func (vm *VM) Fill(size int) {
+	vm.op("fill")
+	addr := int(vm.Pop())
+	tainted := vm.top_tainted(1)
+	n := vm.Pop()
+	vm.CheckBounds(addr, size)
+	for i := addr; i < addr+size; i += 1 {
+		vm.memory[i] = n
+		vm.SetTainted(i, tainted)
+	}
+	if addr+size > vm.foreign_base {
+		vm.sync_foreign_globals(addr, size, true)
+	}
+	if vm.watchpoints != nil {
+		vm.report_watched("stores", addr, size)
+	}
+}
+
+// Pop the address of a zero terminated string off of the
+// stack, and push the number of cells before the terminator.
+func (vm *VM) Strlen() {
+	vm.op("strlen")
+	addr := int(vm.Pop())
+	tainted := false
+	i := addr
+	for {
+		// Stop at the end of memory if the string isn't terminated
+		vm.CheckBounds(i, 1)
+		if vm.memory[i] == 0.0 {
+			break
+		}
+		tainted = tainted || vm.is_tainted(i)
+		i += 1
+	}
+	vm.Push(float64(i - addr))
+	vm.SetTainted(vm.stack_ptr-1, tainted)
+}
+
+// Pop the addresses of two zero terminated strings off of the stack.
+// Push the difference of their first mismatched cells, which is
+// zero if the strings are equal.
+func (vm *VM) Strcmp() {
+	vm.op("strcmp")
+	b := int(vm.Pop())
+	a := int(vm.Pop())
+	tainted := false
+	for {
+		// Stop at the end of memory if either string isn't terminated
+		vm.CheckBounds(a, 1)
+		vm.CheckBounds(b, 1)
+		if vm.memory[a] != vm.memory[b] || vm.memory[a] == 0.0 {
+			break
+		}
+		tainted = tainted || vm.is_tainted(a) || vm.is_tainted(b)
+		a, b = a+1, b+1
 	}
+	vm.Push(vm.memory[a] - vm.memory[b])
+	vm.SetTainted(vm.stack_ptr-1, tainted || vm.is_tainted(a) || vm.is_tainted(b))
 }
 
-func (vm *machine) add() {
-	vm.push(vm.pop() + vm.pop())
+func (vm *VM) Add() {
+	vm.op("add")
+	tainted := vm.top_tainted(2)
+	vm.Push(vm.Pop() + vm.Pop())
+	vm.SetTainted(vm.stack_ptr-1, tainted)
 }
 
-func (vm *machine) subtract() {
-	b := vm.pop()
-	a := vm.pop()
-	vm.push(a - b)
+func (vm *VM) Subtract() {
+	vm.op("subtract")
+	tainted := vm.top_tainted(2)
+	b := vm.Pop()
+	a := vm.Pop()
+	vm.Push(a - b)
+	vm.SetTainted(vm.stack_ptr-1, tainted)
 }
 
-func (vm *machine) multiply() {
-	vm.push(vm.pop() * vm.pop())
+func (vm *VM) Multiply() {
+	vm.op("multiply")
+	tainted := vm.top_tainted(2)
+	vm.Push(vm.Pop() * vm.Pop())
+	vm.SetTainted(vm.stack_ptr-1, tainted)
 }
 
-func (vm *machine) divide() {
-	b := vm.pop()
-	a := vm.pop()
-	vm.push(a / b)
+func (vm *VM) Divide() {
+	vm.op("divide")
+	tainted := vm.top_tainted(2)
+	b := vm.Pop()
+	a := vm.Pop()
+	vm.Push(a / b)
+	vm.SetTainted(vm.stack_ptr-1, tainted)
 }
 
-func (vm *machine) sign() {
-	x := vm.pop()
+func (vm *VM) Sign() {
+	vm.op("sign")
+	tainted := vm.top_tainted(1)
+	x := vm.Pop()
 	if x >= 0 {
-		vm.push(1.0)
+		vm.Push(1.0)
 	} else {
-		vm.push(-1.0)
+		vm.Push(-1.0)
 	}
+	vm.SetTainted(vm.stack_ptr-1, tainted)
 }
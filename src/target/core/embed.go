@@ -0,0 +1,122 @@
+// The API for Go applications that import the program as a package,
+// built with `--go-package`, instead of running it as a separate
+// program. Each `Machine` runs the program's functions on its own
+// memory, and must only be used by one goroutine at a time. Errors
+// that would stop the program, such as running out of memory, are
+// returned instead.
+
+import "io"
+
+// A machine that runs the functions of the compiled Oak program
+type Machine struct {
+	vm *VM
+}
+
+// Create a machine for the program that reads from `stdin` and
+// writes to `stdout`, with the program's literals already in memory
+func NewMachine(stdin io.Reader, stdout io.Writer) *Machine {
+	vm := NewVM(GLOBAL_SCOPE_SIZE, CAPACITY)
+	vm.SetIO(stdin, stdout)
+	return &Machine{vm}
+}
+
+// Push a cell onto the machine's stack
+func (m *Machine) Push(n float64) (err error) {
+	defer RecoverError(&err)
+	m.vm.Push(n)
+	return nil
+}
+
+// Pop a cell off of the machine's stack
+func (m *Machine) Pop() (n float64, err error) {
+	defer RecoverError(&err)
+	return m.vm.Pop(), nil
+}
+
+// Get the `size` cells of memory starting at `addr`
+func (m *Machine) Load(addr, size int) (cells []float64, err error) {
+	defer RecoverError(&err)
+	return m.vm.CopyOut(addr, size), nil
+}
+
+// Write cells to memory, starting at `addr`
+func (m *Machine) Store(addr int, cells []float64) (err error) {
+	defer RecoverError(&err)
+	for _, n := range cells {
+		m.vm.Push(n)
+	}
+	m.vm.Push(float64(addr))
+	m.vm.Store(len(cells))
+	return nil
+}
+
+// Allocate `size` cells on the heap, and get their address
+func (m *Machine) Alloc(size int) (addr int, err error) {
+	defer RecoverError(&err)
+	m.vm.Push(float64(size))
+	m.vm.Allocate()
+	return int(m.vm.Pop()), nil
+}
+
+// Free the `size` cells on the heap starting at `addr`
+func (m *Machine) Free(addr, size int) (err error) {
+	defer RecoverError(&err)
+	m.vm.Push(float64(size))
+	m.vm.Push(float64(addr))
+	m.vm.Free()
+	return nil
+}
+
+// Allocate a copy of the given cells on the heap, and get its address,
+// such as for an array to pass to an Oak function. Free it with `Free`.
+func (m *Machine) CopyIn(cells []float64) (addr int, err error) {
+	defer RecoverError(&err)
+	return m.vm.CopyIn(cells), nil
+}
+
+// Get a copy of the `n` cells of memory starting at `addr`, such
+// as the elements of an array that an Oak function returns
+func (m *Machine) CopyOut(addr, n int) (cells []float64, err error) {
+	defer RecoverError(&err)
+	return m.vm.CopyOut(addr, n), nil
+}
+
+// Allocate a zero terminated copy of a string on the heap, and get its
+// address, such as for a `&char` argument. It takes a cell for each
+// character, and one more for the zero.
+func (m *Machine) CopyInString(s string) (addr int, err error) {
+	defer RecoverError(&err)
+	return m.vm.AllocString(s), nil
+}
+
+// Get a copy of the zero terminated string at `addr`,
+// such as a `&char` that an Oak function returns
+func (m *Machine) CopyOutString(addr int) (s string, err error) {
+	defer RecoverError(&err)
+	return m.vm.ReadString(addr), nil
+}
+
+// Save the machine's memory, such as to resume a long computation
+// later, with `Restore` on this machine or a new one for the program
+func (m *Machine) Snapshot(w io.Writer) error {
+	return m.vm.Snapshot(w)
+}
+
+// Restore the memory saved by `Snapshot`. This must not be
+// called from a foreign function while `Call` is running.
+func (m *Machine) Restore(r io.Reader) error {
+	return m.vm.Restore(r)
+}
+
+// The names of the program's functions that `Call` can call, in order
+func (m *Machine) Functions() []string {
+	return FunctionNames()
+}
+
+// Call the Oak function with the given name, and get the `returnSize`
+// cells that it returns. Each argument is one cell, in the order of the
+// function's parameters, such as an address from `Alloc` for a pointer.
+func (m *Machine) Call(name string, args []float64, returnSize int) ([]float64, error) {
+	defer m.vm.Flush()
+	return m.vm.Call(name, args, returnSize)
+}
@@ -0,0 +1,311 @@
+// The machine's side of foreign functions: the methods that they use
+// to convert between Go values and the machine's cells, and the tables
+// of foreign functions, extensions and globals that the program looks
+// them up in. The `ffi` package registers them in these tables.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Read the zero terminated string at the given address, such as
+// the address of a `&char` argument
+func (vm *VM) ReadString(addr int) string {
+	result := []rune{}
+	for i := addr; ; i += 1 {
+		// A string that runs off the end of memory is an error
+		vm.CheckBounds(i, 1)
+		if vm.memory[i] == 0.0 {
+			break
+		}
+		result = append(result, rune(vm.memory[i]))
+	}
+	return string(result)
+}
+
+// Copy a string into the buffer of `size` cells at `addr`, zero
+// terminated, and return the number of characters copied. The rest
+// of a string that doesn't fit in the buffer is dropped. Strings from
+// outside of the program, such as its input, are marked as tainted.
+func (vm *VM) WriteBuffer(addr, size int, s string, tainted bool) int {
+	vm.CheckBounds(addr, size)
+	runes := []rune(s)
+	if size < 1 {
+		return 0
+	} else if len(runes) > size-1 {
+		runes = runes[:size-1]
+	}
+	for i, r := range runes {
+		vm.memory[addr+i] = float64(r)
+		vm.SetTainted(addr+i, tainted)
+	}
+	vm.memory[addr+len(runes)] = 0
+	return len(runes)
+}
+
+// Write a string to the given address, zero terminated, and return
+// the number of characters written. The memory at the address must
+// have room for each character of the string, and the zero.
+func (vm *VM) WriteString(addr int, s string) int {
+	return vm.WriteBuffer(addr, len([]rune(s))+1, s, false)
+}
+
+// Allocate a zero terminated copy of a string on the heap, and
+// return its address, such as for a foreign function to return
+// as a `&char`. The program is responsible for freeing it.
+func (vm *VM) AllocString(s string) int {
+	cells := []float64{}
+	for _, r := range s {
+		cells = append(cells, float64(r))
+	}
+	return vm.CopyIn(append(cells, 0))
+}
+
+// Allocate a copy of the given cells on the heap, and return its
+// address, such as for an array that a foreign function returns as a
+// `&num`. The program is responsible for freeing it.
+func (vm *VM) CopyIn(cells []float64) int {
+	vm.Push(float64(len(cells)))
+	addr := vm.Allocate()
+	vm.Pop()
+	copy(vm.memory[addr:], cells)
+	return addr
+}
+
+// Get a copy of the `n` cells of memory starting at `addr`,
+// such as the elements of an array that the program passes
+func (vm *VM) CopyOut(addr, n int) []float64 {
+	vm.load_from(addr, n)
+	cells := make([]float64, n)
+	for i := n - 1; i >= 0; i -= 1 {
+		cells[i] = vm.Pop()
+	}
+	return cells
+}
+
+// Get the `size` cells starting at `addr` as bytes. Each cell must hold
+// a whole number from 0 to 255, so that no data is silently lost.
+func (vm *VM) Bytes(addr, size int) []byte {
+	vm.CheckBounds(addr, size)
+	data := make([]byte, size)
+	for i := range data {
+		n := vm.memory[addr+i]
+		if n != math.Trunc(n) || n < 0 || n > 255 {
+			vm.Fail(INVALID_BYTE, fmt.Sprintf("the cell at %d holds %v, which isn't a byte", addr+i, n))
+		}
+		data[i] = byte(n)
+	}
+	return data
+}
+
+// Free `size` cells of the heap, starting at `addr`
+func (vm *VM) FreeCells(addr, size int) {
+	vm.Push(float64(size))
+	vm.Push(float64(addr))
+	vm.Free()
+}
+
+// The program's functions by name. Each takes its arguments off of
+// the stack, with the first argument on top, and pushes its return
+// value in their place.
+var functions = map[string]func(*VM){}
+
+// Index the functions in `FN_TABLE` by name, once it is filled in
+func IndexFunctions() {
+	functions = make(map[string]func(*VM), len(FN_NAMES))
+	for id, name := range FN_NAMES {
+		functions[name] = FN_TABLE[id]
+	}
+}
+
+// The names of the program's functions, in order
+func FunctionNames() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the function with the given name in the source
+func FunctionNamed(name string) (func(*VM), bool) {
+	fn, ok := functions[name]
+	return fn, ok
+}
+
+// Call the Oak function with the given name from a foreign function,
+// such as a comparator that the program passes to a Go sort, and get
+// the cells that it returns. Each argument is one cell, in the order
+// of the function's parameters.
+func (vm *VM) CallOak(name string, args ...float64) []float64 {
+	fn, ok := FunctionNamed(name)
+	if !ok {
+		vm.Fail(INVALID_FUNCTION, fmt.Sprintf("no function named `%s` for a foreign function to call", name))
+	}
+	// The first argument is on the top of the stack, and the
+	// function replaces the arguments with its return value
+	start := vm.stack_ptr
+	for i := len(args) - 1; i >= 0; i -= 1 {
+		vm.Push(args[i])
+	}
+	fn(vm)
+	if vm.stack_ptr < start {
+		vm.Fail(STACK_UNDERFLOW, fmt.Sprintf("`%s` takes more than the %d cells of arguments that it was given", name, len(args)))
+	}
+	result := make([]float64, vm.stack_ptr-start)
+	for i := len(result) - 1; i >= 0; i -= 1 {
+		result[i] = vm.Pop()
+	}
+	return result
+}
+
+// Report an error from a foreign function, such as one that a Go
+// function returned, instead of exiting or pushing a sentinel value.
+// The program's trap handler is called with `FOREIGN_ERROR`, and can
+// get the error's message with `foreign_error`. If the handler
+// recovers, this returns true, and the foreign function must still
+// push its result, such as a zero. Otherwise the machine stops.
+func (vm *VM) ForeignError(err error) bool {
+	vm.foreign_error = err.Error()
+	if vm.trap(FOREIGN_ERROR) {
+		return true
+	}
+	vm.Fail(FOREIGN_ERROR, "foreign function failed: "+err.Error())
+	return false
+}
+
+// The message of the last error reported with `ForeignError`
+func (vm *VM) LastForeignError() string { return vm.foreign_error }
+
+// Call the Oak function `handler` when the machine hits an error that
+// it can recover from, such as running out of memory. The handler
+// takes the error's code, and returns whether it recovered.
+func (vm *VM) SetTrapHandler(handler func(*VM)) { vm.trap_handler = handler }
+
+// Call the Oak function with the given name, like `CallOak`, and get
+// the `returnSize` cells that it returns. This is for Go code that
+// embeds the machine, so errors that would stop the machine are returned
+// instead, along with an error if the function returns a different
+// number of cells.
+func (vm *VM) Call(name string, args []float64, returnSize int) (result []float64, err error) {
+	// An error stops the function partway through, leaving its stack
+	// frames behind, so put the machine back the way it was before the
+	// call. This runs after the error is recovered.
+	stack_ptr, base_ptr, depth := vm.stack_ptr, vm.base_ptr, len(vm.call_stack)
+	line, checkpoints := vm.line, len(vm.ffi_checkpoints)
+	trampoline_depth := vm.trampoline_depth
+	defer func() {
+		if err != nil {
+			vm.clear_cells(stack_ptr, vm.stack_ptr)
+			vm.stack_ptr, vm.base_ptr = stack_ptr, base_ptr
+			// The stack trace pairs each call with the line it was
+			// called from, so these are trimmed together
+			if len(vm.call_stack) > depth {
+				vm.call_stack = vm.call_stack[:depth]
+				vm.call_lines = vm.call_lines[:depth]
+			}
+			vm.line = line
+			if len(vm.ffi_checkpoints) > checkpoints {
+				vm.ffi_checkpoints = vm.ffi_checkpoints[:checkpoints]
+			}
+			vm.trampoline_depth, vm.tail_fn = trampoline_depth, nil
+			vm.in_trap = false
+		}
+	}()
+	defer RecoverError(&err)
+	result = vm.CallOak(name, args...)
+	if len(result) != returnSize {
+		return result, fmt.Errorf("`%s` returned %d cells instead of %d", name, len(result), returnSize)
+	}
+	return result, nil
+}
+
+// A Go value that is mirrored into a cell of each machine's memory,
+// such as a setting or a sensor reading, so that the program can read
+// it through a pointer instead of calling a foreign function each time.
+// `Get` is called each time the program loads the global, and `Set`
+// each time it stores to it, or `Set` is nil if the global is read only.
+type ForeignGlobal struct {
+	Name string
+	Get  func() float64
+	Set  func(float64)
+}
+
+// The foreign globals, in the order that they were registered
+var FOREIGN_GLOBALS []ForeignGlobal
+
+// Reserve a cell at the top of memory for each foreign global,
+// which the heap and the stack are kept out of
+func (vm *VM) map_foreign_globals() {
+	vm.foreign_base = vm.capacity - len(FOREIGN_GLOBALS)
+	vm.heap_start = vm.foreign_base
+	for i := vm.foreign_base; i < vm.capacity; i += 1 {
+		vm.allocated[i] = true
+	}
+}
+
+// Get the address of the foreign global with the given name
+func (vm *VM) ForeignGlobalAddr(name string) (int, bool) {
+	for i, global := range FOREIGN_GLOBALS {
+		if global.Name == name {
+			return vm.foreign_base + i, true
+		}
+	}
+	return 0, false
+}
+
+// Sync the foreign globals among the `size` cells at `addr` with
+// their Go values, before the cells are loaded, or after they are stored
+func (vm *VM) sync_foreign_globals(addr, size int, stored bool) {
+	start := addr
+	if start < vm.foreign_base {
+		start = vm.foreign_base
+	}
+	for i := start; i < addr+size; i += 1 {
+		global := FOREIGN_GLOBALS[i-vm.foreign_base]
+		if !stored {
+			vm.memory[i] = global.Get()
+		} else if global.Set != nil {
+			global.Set(vm.memory[i])
+		} else {
+			vm.Fail(OUT_OF_BOUNDS, fmt.Sprintf("foreign global `%s` is read only", global.Name))
+		}
+	}
+}
+
+// The families of builtins contributed by extensions, such as a
+// graphics pack. An extension is a foreign Go file that registers
+// its builtins in an `init` function, and Oak code declares them
+// with `extern fn family::name as name(...)`.
+var EXTENSIONS = map[string]map[string]func(*VM){}
+
+// Call a builtin contributed by an extension
+func (vm *VM) call_extension(family, name string) {
+	builtin, ok := EXTENSIONS[family][name]
+	if !ok {
+		vm.Fail(NO_SUCH_BUILTIN, fmt.Sprintf("no extension provides the builtin `%s::%s`", family, name))
+	}
+	builtin(vm)
+}
+
+// The foreign functions that the program calls, by name. The ones that
+// it calls without defining are nil until they are registered.
+var FOREIGN_FNS = map[string]func(*VM){}
+
+// Call a foreign function by its name
+func (vm *VM) CallForeign(name string) {
+	if fn := FOREIGN_FNS[name]; fn != nil {
+		fn(vm)
+		return
+	}
+	// Foreign functions named like `graphics::draw_line` are
+	// builtins registered by an extension at runtime
+	if i := strings.LastIndex(name, "::"); i >= 0 {
+		vm.call_extension(name[:i], name[i+2:])
+		return
+	}
+	vm.Fail(NO_SUCH_BUILTIN, fmt.Sprintf("no foreign function `%s` is registered", name))
+}
@@ -0,0 +1,55 @@
+package main
+
+// The golden-output tests that `--emit-tests` writes next to the program
+// as `main_test.go`. Each `testdata/NAME.in` file is given to the program
+// as its input, and its output must match `testdata/NAME.out`. Run
+// `go test -update` to write the current output to the `.out` files.
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var UPDATE = flag.Bool("update", false, "write the program's output to the `.out` files in testdata")
+
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Skip("there are no `.in` files in testdata")
+	}
+
+	for _, input := range inputs {
+		golden := strings.TrimSuffix(input, ".in") + ".out"
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			stdin, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stdout bytes.Buffer
+			if err := Run(bytes.NewReader(stdin), &stdout); err != nil {
+				t.Fatalf("the program stopped with an error: %s", err)
+			}
+
+			if *UPDATE {
+				if err := os.WriteFile(golden, stdout.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, so run `go test -update` to write it", err)
+			}
+			if !bytes.Equal(stdout.Bytes(), expected) {
+				t.Errorf("the output doesn't match %s\ngot:\n%s\nexpected:\n%s", golden, stdout.Bytes(), expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Running a program image: an Oak program compiled by the `go_vm`
+// target with `--embed`, serialized as JSON. The image is embedded
+// in the output program as `PROGRAM`, but with `-program`, the same
+// binary runs another image instead. So, one prebuilt interpreter can
+// run many Oak programs, as long as it has their foreign functions.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var PROGRAM_PATH = FLAGS.String("program", "", "run the program image in this file instead of the embedded one")
+var WRITE_PROGRAM = FLAGS.String("write-program", "", "write the embedded program image to this file, and exit")
+
+type program_image struct {
+	GlobalScopeSize int       `json:"global_scope_size"`
+	Capacity        int       `json:"capacity"`
+	Entry           int       `json:"entry"`
+	Code            []float64 `json:"code"`
+	Data            []float64 `json:"data"`
+	FnNames         []string  `json:"fn_names"`
+	FnFiles         []string  `json:"fn_files"`
+	FnOffsets       []int     `json:"fn_offsets"`
+	ForeignNames    []string  `json:"foreign_names"`
+}
+
+// Load the program image given by the runtime options, or
+// the embedded one, and run it
+func RunImage(embedded string) {
+	data := []byte(embedded)
+	if *WRITE_PROGRAM != "" {
+		if err := os.WriteFile(*WRITE_PROGRAM, data, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "could not write the program image:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *PROGRAM_PATH != "" {
+		var err error
+		if data, err = os.ReadFile(*PROGRAM_PATH); err != nil {
+			fmt.Fprintln(os.Stderr, "could not read the program image:", err)
+			os.Exit(1)
+		}
+	}
+
+	var image program_image
+	if err := json.Unmarshal(data, &image); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid program image:", err)
+		os.Exit(1)
+	}
+	CODE, DATA, FN_NAMES, FN_FILES = image.Code, image.Data, image.FnNames, image.FnFiles
+	FN_TABLE, FN_OFFSETS = nil, image.FnOffsets
+	for _, offset := range image.FnOffsets {
+		FN_TABLE = append(FN_TABLE, InterpretedFn(offset))
+	}
+	IndexFunctions()
+	FOREIGN_NAMES = image.ForeignNames
+	check_foreign_fns(image.ForeignNames)
+
+	err := RunMachine(image.GlobalScopeSize, image.Capacity, func(vm *VM) {
+		FN_TABLE[image.Entry](vm)
+	})
+	ExitOnError(err)
+}
+
+// Make sure that the interpreter has every foreign function that an
+// image calls before running it, since the image may be built
+// with different ones. Builtins from extensions are found at runtime.
+func check_foreign_fns(names []string) {
+	for _, name := range names {
+		if FOREIGN_FNS[name] == nil && !strings.Contains(name, "::") {
+			fmt.Fprintf(os.Stderr, "the interpreter was not built with the foreign function `%s`\n", name)
+			os.Exit(1)
+		}
+	}
+}
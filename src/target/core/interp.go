@@ -0,0 +1,165 @@
+// The interpreter for the `go_vm` target's bytecode. Instead of a Go
+// function for each Oak function, the whole program is a single table of
+// cells, `CODE`, which is much faster for `go build` to compile. Each
+// instruction is an opcode followed by its operands, and each function
+// is a range of the table that ends with `OP_RETURN`.
+
+import "fmt"
+
+const (
+	OP_RETURN = iota
+	OP_PUSH
+	OP_ADD
+	OP_SUBTRACT
+	OP_MULTIPLY
+	OP_DIVIDE
+	OP_SIGN
+	OP_ALLOCATE
+	OP_FREE
+	OP_STORE
+	OP_LOAD
+	OP_LOAD_BASE_PTR
+	OP_ESTABLISH_STACK_FRAME
+	OP_END_STACK_FRAME
+	OP_ENTER_FN
+	OP_EXIT_FN
+	OP_SET_LINE
+	OP_CALL
+	OP_CALL_INDIRECT
+	OP_CALL_FOREIGN
+	OP_MAKE_CLOSURE
+	OP_FREE_CLOSURE
+	OP_BEGIN_TAIL_CALLS
+	OP_TAIL_CALL
+	OP_MUTUAL_TAIL_CALL
+	OP_WHILE
+	OP_END_WHILE
+	OP_STORE_DATA
+)
+
+// The program's bytecode, the offset in `CODE` of each of its functions,
+// and the names of the foreign functions that `OP_CALL_FOREIGN` calls
+var CODE []float64
+var FN_OFFSETS []int
+var FOREIGN_NAMES []string
+
+// A function that interprets the bytecode starting at `offset`, for `FN_TABLE`
+func InterpretedFn(offset int) func(*VM) {
+	return func(vm *VM) {
+		vm.Interpret(CODE, offset)
+	}
+}
+
+// Run the instructions in `code`, starting at `pc`, until `OP_RETURN`
+func (vm *VM) Interpret(code []float64, pc int) {
+	// Where a tail call jumps back to, and the stack pointer
+	// it expects, as in the Go target's `tail_calls` loop
+	tail_calls, tail_call_entry := 0, 0
+	for {
+		switch int(code[pc]) {
+		case OP_RETURN:
+			return
+		case OP_PUSH:
+			vm.Push(code[pc+1])
+			pc += 2
+		case OP_ADD:
+			vm.Add()
+			pc += 1
+		case OP_SUBTRACT:
+			vm.Subtract()
+			pc += 1
+		case OP_MULTIPLY:
+			vm.Multiply()
+			pc += 1
+		case OP_DIVIDE:
+			vm.Divide()
+			pc += 1
+		case OP_SIGN:
+			vm.Sign()
+			pc += 1
+		case OP_ALLOCATE:
+			vm.Allocate()
+			pc += 1
+		case OP_FREE:
+			vm.Free()
+			pc += 1
+		case OP_STORE:
+			vm.Store(int(code[pc+1]))
+			pc += 2
+		case OP_LOAD:
+			vm.Load(int(code[pc+1]))
+			pc += 2
+		case OP_LOAD_BASE_PTR:
+			vm.LoadBasePtr()
+			pc += 1
+		case OP_ESTABLISH_STACK_FRAME:
+			vm.EstablishStackFrame(int(code[pc+1]), int(code[pc+2]))
+			pc += 3
+		case OP_END_STACK_FRAME:
+			vm.EndStackFrame(int(code[pc+1]), int(code[pc+2]))
+			pc += 3
+		case OP_ENTER_FN:
+			vm.EnterFn(int(code[pc+1]))
+			pc += 2
+		case OP_EXIT_FN:
+			vm.ExitFn(int(code[pc+1]))
+			pc += 2
+		case OP_SET_LINE:
+			vm.SetLine(int(code[pc+1]))
+			pc += 2
+		case OP_CALL:
+			FN_TABLE[int(code[pc+1])](vm)
+			pc += 2
+		case OP_CALL_INDIRECT:
+			vm.CallIndirect()
+			pc += 1
+		case OP_CALL_FOREIGN:
+			index := int(code[pc+1])
+			vm.BeginForeignCall()
+			vm.CallForeign(FOREIGN_NAMES[index])
+			vm.EndForeignCall(FOREIGN_NAMES[index], int(code[pc+2]), int(code[pc+3]))
+			pc += 4
+		case OP_MAKE_CLOSURE:
+			vm.MakeClosure(int(code[pc+1]), int(code[pc+2]))
+			pc += 3
+		case OP_FREE_CLOSURE:
+			vm.FreeClosure()
+			pc += 1
+		case OP_BEGIN_TAIL_CALLS:
+			pc += 1
+			tail_calls, tail_call_entry = pc, vm.stack_ptr
+		case OP_TAIL_CALL:
+			if vm.ReuseStackFrame(tail_call_entry, int(code[pc+1])) {
+				pc = tail_calls
+			} else {
+				FN_TABLE[int(code[pc+2])](vm)
+				pc += 3
+			}
+		case OP_MUTUAL_TAIL_CALL:
+			// Run the callee in place of the function that left its
+			// stack frame, instead of calling it from this interpreter
+			id := int(code[pc+3])
+			if vm.LeaveStackFrame(tail_call_entry-int(code[pc+1]), int(code[pc+2])) {
+				code, pc = CODE, FN_OFFSETS[id]
+			} else {
+				FN_TABLE[id](vm)
+				pc += 4
+			}
+		case OP_WHILE:
+			// Jump past the end of the loop when the condition is false
+			if vm.Pop() != 0.0 {
+				pc += 2
+			} else {
+				pc = int(code[pc+1])
+			}
+		case OP_END_WHILE:
+			// Jump back to check the condition again
+			pc = int(code[pc+1])
+		case OP_STORE_DATA:
+			vm.StoreData(int(code[pc+1]), int(code[pc+2]))
+			pc += 3
+		default:
+			panic(fmt.Sprintf("invalid opcode %g at %d", code[pc], pc))
+		}
+	}
+}
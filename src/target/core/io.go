@@ -0,0 +1,131 @@
+// The program's standard input and output. TinyGo and
+// browser builds use `tinygo.go` and `wasm.go` instead.
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// The buffered standard input, which every machine reads by default
+var STDIN = bufio.NewReader(os.Stdin)
+
+// The input and output of a machine. Machines that run on separate
+// goroutines should each be given their own, because they are not
+// safe to share.
+type machine_io struct {
+	input  *bufio.Reader
+	output io.Writer
+	// Whether a read has reached the end of the input
+	eof bool
+	// The input read by another goroutine, once the program starts
+	// polling for it. Every read comes from here after that.
+	polled chan byte
+}
+
+func machine_io_new() machine_io {
+	return machine_io{input: STDIN, output: os.Stdout}
+}
+
+// Run the function `entry` on a new machine that reads from `stdin`
+// and writes to `stdout`, and return the error that stopped it. This
+// runs the program's `Run` function, which plugin hosts and the tests
+// written by `--emit-tests` call.
+func RunWithIO(stdin io.Reader, stdout io.Writer, global_scope_size, capacity int, entry func(*VM)) (err error) {
+	defer RecoverError(&err)
+	vm := NewVM(global_scope_size, capacity)
+	vm.SetIO(stdin, stdout)
+	err = vm.run(entry)
+	// Exiting early with a status of zero isn't an error
+	if e, ok := err.(*machine_exit); ok && e.code == 0 {
+		return nil
+	}
+	return err
+}
+
+// Make the machine read from `stdin` and write to `stdout`,
+// instead of the program's standard input and output
+func (vm *VM) SetIO(stdin io.Reader, stdout io.Writer) {
+	vm.machine_io = machine_io{input: bufio.NewReader(stdin), output: stdout}
+}
+
+// Read a byte of input, or zero at the end of the input
+func (vm *VM) InputByte() byte {
+	if vm.polled != nil {
+		ch, ok := <-vm.polled
+		if !ok {
+			vm.eof = true
+		}
+		return ch
+	}
+	ch, err := vm.input.ReadByte()
+	if err != nil {
+		vm.eof = true
+	}
+	return ch
+}
+
+// Read a line of input, including its newline
+func (vm *VM) InputLine() (string, error) {
+	if vm.polled != nil {
+		line := []byte{}
+		for {
+			ch, ok := <-vm.polled
+			if !ok {
+				vm.eof = true
+				return string(line), io.EOF
+			}
+			line = append(line, ch)
+			if ch == '\n' {
+				return string(line), nil
+			}
+		}
+	}
+	line, err := vm.input.ReadString('\n')
+	if err != nil {
+		vm.eof = true
+	}
+	return line, err
+}
+
+// Get a byte of input if there is one ready, without waiting for it.
+// The first poll starts reading the input on another goroutine.
+func (vm *VM) PollInput() (byte, bool) {
+	if vm.polled == nil {
+		polled, input := make(chan byte, 256), vm.input
+		go func() {
+			for {
+				ch, err := input.ReadByte()
+				if err != nil {
+					close(polled)
+					return
+				}
+				polled <- ch
+			}
+		}()
+		vm.polled = polled
+	}
+
+	select {
+	case ch, ok := <-vm.polled:
+		if !ok {
+			vm.eof = true
+		}
+		return ch, ok
+	default:
+		return 0, false
+	}
+}
+
+// Has a read reached the end of the input?
+func (vm *VM) AtEOF() bool {
+	return vm.eof
+}
+
+// Write a string to the output
+func (vm *VM) Print(s string) {
+	io.WriteString(vm.output, s)
+}
+
+// Output is written as soon as it is given, so there is nothing to flush
+func (vm *VM) Flush() {}
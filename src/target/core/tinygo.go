@@ -0,0 +1,101 @@
+// The program's standard input and output for TinyGo, which replaces
+// `io.go`. Input is read a byte at a time, without `bufio`, and output
+// is written with the `print` builtin, which TinyGo sends to the serial
+// port or console of the board.
+
+import (
+	"io"
+	"os"
+)
+
+// TinyGo programs run a single machine, so it has nothing of its own
+type machine_io struct{}
+
+func machine_io_new() machine_io {
+	return machine_io{}
+}
+
+// Whether a read has reached the end of the input
+var STDIN_EOF = false
+
+// The input read by another goroutine, once the program starts
+// polling for it. Every read comes from here after that.
+var POLLED chan byte
+
+// Read a byte of standard input, or from `POLLED` if it's being polled
+func read_stdin() (byte, bool) {
+	if POLLED != nil {
+		ch, ok := <-POLLED
+		return ch, ok
+	}
+	var buf [1]byte
+	_, err := os.Stdin.Read(buf[:])
+	return buf[0], err == nil
+}
+
+// Read a byte of input, or zero at the end of the input
+func (vm *VM) InputByte() byte {
+	ch, ok := read_stdin()
+	if !ok {
+		STDIN_EOF = true
+	}
+	return ch
+}
+
+// Read a line of input, including its newline
+func (vm *VM) InputLine() (string, error) {
+	line := []byte{}
+	for {
+		ch, ok := read_stdin()
+		if !ok {
+			STDIN_EOF = true
+			return string(line), io.EOF
+		}
+		line = append(line, ch)
+		if ch == '\n' {
+			return string(line), nil
+		}
+	}
+}
+
+// Get a byte of input if there is one ready, without waiting for it.
+// The first poll starts reading the input on another goroutine.
+func (vm *VM) PollInput() (byte, bool) {
+	if POLLED == nil {
+		polled := make(chan byte, 256)
+		go func() {
+			var buf [1]byte
+			for {
+				if _, err := os.Stdin.Read(buf[:]); err != nil {
+					close(polled)
+					return
+				}
+				polled <- buf[0]
+			}
+		}()
+		POLLED = polled
+	}
+
+	select {
+	case ch, ok := <-POLLED:
+		if !ok {
+			STDIN_EOF = true
+		}
+		return ch, ok
+	default:
+		return 0, false
+	}
+}
+
+// Has a read reached the end of the input?
+func (vm *VM) AtEOF() bool {
+	return STDIN_EOF
+}
+
+// Write a string to the output
+func (vm *VM) Print(s string) {
+	print(s)
+}
+
+// Output is written as soon as it is given, so there is nothing to flush
+func (vm *VM) Flush() {}
@@ -0,0 +1,213 @@
+// The options that watch the machine as the program runs, such as
+// `-trace` and `-taint`. The debuggers and the other tools that report
+// on the machine are in the `debug` package, which uses its hooks.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Runtime options, parsed from the command line of the compiled program.
+// They have their own set, instead of the `flag` package's global one,
+// so that they don't clash with a host program's options when the
+// program is loaded as a plugin. The packages built on the machine
+// add their own options to this set.
+var FLAGS = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+var DEBUG_FFI = FLAGS.Bool("debug-ffi", false, "report changes foreign functions make to the stack beyond their arguments and return values")
+var TAINT_MODE = FLAGS.Bool("taint", false, "track user input through memory and report when it reaches a sensitive builtin")
+var TRACE_OPS = FLAGS.Bool("trace", false, "print each operation of the machine, with its operands and the stack pointer, to stderr")
+var LOG_CALLS = FLAGS.Bool("log-calls", false, "print each Oak function call with its argument cells, and each return with its returned cells, to stderr")
+var WATCH = FLAGS.String("watch", "", "report each load and store that touches these cells, such as `100-107,200`")
+var MAX_OPS = FLAGS.Int("max-ops", 0, "stop the program after this many pushes and pops, or 0 for no limit")
+var TIMEOUT = FLAGS.Duration("timeout", 0, "stop the program after it runs for this long, such as `10s`, or 0 for no limit")
+
+// Parse the runtime options. Options that replace running the
+// program, such as `-load-core`, are handled as they are parsed.
+func ParseFlags() {
+	FLAGS.Parse(os.Args[1:])
+}
+
+// Print an operation of the machine for `-trace`. Callers check the
+// flag themselves, so that operands aren't formatted when it is off.
+func (vm *VM) trace_op(op string, operands string) {
+	fmt.Fprintf(os.Stderr, "trace: %-6s %-16s sp=%d\n", op, operands, vm.stack_ptr)
+}
+
+// Print the call to the innermost function for `-log-calls`, with the
+// `arg_size` argument cells on the top of the stack. The cells are in
+// the order they are on the stack, so the last argument comes first.
+func (vm *VM) log_call(arg_size int) {
+	depth := len(vm.call_stack) - 1
+	fmt.Fprintf(os.Stderr, "%s-> %s(%s)\n", strings.Repeat("  ", depth), FN_NAMES[vm.call_stack[depth]], vm.format_cells(vm.stack_ptr-arg_size, arg_size))
+}
+
+// Print the return from the innermost function for `-log-calls`,
+// with the `return_size` returned cells on the top of the stack
+func (vm *VM) log_return(return_size int) {
+	depth := len(vm.call_stack) - 1
+	fmt.Fprintf(os.Stderr, "%s<- %s = [%s]\n", strings.Repeat("  ", depth), FN_NAMES[vm.call_stack[depth]], vm.format_cells(vm.stack_ptr-return_size, return_size))
+}
+
+// Format `size` cells starting at `addr`, separated by commas
+func (vm *VM) format_cells(addr, size int) string {
+	cells := []string{}
+	for i := addr; i < addr+size; i += 1 {
+		if i >= 0 && i < vm.capacity {
+			cells = append(cells, fmt.Sprint(vm.memory[i]))
+		}
+	}
+	return strings.Join(cells, ", ")
+}
+
+// Parse the ranges of cells for `-watch`, such as `100-107,200`
+func parse_watchpoints(ranges string) [][2]int {
+	var result [][2]int
+	for _, item := range strings.Split(ranges, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || last < first {
+			fmt.Fprintf(os.Stderr, "invalid watchpoint `%s`, expected a cell such as `200` or a range such as `100-107`\n", item)
+			os.Exit(1)
+		}
+		result = append(result, [2]int{first, last + 1})
+	}
+	return result
+}
+
+// Watch `size` cells starting at `addr`
+func (vm *VM) Watch(addr, size int) {
+	vm.watchpoints = append(vm.watchpoints, [2]int{addr, addr + size})
+}
+
+// Report the watched cells among the `size` cells at `addr` that
+// the current Oak function has just loaded or stored
+func (vm *VM) report_watched(action string, addr, size int) {
+	where := "the entry point"
+	if depth := len(vm.call_stack); depth > 0 {
+		id := vm.call_stack[depth-1]
+		where = fmt.Sprintf("`%s`%s", FN_NAMES[id], Location(id, vm.line))
+	}
+	for i := addr; i < addr+size; i += 1 {
+		for _, watched := range vm.watchpoints {
+			if i >= watched[0] && i < watched[1] {
+				fmt.Fprintf(os.Stderr, "watch: %s %s %g at cell %d\n", where, action, vm.memory[i], i)
+				break
+			}
+		}
+	}
+}
+
+// Take a snapshot of the stack before calling a foreign function
+func (vm *VM) BeginForeignCall() {
+	if *DEBUG_FFI {
+		checkpoint := make([]float64, vm.stack_ptr)
+		copy(checkpoint, vm.memory[:vm.stack_ptr])
+		vm.ffi_checkpoints = append(vm.ffi_checkpoints, checkpoint)
+	}
+}
+
+// Compare the stack after calling a foreign function against the
+// snapshot taken before the call. A foreign function is only allowed
+// to pop its `arg_size` argument cells and push `return_size` cells.
+func (vm *VM) EndForeignCall(name string, arg_size, return_size int) {
+	if !*DEBUG_FFI {
+		return
+	}
+	checkpoint := vm.ffi_checkpoints[len(vm.ffi_checkpoints)-1]
+	vm.ffi_checkpoints = vm.ffi_checkpoints[:len(vm.ffi_checkpoints)-1]
+
+	expected := len(checkpoint) - arg_size + return_size
+	if vm.stack_ptr != expected {
+		fmt.Fprintf(os.Stderr, "ffi: `%s` takes %d cells and returns %d, so the stack pointer should be %d, but it is %d\n", name, arg_size, return_size, expected, vm.stack_ptr)
+	}
+	for i := 0; i < len(checkpoint)-arg_size; i += 1 {
+		if vm.memory[i] != checkpoint[i] {
+			fmt.Fprintf(os.Stderr, "ffi: `%s` changed stack cell %d from %g to %g\n", name, i, checkpoint[i], vm.memory[i])
+		}
+	}
+}
+
+// Is the cell at the given address derived from user input?
+func (vm *VM) is_tainted(addr int) bool {
+	return vm.taint != nil && vm.taint[addr]
+}
+
+// Whether any character of the zero terminated string at the given
+// address is derived from user input
+func (vm *VM) IsTaintedString(addr int) bool {
+	for i := addr; vm.taint != nil && i < len(vm.memory) && vm.memory[i] != 0; i += 1 {
+		if vm.taint[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark or unmark the cell at the given address as derived from user input.
+func (vm *VM) SetTainted(addr int, tainted bool) {
+	if vm.taint != nil {
+		vm.taint[addr] = tainted
+	}
+}
+
+// Are any of the top `n` cells on the stack derived from user input?
+func (vm *VM) top_tainted(n int) bool {
+	for i := 1; i <= n && i <= vm.stack_ptr; i += 1 {
+		if vm.is_tainted(vm.stack_ptr - i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report that tainted data has reached a sensitive builtin.
+func (vm *VM) TaintSink(builtin string, tainted bool) {
+	if tainted {
+		fmt.Fprintf(os.Stderr, "taint: user input reaches `%s`\n", builtin)
+	}
+}
+
+// Read the zero terminated string at the given address for a sensitive
+// builtin, such as the path of a file to open, and report if it is
+// derived from user input.
+func (vm *VM) ReadSinkString(builtin string, addr int) string {
+	vm.TaintSink(builtin, vm.IsTaintedString(addr))
+	return vm.ReadString(addr)
+}
+
+// Record the line of the statement about to run. In `-debug`
+// mode, this is where the debugger pauses the program.
+func (vm *VM) SetLine(line int) {
+	vm.line = line
+	for _, hooks := range vm.hooks {
+		if hooks.Statement != nil {
+			hooks.Statement(vm, line)
+		}
+	}
+}
+
+// Pause the program where the Oak program asks to, if it is being
+// debugged with `-debug` or `-dap`. Otherwise, this does nothing,
+// except mark the point in the `-trace` output.
+func (vm *VM) Break() {
+	if *TRACE_OPS {
+		vm.trace_op("break", "")
+	}
+	for _, hooks := range vm.hooks {
+		if hooks.Break != nil {
+			hooks.Break(vm)
+		}
+	}
+}
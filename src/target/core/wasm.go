@@ -0,0 +1,106 @@
+// The program's standard input and output in the browser, which
+// replaces `io.go` when the program is built for WebAssembly. Output
+// is added to the element with the ID `oak-console`, or logged to the
+// browser's console a line at a time if the page doesn't have one.
+// Input is read from a queue that the page fills by calling the
+// global `oakInput(text)` function.
+
+import (
+	"bytes"
+	"syscall/js"
+)
+
+// The page has a single input queue and console, so
+// a machine has no input or output of its own
+type machine_io struct{}
+
+func machine_io_new() machine_io {
+	return machine_io{}
+}
+
+// The text given to `oakInput` that hasn't been read yet
+var INPUT = make(chan string)
+var PENDING_INPUT []byte
+
+// The output that hasn't been logged yet, without a console element
+var PENDING_OUTPUT []byte
+
+func init() {
+	js.Global().Set("oakInput", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		for _, arg := range args {
+			// Queue the input without blocking the page
+			text := arg.String()
+			go func() { INPUT <- text }()
+		}
+		return nil
+	}))
+}
+
+// Read a byte of input, waiting for the page to provide it
+func (vm *VM) InputByte() byte {
+	for len(PENDING_INPUT) == 0 {
+		PENDING_INPUT = []byte(<-INPUT)
+	}
+	ch := PENDING_INPUT[0]
+	PENDING_INPUT = PENDING_INPUT[1:]
+	return ch
+}
+
+// Read a line of input, including its newline
+func (vm *VM) InputLine() (string, error) {
+	line := []byte{}
+	for {
+		ch := vm.InputByte()
+		line = append(line, ch)
+		if ch == '\n' {
+			return string(line), nil
+		}
+	}
+}
+
+// Get a byte of input if the page has given one, without waiting for it
+func (vm *VM) PollInput() (byte, bool) {
+	if len(PENDING_INPUT) == 0 {
+		select {
+		case text := <-INPUT:
+			PENDING_INPUT = []byte(text)
+		default:
+		}
+	}
+	if len(PENDING_INPUT) == 0 {
+		return 0, false
+	}
+	return vm.InputByte(), true
+}
+
+// The page can always give more input, so it never ends
+func (vm *VM) AtEOF() bool {
+	return false
+}
+
+// Write a string to the output
+func (vm *VM) Print(s string) {
+	if document := js.Global().Get("document"); document.Truthy() {
+		if console := document.Call("getElementById", "oak-console"); console.Truthy() {
+			console.Call("append", s)
+			return
+		}
+	}
+	PENDING_OUTPUT = append(PENDING_OUTPUT, s...)
+	for {
+		i := bytes.IndexByte(PENDING_OUTPUT, '\n')
+		if i < 0 {
+			return
+		}
+		js.Global().Get("console").Call("log", string(PENDING_OUTPUT[:i]))
+		PENDING_OUTPUT = PENDING_OUTPUT[i+1:]
+	}
+}
+
+// Log the last line of output, if it doesn't end with a newline
+func (vm *VM) Flush() {
+	if len(PENDING_OUTPUT) > 0 {
+		js.Global().Get("console").Call("log", string(PENDING_OUTPUT))
+		PENDING_OUTPUT = nil
+	}
+}
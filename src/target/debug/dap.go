@@ -0,0 +1,339 @@
+// A Debug Adapter Protocol server, so that editors such as VS Code can
+// set breakpoints in Oak files, step through statements, and inspect the
+// memory of the running program. With `-dap localhost:4711`, the program
+// waits for the editor to connect before it runs its first statement.
+// In VS Code, a launch configuration with `"debugServer": 4711` connects to it.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var DAP_ADDR = FLAGS.String("dap", "", "wait for a Debug Adapter Protocol client to connect to this address, such as `localhost:4711`")
+
+func init() {
+	OnNewVM(func(vm *VM) {
+		if *DAP_ADDR != "" {
+			vm.AddHooks(Hooks{Statement: dap_statement, Break: dap_break, Fail: dap_exception})
+		}
+	})
+	OnExit(dap_exited)
+}
+
+// The session with the connected client, or nil before it connects
+var DAP *dap_session
+
+// A request sent by the client
+type dap_request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dap_session struct {
+	conn net.Conn
+	seq  int
+	// The requests read from the connection. This is closed when the client disconnects.
+	requests chan dap_request
+	// The lines with breakpoints, by the base name of their file
+	breakpoints map[string]map[int]bool
+	// How the program is being stepped: "in", "over", "out", "pause" or
+	// "entry", or empty while it is running until the next breakpoint.
+	step string
+	// The call depth when the step began, for stepping over and out of calls
+	step_depth int
+	// Whether the client has finished configuring the session, whether it
+	// has resumed the stopped program, and whether it has disconnected
+	configured bool
+	resumed    bool
+	detached   bool
+}
+
+// Wait for a client to connect to the `-dap` address
+func dap_listen(addr string) *dap_session {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not start the debug adapter:", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+	fmt.Fprintf(os.Stderr, "waiting for a debug adapter client at %s\n", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not start the debug adapter:", err)
+		os.Exit(1)
+	}
+
+	session := &dap_session{conn: conn, requests: make(chan dap_request), breakpoints: map[string]map[int]bool{}}
+	go session.read()
+	return session
+}
+
+// Read requests from the connection in the background, so that
+// the client can pause the program or set breakpoints while it runs
+func (s *dap_session) read() {
+	defer close(s.requests)
+	reader := bufio.NewReader(s.conn)
+	for {
+		// Each message has a `Content-Length` header, followed by an empty line
+		length := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				break
+			}
+			if strings.HasPrefix(line, "Content-Length:") {
+				length, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+		var request dap_request
+		if json.Unmarshal(body, &request) == nil && request.Type == "request" {
+			s.requests <- request
+		}
+	}
+}
+
+func (s *dap_session) send(message map[string]interface{}) {
+	s.seq += 1
+	message["seq"] = s.seq
+	data, _ := json.Marshal(message)
+	fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *dap_session) respond(request dap_request, body interface{}) {
+	s.send(map[string]interface{}{"type": "response", "request_seq": request.Seq, "command": request.Command, "success": true, "body": body})
+}
+
+func (s *dap_session) reject(request dap_request, message string) {
+	s.send(map[string]interface{}{"type": "response", "request_seq": request.Seq, "command": request.Command, "success": false, "message": message})
+}
+
+func (s *dap_session) event(name string, body interface{}) {
+	s.send(map[string]interface{}{"type": "event", "event": name, "body": body})
+}
+
+// Handle a request. `ok` is false if the client has disconnected.
+func (s *dap_session) handle(vm *VM, request dap_request, ok bool) {
+	if !ok {
+		s.detached = true
+		return
+	}
+
+	switch request.Command {
+	case "initialize":
+		s.respond(request, map[string]interface{}{"supportsConfigurationDoneRequest": true})
+		s.event("initialized", nil)
+	case "launch", "attach":
+		var args struct {
+			StopOnEntry bool `json:"stopOnEntry"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		if args.StopOnEntry {
+			s.step = "entry"
+		}
+		s.respond(request, nil)
+	case "setBreakpoints":
+		var args struct {
+			Source struct {
+				Path string `json:"path"`
+			} `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		lines := map[int]bool{}
+		verified := []map[string]interface{}{}
+		for _, breakpoint := range args.Breakpoints {
+			lines[breakpoint.Line] = true
+			verified = append(verified, map[string]interface{}{"verified": true, "line": breakpoint.Line})
+		}
+		s.breakpoints[filepath.Base(args.Source.Path)] = lines
+		s.respond(request, map[string]interface{}{"breakpoints": verified})
+	case "configurationDone":
+		s.configured = true
+		s.respond(request, nil)
+	case "threads":
+		s.respond(request, map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "main"}}})
+	case "stackTrace":
+		frames := dap_frames(vm)
+		s.respond(request, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+	case "scopes":
+		var args struct {
+			FrameId int `json:"frameId"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		scopes := []map[string]interface{}{}
+		// Only the innermost function's stack frame is known
+		if args.FrameId == 0 {
+			scopes = append(scopes, map[string]interface{}{"name": "Stack Frame", "variablesReference": 1, "expensive": false})
+		}
+		scopes = append(scopes, map[string]interface{}{"name": "Heap", "variablesReference": 2, "expensive": true})
+		s.respond(request, map[string]interface{}{"scopes": scopes})
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		json.Unmarshal(request.Arguments, &args)
+		s.respond(request, map[string]interface{}{"variables": dap_variables(vm, args.VariablesReference)})
+	case "continue":
+		s.resume("", len(vm.CallStack()))
+		s.respond(request, map[string]interface{}{"allThreadsContinued": true})
+	case "next":
+		s.resume("over", len(vm.CallStack()))
+		s.respond(request, nil)
+	case "stepIn":
+		s.resume("in", len(vm.CallStack()))
+		s.respond(request, nil)
+	case "stepOut":
+		s.resume("out", len(vm.CallStack()))
+		s.respond(request, nil)
+	case "pause":
+		s.step = "pause"
+		s.respond(request, nil)
+	case "disconnect":
+		// Let the program finish without the debugger
+		s.respond(request, nil)
+		s.detached = true
+		s.conn.Close()
+	default:
+		s.reject(request, fmt.Sprintf("`%s` is not supported", request.Command))
+	}
+}
+
+// Resume the stopped program at the given call depth,
+// and stop again according to `step`
+func (s *dap_session) resume(step string, depth int) {
+	s.step = step
+	s.step_depth = depth
+	s.resumed = true
+}
+
+// Stop the program and handle requests until the client resumes it
+func (s *dap_session) stop(vm *VM, reason, text string) {
+	s.event("stopped", map[string]interface{}{"reason": reason, "text": text, "threadId": 1, "allThreadsStopped": true})
+	s.step = ""
+	s.resumed = false
+	for !s.resumed && !s.detached {
+		request, ok := <-s.requests
+		s.handle(vm, request, ok)
+	}
+}
+
+// Called before each statement when the `-dap` flag is used. This
+// connects to the client before the first statement, and stops at
+// breakpoints and steps.
+func dap_statement(vm *VM, line int) {
+	if DAP == nil {
+		DAP = dap_listen(*DAP_ADDR)
+	}
+	s := DAP
+	for !s.configured && !s.detached {
+		request, ok := <-s.requests
+		s.handle(vm, request, ok)
+	}
+	// Handle the requests that arrived while the program was running
+	for polling := true; polling && !s.detached; {
+		select {
+		case request, ok := <-s.requests:
+			s.handle(vm, request, ok)
+		default:
+			polling = false
+		}
+	}
+	if s.detached {
+		return
+	}
+
+	depth := len(vm.CallStack())
+	switch {
+	case s.step == "entry":
+		s.stop(vm, "entry", "")
+	case s.step == "pause":
+		s.stop(vm, "pause", "")
+	case s.step == "in", s.step == "over" && depth <= s.step_depth, s.step == "out" && depth < s.step_depth:
+		s.stop(vm, "step", "")
+	case depth > 0 && s.breakpoints[filepath.Base(FN_FILES[vm.CallStack()[depth-1]])][line]:
+		s.stop(vm, "breakpoint", "")
+	}
+}
+
+// Stop where the Oak program calls `debug_break`
+func dap_break(vm *VM) {
+	if DAP != nil && !DAP.detached {
+		DAP.stop(vm, "breakpoint", "debug_break")
+	}
+}
+
+// Let the client inspect the machine when it stops with an error
+func dap_exception(vm *VM, code int, message string) {
+	if DAP != nil && !DAP.detached {
+		DAP.stop(vm, "exception", message)
+	}
+}
+
+// Tell the client that the program has exited with the given status
+func dap_exited(code int) {
+	if DAP != nil && !DAP.detached {
+		DAP.event("exited", map[string]interface{}{"exitCode": code})
+		DAP.event("terminated", nil)
+		DAP.conn.Close()
+	}
+}
+
+// Describe the Oak functions on the call stack, innermost first
+func dap_frames(vm *VM) []map[string]interface{} {
+	frames := []map[string]interface{}{}
+	line := vm.Line()
+	call_stack := vm.CallStack()
+	for i := len(call_stack) - 1; i >= 0; i -= 1 {
+		id := call_stack[i]
+		frame := map[string]interface{}{"id": len(frames), "name": FN_NAMES[id], "line": line, "column": 1}
+		if FN_FILES[id] != "" {
+			path, _ := filepath.Abs(FN_FILES[id])
+			frame["source"] = map[string]interface{}{"name": filepath.Base(path), "path": path}
+		}
+		frames = append(frames, frame)
+		line = vm.CallLines()[i]
+	}
+	return frames
+}
+
+// Describe the cells of the current stack frame, by their offset from
+// the base pointer, or the allocated cells of the heap, by their address
+func dap_variables(vm *VM, reference int) []map[string]interface{} {
+	memory, allocated := vm.Memory(), vm.Allocated()
+	variables := []map[string]interface{}{}
+	cell := func(name string, addr int) {
+		variables = append(variables, map[string]interface{}{"name": name, "value": fmt.Sprint(memory[addr]), "variablesReference": 0})
+	}
+	switch reference {
+	case 1:
+		for i := vm.BasePtr(); i < vm.StackPtr(); i += 1 {
+			cell(fmt.Sprintf("+%d", i-vm.BasePtr()), i)
+		}
+	case 2:
+		for i := vm.StackPtr(); i < len(memory); i += 1 {
+			if allocated[i] {
+				cell(fmt.Sprintf("[%d]", i), i)
+			}
+		}
+	}
+	return variables
+}
@@ -0,0 +1,438 @@
+// Debugging and analysis tools for the machine, which are enabled
+// by the compiled program's command line options. Each machine is
+// given the hooks for the options that are on when it is created.
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var CHROME_TRACE = FLAGS.String("chrome-trace", "", "write the Oak function calls to this file as Chrome trace-event JSON")
+var HEAP_CHECKSUM = FLAGS.Bool("heap-checksum", false, "print a checksum of the global variables and the heap cells that the program used to stderr when it exits")
+var CORE_DUMP = FLAGS.Bool("core-dump", false, "write the state of the machine to `oak.core` when it stops with an error")
+var VISUALIZE = FLAGS.Bool("visualize", false, "draw the stack, the heap and the allocated cells to stderr when the program exits")
+var VISUALIZE_EVERY = FLAGS.Int("visualize-every", 0, "redraw the memory of the machine every N pushes and pops while the program runs")
+var PROFILE = FLAGS.Bool("profile", false, "count each operation of the machine, and time each Oak function, and print a report to stderr when the program exits")
+var DEBUG = FLAGS.Bool("debug", false, "pause before each Oak statement and read debugger commands from stdin")
+
+func init() {
+	// Printing a core dump replaces running the program
+	FLAGS.Func("load-core", "print the machine state saved in a core dump `file`, instead of running the program", func(path string) error {
+		print_core_dump(path)
+		os.Exit(0)
+		return nil
+	})
+	OnNewVM(attach)
+}
+
+// Give a new machine the hooks for the options that are on
+func attach(vm *VM) {
+	if *CHROME_TRACE != "" {
+		trace := &chrome_trace{start: time.Now()}
+		vm.AddHooks(Hooks{
+			Enter: func(vm *VM, id int) { trace.event(id, "B") },
+			Exit:  func(vm *VM, id int) { trace.event(id, "E") },
+			Drop:  func(vm *VM) { trace.write() },
+		})
+	}
+	if *HEAP_CHECKSUM {
+		vm.AddHooks(Hooks{Drop: print_heap_checksum})
+	}
+	if *PROFILE {
+		p := &profile{ops: map[string]int{}}
+		vm.AddHooks(Hooks{Op: p.op, Enter: p.enter, Exit: p.exit, Drop: p.print})
+	}
+	if *VISUALIZE {
+		vm.AddHooks(Hooks{Drop: visualize})
+	}
+	if *VISUALIZE_EVERY > 0 {
+		ops := 0
+		vm.AddHooks(Hooks{Op: func(vm *VM, op string) {
+			if op != "push" && op != "pop" {
+				return
+			}
+			ops += 1
+			if ops%*VISUALIZE_EVERY == 0 {
+				// Clear the terminal, so that the view is redrawn in place
+				fmt.Fprint(os.Stderr, "\033[H\033[2J")
+				visualize(vm)
+			}
+		}})
+	}
+	if *CORE_DUMP {
+		vm.AddHooks(Hooks{Fail: write_core_dump})
+	}
+	if *DEBUG {
+		d := &debugger{breakpoints: map[int]bool{}}
+		vm.AddHooks(Hooks{Statement: d.statement, Break: d.prompt})
+	}
+}
+
+// A single event in the Chrome trace-event format, which can
+// be opened with Perfetto or chrome://tracing.
+type trace_event struct {
+	Name      string  `json:"name"`
+	Phase     string  `json:"ph"`
+	Timestamp float64 `json:"ts"`
+	Pid       int     `json:"pid"`
+	Tid       int     `json:"tid"`
+}
+
+// The function enter and exit events recorded for `-chrome-trace`
+type chrome_trace struct {
+	start  time.Time
+	events []trace_event
+}
+
+func (t *chrome_trace) event(id int, phase string) {
+	// Timestamps are measured in microseconds
+	timestamp := float64(time.Since(t.start).Nanoseconds()) / 1000
+	t.events = append(t.events, trace_event{FN_NAMES[id], phase, timestamp, 1, 1})
+}
+
+// Write the recorded trace events to the `-chrome-trace` file
+func (t *chrome_trace) write() {
+	data, err := json.Marshal(map[string][]trace_event{"traceEvents": t.events})
+	if err == nil {
+		err = os.WriteFile(*CHROME_TRACE, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not write chrome trace:", err)
+	}
+}
+
+// Print a checksum of the memory that the program used for
+// `-heap-checksum`: where its global variables and its heap are, the
+// values of its globals, and each cell that the heap grew to cover, with
+// whether it is still allocated. Tests can tell when a change to the
+// runtime or the code generator changes how the program lays out memory,
+// what it leaves there, or how much of the heap it needs.
+func print_heap_checksum(vm *VM) {
+	memory, allocated := vm.Memory(), vm.Allocated()
+	start, end := vm.HeapExtent()
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "globals %d, heap %d-%d;", vm.GlobalScopeSize(), start, end)
+	for i := 0; i < vm.GlobalScopeSize(); i += 1 {
+		fmt.Fprintf(hash, "%d:%x;", i, math.Float64bits(memory[i]))
+	}
+	for i := start; i < end; i += 1 {
+		fmt.Fprintf(hash, "%d:%x:%t;", i, math.Float64bits(memory[i]), allocated[i])
+	}
+	fmt.Fprintf(os.Stderr, "heap checksum: %016x\n", hash.Sum64())
+}
+
+// The state of a machine when it stopped with an error, for post-mortem debugging
+type core_dump struct {
+	Code      int       `json:"code"`
+	Message   string    `json:"message"`
+	Trace     string    `json:"trace"`
+	Memory    []float64 `json:"memory"`
+	Allocated []bool    `json:"allocated"`
+	BasePtr   int       `json:"base_ptr"`
+	StackPtr  int       `json:"stack_ptr"`
+}
+
+// Save the state of the machine to `oak.core` for `-core-dump`
+func write_core_dump(vm *VM, code int, message string) {
+	dump := core_dump{code, message, vm.StackTrace(), vm.Memory(), vm.Allocated(), vm.BasePtr(), vm.StackPtr()}
+	data, err := json.Marshal(dump)
+	if err == nil {
+		err = os.WriteFile("oak.core", data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not write core dump:", err)
+	} else {
+		fmt.Fprintln(os.Stderr, "wrote core dump to oak.core")
+	}
+}
+
+// Print the state saved in a core dump: the error, the stack up
+// to the stack pointer, and each run of allocated heap cells.
+func print_core_dump(path string) {
+	var dump core_dump
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &dump)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not read core dump:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("error %d: %s\n%s", dump.Code, dump.Message, dump.Trace)
+	fmt.Printf("\nbase pointer: %d\nstack pointer: %d\ncapacity: %d\n", dump.BasePtr, dump.StackPtr, len(dump.Memory))
+
+	fmt.Println("\nstack:")
+	for i := 0; i < dump.StackPtr && i < len(dump.Memory); i += 1 {
+		marker := ""
+		if i == dump.BasePtr {
+			marker = "  <- base pointer"
+		}
+		fmt.Printf("%8d: %g%s\n", i, dump.Memory[i], marker)
+	}
+
+	fmt.Println("\nheap:")
+	for i := dump.StackPtr; i < len(dump.Allocated); i += 1 {
+		if !dump.Allocated[i] {
+			continue
+		}
+		// Print a run of consecutive allocated cells on one line
+		start := i
+		cells := []string{}
+		for ; i < len(dump.Allocated) && dump.Allocated[i]; i += 1 {
+			cells = append(cells, fmt.Sprint(dump.Memory[i]))
+		}
+		fmt.Printf("%8d: [%s]\n", start, strings.Join(cells, " "))
+	}
+}
+
+// The operation counts and function timings recorded for `-profile`
+type profile struct {
+	// The number of times each operation was run, including
+	// the pushes and pops that other operations make
+	ops map[string]int
+	// The number of calls to each function by ID, and the time spent in
+	// each function, both including and excluding the functions it calls
+	calls      []int
+	total_time []time.Duration
+	self_time  []time.Duration
+	// For each function being called, by its depth on the call stack,
+	// when it was called and the time spent in the functions it has called
+	starts   []time.Time
+	children []time.Duration
+}
+
+// Count an operation of the machine
+func (p *profile) op(vm *VM, name string) {
+	p.ops[name] += 1
+}
+
+// Start timing a function call. The timings are kept by call depth,
+// so the calls that an error stopped, which never return, are dropped
+// when a host recovers from the error and calls another function.
+func (p *profile) enter(vm *VM, id int) {
+	depth := len(vm.CallStack()) - 1
+	p.starts = append(p.starts[:depth], time.Now())
+	p.children = append(p.children[:depth], 0)
+}
+
+// Stop timing the call to the function with the given ID
+func (p *profile) exit(vm *VM, id int) {
+	if p.calls == nil {
+		p.calls = make([]int, len(FN_NAMES))
+		p.total_time = make([]time.Duration, len(FN_NAMES))
+		p.self_time = make([]time.Duration, len(FN_NAMES))
+	}
+	// The function is no longer on the call stack
+	depth := len(vm.CallStack())
+	elapsed := time.Since(p.starts[depth])
+	p.calls[id] += 1
+	p.total_time[id] += elapsed
+	p.self_time[id] += elapsed - p.children[depth]
+	p.starts = p.starts[:depth]
+	p.children = p.children[:depth]
+	if depth > 0 {
+		p.children[depth-1] += elapsed
+	}
+}
+
+// Print the operation counts, most common first, and the function
+// timings, slowest first by the time spent in the function itself
+func (p *profile) print(vm *VM) {
+	names := []string{}
+	for name := range p.ops {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if p.ops[names[i]] != p.ops[names[j]] {
+			return p.ops[names[i]] > p.ops[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(os.Stderr, "%-24s %12s\n", "operation", "count")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "%-24s %12d\n", name, p.ops[name])
+	}
+
+	ids := []int{}
+	for id := range p.calls {
+		if p.calls[id] > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return p.self_time[ids[i]] > p.self_time[ids[j]] })
+	fmt.Fprintf(os.Stderr, "\n%-24s %12s %14s %14s\n", "function", "calls", "total time", "self time")
+	for _, id := range ids {
+		fmt.Fprintf(os.Stderr, "%-24s %12d %14s %14s\n", FN_NAMES[id], p.calls[id], p.total_time[id], p.self_time[id])
+	}
+}
+
+// The number of cells in each row of the `-visualize` view
+const VISUALIZE_WIDTH = 16
+
+// Draw the memory of the machine. Stack cells are shown as their values,
+// allocated heap cells as their values in brackets, and free cells as dots.
+// Rows of free cells are collapsed, so that large memories stay readable.
+func visualize(vm *VM) {
+	memory, allocated, stack_ptr := vm.Memory(), vm.Allocated(), vm.StackPtr()
+	capacity := len(memory)
+	in_use := 0
+	for i := 0; i < capacity; i += 1 {
+		if allocated[i] {
+			in_use += 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "stack pointer: %d, base pointer: %d, allocated: %d of %d cells\n", stack_ptr, vm.BasePtr(), in_use, capacity)
+
+	skipped := false
+	for row := 0; row < capacity; row += VISUALIZE_WIDTH {
+		line := fmt.Sprintf("%6d |", row)
+		free := true
+		for i := row; i < row+VISUALIZE_WIDTH && i < capacity; i += 1 {
+			if i < stack_ptr {
+				line += fmt.Sprintf(" %5g ", memory[i])
+				free = false
+			} else if allocated[i] {
+				line += fmt.Sprintf("[%5g]", memory[i])
+				free = false
+			} else {
+				line += "     . "
+			}
+		}
+		if free {
+			if !skipped {
+				fmt.Fprintln(os.Stderr, "   ... |")
+			}
+			skipped = true
+			continue
+		}
+		skipped = false
+		fmt.Fprintln(os.Stderr, strings.TrimRight(line, " "))
+	}
+}
+
+const DEBUG_HELP = `commands:
+    s, step          run until the next statement
+    c, continue      run until the next breakpoint
+    b, break LINE    pause before the statements on a line
+    p, print OFFSET  print the local variable cell at an offset from the base pointer
+    x ADDR [N]       print N memory cells, starting at an address
+    stack            print the cells on the current stack frame
+    bt               print the functions being called
+    q, quit          stop the program
+`
+
+// The `-debug` debugger: the lines to pause at, and whether
+// the program is running until it reaches one of them
+type debugger struct {
+	breakpoints map[int]bool
+	running     bool
+}
+
+// Pause before a statement when stepping, or at a breakpoint
+func (d *debugger) statement(vm *VM, line int) {
+	if !d.running || d.breakpoints[line] {
+		d.prompt(vm)
+	}
+}
+
+// Read and run debugger commands until one resumes the program
+func (d *debugger) prompt(vm *VM) {
+	d.running = false
+	where := ""
+	if vm.Line() != 0 {
+		where = fmt.Sprintf(" at line %d", vm.Line())
+	}
+	if depth := len(vm.CallStack()); depth > 0 {
+		id := vm.CallStack()[depth-1]
+		if here := Location(id, vm.Line()); here != "" {
+			where = here
+		}
+		where += fmt.Sprintf(" in `%s`", FN_NAMES[id])
+	}
+	fmt.Fprintf(os.Stderr, "paused%s\n", where)
+
+	for {
+		fmt.Fprint(os.Stderr, "(oak) ")
+		line, err := vm.InputLine()
+		if err != nil && line == "" {
+			// There are no more commands, so let the program finish
+			d.running = true
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			args = []string{"step"}
+		}
+
+		switch args[0] {
+		case "s", "step":
+			return
+		case "c", "continue":
+			d.running = true
+			return
+		case "b", "break":
+			if n, ok := debug_args(args, 1); ok {
+				d.breakpoints[n[0]] = true
+			}
+		case "p", "print":
+			if n, ok := debug_args(args, 1); ok {
+				debug_print_cells(vm, vm.BasePtr()+n[0], 1)
+			}
+		case "x":
+			if n, ok := debug_args(args, 1); ok {
+				size := 1
+				if len(n) > 1 {
+					size = n[1]
+				}
+				debug_print_cells(vm, n[0], size)
+			}
+		case "stack":
+			debug_print_cells(vm, vm.BasePtr(), vm.StackPtr()-vm.BasePtr())
+		case "bt":
+			fmt.Fprint(os.Stderr, vm.StackTrace())
+		case "q", "quit":
+			vm.Exit(0)
+		default:
+			fmt.Fprint(os.Stderr, DEBUG_HELP)
+		}
+	}
+}
+
+// Parse the integer arguments of a debugger command, which must have
+// at least `min` of them
+func debug_args(args []string, min int) ([]int, bool) {
+	result := []int{}
+	for _, arg := range args[1:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "`%s` is not a number\n", arg)
+			return nil, false
+		}
+		result = append(result, n)
+	}
+	if len(result) < min {
+		fmt.Fprintf(os.Stderr, "`%s` needs %d arguments\n", args[0], min)
+		return nil, false
+	}
+	return result, true
+}
+
+// Print `size` memory cells starting at `addr`, one per line
+func debug_print_cells(vm *VM, addr, size int) {
+	memory := vm.Memory()
+	for i := addr; i < addr+size; i += 1 {
+		if i < 0 || i >= len(memory) {
+			fmt.Fprintf(os.Stderr, "%6d: out of bounds\n", i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "%6d: %g\n", i, memory[i])
+	}
+}
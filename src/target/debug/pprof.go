@@ -0,0 +1,19 @@
+// Serve profiles of the running program with net/http/pprof, so that
+// long-running programs can be profiled with `go tool pprof`. This is
+// only included when the program is compiled with `--pprof`, which
+// defines `PPROF_ADDR`.
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+)
+
+func init() {
+	go func() {
+		if err := http.ListenAndServe(PPROF_ADDR, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "could not serve pprof:", err)
+		}
+	}()
+}
@@ -0,0 +1,56 @@
+// Registering foreign functions, extensions and globals with the
+// machine. Foreign files, the standard library, and the output code
+// call these from `init` functions, and hosts can call them before
+// they run the program.
+
+import (
+	"fmt"
+)
+
+// Add the foreign functions that the program calls, which its code does
+// from an `init` function. Ones that are already registered, such as
+// by a foreign file's own `init` function, are kept.
+func AddForeignFns(fns map[string]func(*VM)) {
+	for name, fn := range fns {
+		if FOREIGN_FNS[name] == nil {
+			FOREIGN_FNS[name] = fn
+		}
+	}
+}
+
+// Replace the foreign function `name` with `fn`, or supply it if the
+// program calls it without defining it. The program looks its foreign
+// functions up in `FOREIGN_FNS` each time that it calls them, so this
+// can be called from an `init` function, or by a host before it runs
+// the program.
+func RegisterForeign(name string, fn func(*VM)) {
+	FOREIGN_FNS[name] = fn
+}
+
+// Register a family of builtins. This is meant to be called from an
+// extension's `init` function. A family can only be registered once,
+// so registering it again returns an error and keeps the first one.
+func RegisterExtension(family string, builtins map[string]func(*VM)) error {
+	if _, ok := EXTENSIONS[family]; ok {
+		return fmt.Errorf("extension `%s` is registered more than once", family)
+	}
+	EXTENSIONS[family] = builtins
+	return nil
+}
+
+// Register a foreign global. This is meant to be called from a foreign
+// file's `init` function. The program gets the global's address with
+// `foreign_global`. `get` is called each time the program loads the
+// global, and `set` each time it stores to it, or `set` is nil if the
+// global is read only.
+func RegisterForeignGlobal(name string, get func() float64, set func(float64)) {
+	FOREIGN_GLOBALS = append(FOREIGN_GLOBALS, ForeignGlobal{Name: name, Get: get, Set: set})
+}
+
+// Convert a boolean to the cell representing it
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
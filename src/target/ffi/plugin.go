@@ -0,0 +1,72 @@
+// Loading foreign functions from Go plugins at runtime, so that the
+// foreign functions of a built program can be replaced or supplied
+// without compiling it again. With `-foreign-plugin path.so`, each
+// foreign function `name` that the program calls is looked up in the
+// plugin as the exported function `Foreign_name`.
+//
+// A plugin is built separately from the program, so it can't refer to
+// the program's `VM` type. Instead, its foreign functions take an
+// interface with the methods below. The interface isn't named, so it is
+// the same type in the plugin as in the program, as long as it is
+// written with the same methods:
+//
+//	func Foreign_add(vm interface {
+//		Pop() float64
+//		Push(n float64)
+//		ReadString(addr int) string
+//		WriteString(addr int, s string) int
+//		AllocString(s string) int
+//		CopyIn(cells []float64) int
+//		CopyOut(addr, n int) []float64
+//		CallOak(name string, args ...float64) []float64
+//		ForeignError(err error) bool
+//	}) {
+//		vm.Push(vm.Pop() + vm.Pop())
+//	}
+
+import (
+	"fmt"
+	"plugin"
+	"strings"
+)
+
+// The machine as the foreign functions in plugins see it
+type plugin_machine = interface {
+	Pop() float64
+	Push(n float64)
+	ReadString(addr int) string
+	WriteString(addr int, s string) int
+	AllocString(s string) int
+	CopyIn(cells []float64) int
+	CopyOut(addr, n int) []float64
+	CallOak(name string, args ...float64) []float64
+	ForeignError(err error) bool
+}
+
+func init() {
+	FLAGS.Func("foreign-plugin", "load the foreign functions that the Go plugin at this `path` exports, such as Foreign_prn for prn, in place of the program's own", load_foreign_plugin)
+}
+
+// Register the foreign functions that a plugin exports
+func load_foreign_plugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	for name := range FOREIGN_FNS {
+		// Builtins from extensions are registered by the extensions
+		if strings.Contains(name, "::") {
+			continue
+		}
+		symbol, err := p.Lookup("Foreign_" + name)
+		if err != nil {
+			continue
+		}
+		fn, ok := symbol.(func(plugin_machine))
+		if !ok {
+			return fmt.Errorf("`Foreign_%s` must be a function that takes the machine interface, not %T", name, symbol)
+		}
+		RegisterForeign(name, func(vm *VM) { fn(vm) })
+	}
+	return nil
+}
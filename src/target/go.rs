@@ -1,11 +1,801 @@
 use super::Target;
+use crate::{
+    asm::AsmNativeFn,
+    tir::{TirForeignFn, TirForeignStruct},
+};
 use std::{
-    fs::{remove_file, write},
-    io::{Error, ErrorKind, Result},
-    process::Command,
+    cell::RefCell,
+    collections::{BTreeMap, BTreeSet},
+    env::current_dir,
+    fs::{create_dir_all, remove_file, write},
+    io::{Error, ErrorKind, Result, Write},
+    path::Path,
+    process::{Command, Output, Stdio},
 };
 
-pub struct Go;
+mod wrap;
+
+#[derive(Clone, Debug, Default)]
+pub struct Go {
+    /// Functions from Go packages to generate foreign
+    /// bindings for, such as `strings.ToUpper`
+    pub wrap: Vec<String>,
+    /// The address to serve `net/http/pprof` profiles
+    /// of the compiled program at, if any
+    pub pprof: Option<String>,
+    /// The directory to write the output program to as a Go module,
+    /// with the runtime as a package of its own that the program
+    /// imports, instead of building it from a temporary `main.go`
+    pub module: Option<String>,
+    /// Build the output program with TinyGo, with a runtime that
+    /// leaves out the packages that microcontrollers don't have
+    pub tinygo: bool,
+    /// Build the output program for WebAssembly in the browser, as
+    /// `main.wasm`, with a runtime that does I/O through the page.
+    /// The page runs it with the `wasm_exec.js` that comes with Go.
+    pub wasm: bool,
+    /// Build the output program as a Go plugin, `main.so`, which exports
+    /// `Run(stdin io.Reader, stdout io.Writer) error` to run the program
+    pub plugin: bool,
+    /// Write the output program to its module as a Go package with this
+    /// name, instead of a command, for Go applications to import. Along
+    /// with `Run`, it exports the `Machine` type, which calls the
+    /// program's functions and works with its memory.
+    pub package: Option<String>,
+    /// Write golden-output tests for the program to its module, which
+    /// compare its output for each input in `testdata` with `go test`
+    pub emit_tests: bool,
+    /// The file to write the built program to, instead of the default
+    /// for the kind of build, such as `main` or `main.wasm`
+    pub output: Option<String>,
+    /// Keep the `main.go` that the program is built from
+    pub keep_source: bool,
+    /// Run the output program with `go run` instead of building it,
+    /// with the compiler's own input and output
+    pub run: bool,
+    /// The operating system and architecture to build the output
+    /// program for, such as `windows` and `arm64`, if not the host's
+    pub goos: Option<String>,
+    pub goarch: Option<String>,
+    /// Include the standard library's graphics functions, which draw
+    /// to a window with ebiten. Ebiten is a dependency of the output
+    /// program, so it must be built as a module.
+    pub graphics: bool,
+    /// Include the standard library's SQLite functions, with a pure
+    /// Go driver. Like ebiten, the driver is a dependency of the
+    /// output program, so it must be built as a module.
+    pub sqlite: bool,
+    /// The foreign functions that the program calls, which are
+    /// registered by name in `FOREIGN_FNS` if the output code defines them
+    foreign: RefCell<BTreeSet<String>>,
+}
+
+impl Go {
+    /// The comments that the runtime is between in the output code, so
+    /// that modules can put it in packages of their own under `oakrt`,
+    /// which the program imports. They are removed from programs built
+    /// from `main.go`, which include the runtime in their `main` package.
+    pub(super) const RUNTIME_BEGIN: &'static str = "//oak:begin runtime\n";
+    pub(super) const RUNTIME_END: &'static str = "//oak:end runtime\n";
+
+    /// The directory of the runtime's packages in a module
+    const RUNTIME_DIR: &'static str = "oakrt";
+
+    /// The comment that starts each of the runtime's packages in the
+    /// output code, like `//oak:package core`. The code up to the next
+    /// one belongs to the package.
+    const PACKAGE: &'static str = "//oak:package ";
+
+    /// The runtime's packages, and the ones that each of them imports.
+    /// `core` is the machine, `ffi` registers foreign functions with it,
+    /// `debug` has the tools that watch it through its hooks, and `std`
+    /// is the standard library. Each is dot imported, so that the code
+    /// reads the same as in a single `main` package.
+    const PACKAGES: &'static [(&'static str, &'static [&'static str])] = &[
+        ("core", &[]),
+        ("ffi", &["core"]),
+        ("debug", &["core"]),
+        ("std", &["core"]),
+    ];
+
+    /// The comments that the standard library's foreign functions are
+    /// between in the output code, so that modules can put them in files
+    /// of their own. They are removed from programs built from `main.go`.
+    const STD_BEGIN: &'static str = "//oak:begin std\n";
+    const STD_END: &'static str = "//oak:end std\n";
+
+    /// The comments that the C code of foreign files written for the
+    /// C target is between in the output code. It is moved into the
+    /// cgo preamble, which must come before the rest of the code.
+    const C_BEGIN: &'static str = "//oak:begin c\n";
+    const C_END: &'static str = "//oak:end c\n";
+
+    /// The comment that ends each function in the output code. It is
+    /// replaced with a line directive that attributes the code after the
+    /// function to the Go file again, once the file's lines are known.
+    const LINE_RESET: &'static str = "//oak:reset line\n";
+
+    /// The build tag that leaves the standard library out of a module
+    const NO_STD_TAG: &'static str = "oak_nostd";
+
+    /// The version of ebiten that modules with graphics require
+    const EBITEN: &'static str = "github.com/hajimehoshi/ebiten/v2 v2.6.0";
+    /// The version of the SQLite driver that modules with SQLite require
+    const SQLITE: &'static str = "modernc.org/sqlite v1.29.0";
+    /// The comment that foreign files declare a module that they import
+    /// packages from with, like `//oak:require github.com/google/uuid v1.6.0`
+    const REQUIRE: &'static str = "//oak:require ";
+
+    /// Mark a foreign function as called by the program
+    pub(super) fn use_foreign_fn(&self, name: &str) {
+        self.foreign.borrow_mut().insert(name.to_string());
+    }
+
+    /// The foreign functions that the output code defines,
+    /// which are defined like `func prn(vm *machine) {`, or
+    /// with the runtime's own name for the machine, `*VM`
+    pub(super) fn defined_foreign_fns(code: &str) -> Vec<&str> {
+        code.lines()
+            .filter_map(Self::foreign_fn_declaration)
+            .collect()
+    }
+
+    /// Get the name of the foreign function that a line of Go code
+    /// declares, if it declares one. The spacing and the name of the
+    /// machine parameter don't matter, but methods, and functions
+    /// with any other parameters or with results, aren't foreign.
+    fn foreign_fn_declaration(line: &str) -> Option<&str> {
+        let is_identifier = |s: &str| s.chars().all(|ch| ch.is_ascii_alphanumeric() || ch == '_');
+
+        // Methods and function literals have a parenthesis after `func`
+        let line = line.strip_prefix("func")?;
+        if !line.starts_with(char::is_whitespace) {
+            return None;
+        }
+        let (name, line) = line.split_at(line.find('(')?);
+        let name = name.trim();
+        if name.is_empty()
+            || name.starts_with(|ch: char| ch.is_ascii_digit())
+            || !is_identifier(name)
+        {
+            return None;
+        }
+
+        let (params, body) = line[1..].split_at(line[1..].find(')')?);
+        let params: String = params.chars().filter(|ch| !ch.is_whitespace()).collect();
+        let name_param = params
+            .strip_suffix("*machine")
+            .or_else(|| params.strip_suffix("*VM"))?;
+        if is_identifier(name_param) && body[1..].trim_start().starts_with('{') {
+            Some(name)
+        } else {
+            None
+        }
+    }
+
+    /// Register each foreign function that the program calls by name.
+    /// The ones that the output code doesn't define are registered as
+    /// nil, so that they can be supplied at runtime instead.
+    fn foreign_fns(&self, code: &str) -> String {
+        let defined = Self::defined_foreign_fns(code);
+        let mut result = String::from("\nfunc init() {\nAddForeignFns(map[string]func(*VM){\n");
+        for name in self.foreign.borrow().iter() {
+            if defined.contains(&name.as_str()) {
+                result += &format!("{:?}: {},\n", name, name);
+            } else if !name.contains("::") {
+                result += &format!("{:?}: nil,\n", name);
+            }
+        }
+        result + "})\n}\n"
+    }
+
+    /// Bridge a foreign file written in C for the C target, whose foreign
+    /// functions are defined like `void add(machine *vm) {`. The file
+    /// becomes part of the cgo preamble, and each of its foreign functions
+    /// gets a Go foreign function of the same name that calls it.
+    fn cgo_bridge(contents: &str) -> String {
+        let mut result = String::from(Self::C_BEGIN) + contents;
+        if !result.ends_with('\n') {
+            result += "\n";
+        }
+        result += Self::C_END;
+        for line in contents.lines() {
+            let name = line.strip_prefix("void ").and_then(|line| {
+                let (name, params) = line.split_at(line.find('(')?);
+                let params: String = params.chars().filter(|ch| !ch.is_whitespace()).collect();
+                if params.starts_with("(machine*") && !params.contains(',') {
+                    Some(name.trim())
+                } else {
+                    None
+                }
+            });
+            if let Some(name) = name {
+                result += &format!(
+                    "\nfunc {}(vm *machine) {{\n\tcall_c(vm, func(c *C.machine) {{ C.{}(c) }})\n}}\n",
+                    name, name
+                );
+            }
+        }
+        result
+    }
+
+    /// Go requires every import to come before the rest of the code,
+    /// but foreign code is added to the end of the output code.
+    /// So, gather every import into a single block at the top. The C
+    /// code of foreign files is gathered into the cgo preamble, along
+    /// with the C target's machine and the bridge to it.
+    fn hoist_imports(code: String) -> String {
+        let code = if code.contains(Self::C_BEGIN) {
+            code + include_str!("core/cgo.go")
+        } else {
+            code
+        };
+        let mut imports = BTreeSet::new();
+        let mut c_code = String::new();
+        let mut body = String::new();
+        let mut lines = code.lines();
+        while let Some(line) = lines.next() {
+            let trimmed = line.trim();
+            if line == Self::C_BEGIN.trim_end() {
+                // Collect the C code up to the end of the section
+                for line in &mut lines {
+                    if line == Self::C_END.trim_end() {
+                        break;
+                    }
+                    c_code += line;
+                    c_code += "\n";
+                }
+            } else if trimmed == "import (" {
+                // Collect every import in a parenthesized import block
+                for line in &mut lines {
+                    let trimmed = line.trim();
+                    if trimmed == ")" {
+                        break;
+                    } else if !trimmed.is_empty() {
+                        imports.insert(trimmed.to_string());
+                    }
+                }
+            } else if trimmed.starts_with("import ") {
+                imports.insert(trimmed["import ".len()..].trim().to_string());
+            } else {
+                body += line;
+                body += "\n";
+            }
+        }
+
+        let mut import_block = String::new();
+        if !c_code.is_empty() {
+            // The preamble must come right before `import "C"`
+            import_block += &format!(
+                "/*\n{}\n{}*/\nimport \"C\"\n\n",
+                include_str!("core/core.c"),
+                c_code
+            );
+        }
+        if !imports.is_empty() {
+            import_block += "import (\n";
+            for import in imports {
+                import_block += &format!("\t{}\n", import);
+            }
+            import_block += ")\n";
+        }
+        if import_block.is_empty() {
+            return body;
+        }
+        body.replacen(
+            "package main\n",
+            &format!("package main\n\n{}", import_block),
+            1,
+        )
+    }
+
+    /// Collapse common sequences of machine operations in a function's body
+    /// into single calls, which do the same thing with less call overhead.
+    /// The result of each rule is checked against the rules again, so that
+    /// `vm.Push(2)`, `vm.LoadBasePtr()`, `vm.Add()`, `vm.Load(1)` becomes
+    /// `vm.PushLocalAddr(2)`, `vm.Load(1)`, and then `vm.LoadLocal(2, 1)`.
+    fn peephole(body: &str) -> String {
+        // Get the argument of a line that calls `method`, such as `2` in `vm.Push(2)`
+        fn arg<'a>(line: &'a str, method: &str) -> Option<&'a str> {
+            line.strip_prefix(method)?.strip_suffix(")")
+        }
+
+        let mut lines: Vec<String> = vec![];
+        for line in body.lines() {
+            lines.push(line.trim().to_string());
+            loop {
+                let n = lines.len();
+                let last = |i: usize| if i <= n { lines[n - i].as_str() } else { "" };
+                let replacement = if last(2) == "vm.LoadBasePtr()" && last(1) == "vm.Add()" {
+                    // Only integer offsets from the base pointer are collapsed
+                    match arg(last(3), "vm.Push(").map(str::parse::<i32>) {
+                        Some(Ok(offset)) => Some((3, format!("vm.PushLocalAddr({})", offset))),
+                        _ => None,
+                    }
+                } else if let (Some(offset), Some(size)) =
+                    (arg(last(2), "vm.PushLocalAddr("), arg(last(1), "vm.Load("))
+                {
+                    Some((2, format!("vm.LoadLocal({}, {})", offset, size)))
+                } else if let (Some(offset), Some(size)) =
+                    (arg(last(2), "vm.PushLocalAddr("), arg(last(1), "vm.Store("))
+                {
+                    Some((2, format!("vm.StoreLocal({}, {})", offset, size)))
+                } else if let (Some(n), Some(local)) =
+                    (arg(last(2), "vm.Push("), arg(last(1), "vm.StoreLocal("))
+                {
+                    match local.strip_suffix(", 1") {
+                        Some(offset) => Some((2, format!("vm.SetLocal({}, {})", offset, n))),
+                        None => None,
+                    }
+                } else {
+                    None
+                };
+
+                match replacement {
+                    Some((count, line)) => {
+                        lines.truncate(n - count);
+                        lines.push(line);
+                    }
+                    None => break,
+                }
+            }
+        }
+        lines.join("\n")
+    }
+
+    /// Start each line of a function's body with the line directive of the
+    /// Oak statement that it belongs to. Go counts up from a directive for
+    /// the lines after it, so each line needs a directive of its own to be
+    /// attributed to the statement's line instead of the ones below it.
+    fn attribute_lines(body: &str) -> String {
+        let mut directive = "";
+        let mut lines = vec![];
+        for line in body.lines() {
+            if line.starts_with("/*line ") {
+                if let Some(end) = line.find("*/") {
+                    directive = &line[..end + 2];
+                }
+                lines.push(line.to_string());
+            } else if line.is_empty() {
+                lines.push(String::new());
+            } else {
+                lines.push(format!("{}{}", directive, line));
+            }
+        }
+        lines.join("\n")
+    }
+
+    /// Replace the comment that ends each function with a line directive
+    /// for the line of `file` after it, so that the code between and after
+    /// the functions, such as the function tables and `main`, is attributed
+    /// to `file` instead of the last Oak statement. This is done to the
+    /// output code once it's formatted, when its lines won't move again.
+    fn reset_lines(code: String, file: &str) -> String {
+        let mut result = String::new();
+        for (i, line) in code.lines().enumerate() {
+            if line == Self::LINE_RESET.trim_end() {
+                result += &format!("//line {}:{}\n", file, i + 2);
+            } else {
+                result += line;
+                result += "\n";
+            }
+        }
+        result
+    }
+
+    /// Indent the output code and remove its extra blank lines and
+    /// semicolons with `gofmt`, which comes with Go. If `gofmt` can't be
+    /// run, or the code can't be parsed, the code is left as it is.
+    fn format(code: String) -> String {
+        let child = Command::new("gofmt")
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn();
+        if let Ok(mut child) = child {
+            if let Some(mut stdin) = child.stdin.take() {
+                // Close stdin after writing, so that `gofmt` knows the code has ended
+                let _ = stdin.write_all(code.as_bytes());
+            }
+            if let Ok(output) = child.wait_with_output() {
+                if output.status.success() {
+                    return String::from_utf8_lossy(&output.stdout).into_owned();
+                }
+            }
+        }
+        code
+    }
+
+    /// The command that builds the output program, with `go` or `tinygo`
+    fn build_command(&self) -> Command {
+        let mut command = Command::new(if self.tinygo { "tinygo" } else { "go" });
+        command.arg("build");
+        let mut output = None;
+        if self.wasm {
+            if self.tinygo {
+                command.args(&["-target", "wasm"]);
+            } else {
+                command.env("GOOS", "js").env("GOARCH", "wasm");
+            }
+            output = Some("main.wasm");
+        } else if self.tinygo {
+            output = Some("main");
+        } else if self.plugin {
+            command.arg("-buildmode=plugin");
+            output = Some("main.so");
+        }
+        if let Some(goos) = &self.goos {
+            command.env("GOOS", goos);
+        }
+        if let Some(goarch) = &self.goarch {
+            command.env("GOARCH", goarch);
+        }
+
+        if let Some(file) = &self.output {
+            // Modules are built in their own directory, so the
+            // file is found from where the compiler was run
+            let file = match current_dir() {
+                Ok(dir) => dir.join(file),
+                Err(_) => Path::new(file).to_path_buf(),
+            };
+            command.arg("-o").arg(file);
+        } else if let Some(file) = output {
+            command.args(&["-o", file]);
+        }
+        command
+    }
+
+    /// The command that builds the output program and runs it right
+    /// away, with the compiler's own input and output
+    fn run_command(&self) -> Command {
+        let mut command = Command::new(if self.tinygo { "tinygo" } else { "go" });
+        command
+            .arg("run")
+            .stdin(Stdio::inherit())
+            .stdout(Stdio::inherit())
+            .stderr(Stdio::inherit());
+        command
+    }
+
+    /// Build the program in `dir` from `source`, or run it instead
+    fn build_or_run(&self, dir: &Path, source: &str, what: &str) -> Result<()> {
+        if self.run {
+            // Go already reports why the program failed to build or run
+            match self.run_command().arg(source).current_dir(dir).status() {
+                Ok(status) if status.success() => Ok(()),
+                Ok(_) => Err(Error::new(
+                    ErrorKind::Other,
+                    format!("could not run {}", what),
+                )),
+                Err(_) => Err(Error::new(
+                    ErrorKind::Other,
+                    "could not compile output golang code. is golang installed?",
+                )),
+            }
+        } else {
+            Self::check_build(
+                self.build_command().arg(source).current_dir(dir).output(),
+                what,
+            )
+        }
+    }
+
+    /// Check the result of running the build command, and
+    /// report what went wrong if the program didn't build
+    fn check_build(output: Result<Output>, what: &str) -> Result<()> {
+        match output {
+            Ok(output) if output.status.success() => Ok(()),
+            Ok(output) => Err(Error::new(
+                ErrorKind::Other,
+                format!(
+                    "could not build {}:\n{}",
+                    what,
+                    String::from_utf8_lossy(&output.stderr)
+                ),
+            )),
+            Err(_) => Err(Error::new(
+                ErrorKind::Other,
+                "could not compile output golang code. is golang installed?",
+            )),
+        }
+    }
+
+    /// Separate the code between the comments `begin` and `end`, such
+    /// as the standard library's foreign functions, from the rest of the
+    /// output code, if the output code has them
+    fn split_section(code: &str, begin: &str, end: &str) -> (String, Option<String>) {
+        if let Some(start) = code.find(begin) {
+            if let Some(stop) = code[start..].find(end) {
+                let stop = start + stop;
+                let section = &code[start + begin.len()..stop];
+                let rest = String::from(&code[..start]) + &code[stop + end.len()..];
+                return (rest, Some(String::from(section)));
+            }
+        }
+        (String::from(code), None)
+    }
+
+    /// Replace each of the standard library's foreign functions
+    /// with one that stops the machine with an error, for programs
+    /// built without the standard library
+    fn std_stubs(std: &str) -> String {
+        let mut result = String::new();
+        for line in std.lines() {
+            let name = line
+                .strip_prefix("func ")
+                .and_then(|line| line.strip_suffix("(vm *VM) {"));
+            if let Some(name) = name {
+                result += &format!(
+                    "\nfunc {}(vm *VM) {{\nvm.Fail(NO_SUCH_BUILTIN, \"`{}` is part of the standard library, which was left out with the `{}` build tag\")\n}}\n",
+                    name,
+                    name,
+                    Self::NO_STD_TAG
+                );
+            }
+        }
+        result
+    }
+
+    /// The runtime, which is split into packages, and each package into
+    /// files by concern. Programs built from `main.go` include it in their
+    /// `main` package, and modules import its packages from `oakrt`. So,
+    /// the output code and foreign files only use its exported API, like
+    /// any other package. `interpreter` is any code that the target adds
+    /// to the machine, such as the `go_vm` target's interpreter.
+    pub(super) fn runtime(&self, interpreter: &str) -> String {
+        let package = |name: &str| format!("{}{}\n", Self::PACKAGE, name);
+        let mut result = package("core")
+            + include_str!("core/core.go")
+            + include_str!("core/foreign.go")
+            + include_str!("core/trace.go");
+        if self.wasm {
+            result += include_str!("core/wasm.go");
+        } else if self.tinygo {
+            result += include_str!("core/tinygo.go");
+        } else {
+            result += include_str!("core/io.go");
+        }
+        result += interpreter;
+
+        // Without `plugin` and `net`, there are no plugins,
+        // debug adapter or profile server
+        let hosted = !self.wasm && !self.tinygo;
+        result += &package("ffi");
+        result += include_str!("ffi/ffi.go");
+        if hosted {
+            result += include_str!("ffi/plugin.go");
+        }
+        result += &package("debug");
+        result += include_str!("debug/debug.go");
+        if hosted {
+            result += include_str!("debug/dap.go");
+            if let Some(addr) = &self.pprof {
+                result += &format!("\nconst PPROF_ADDR = {:?}\n", addr);
+                result += include_str!("debug/pprof.go");
+            }
+        }
+        if self.graphics {
+            result += &package("std");
+            result += include_str!("std/window.go");
+        }
+        result
+    }
+
+    /// Split the runtime into its packages, by the comments that start them
+    fn split_packages(runtime: &str) -> BTreeMap<&str, String> {
+        let mut packages = BTreeMap::new();
+        let mut package = "core";
+        for line in runtime.lines() {
+            if let Some(name) = line.strip_prefix(Self::PACKAGE) {
+                package = name;
+            } else {
+                let code: &mut String = packages.entry(package).or_default();
+                *code += line;
+                *code += "\n";
+            }
+        }
+        packages
+    }
+
+    /// Whether the program runs on another goroutine, so that the main
+    /// one is free to show its window. Plugins, packages and tests have
+    /// no `main` of their own, so they never show one.
+    fn runs_with_window(&self) -> bool {
+        self.graphics && !self.plugin && !self.emit_tests && self.package.is_none()
+    }
+
+    /// The modules that the output program depends on, such as
+    /// `modernc.org/sqlite v1.29.0`, including the ones that its foreign
+    /// files require. When a module is required more than once, the
+    /// newest of its versions is used, like Go's own version selection.
+    fn requirements(&self, code: &str) -> Result<Vec<String>> {
+        let mut modules: BTreeMap<String, String> = BTreeMap::new();
+        let mut require = |requirement: &str| -> Result<()> {
+            let (path, version) = match requirement.split_whitespace().collect::<Vec<_>>()[..] {
+                [path, version] if version.starts_with('v') => (path, version),
+                _ => {
+                    return Err(Error::new(
+                        ErrorKind::Other,
+                        format!(
+                            "expected a module path and version in `{}{}`",
+                            Self::REQUIRE,
+                            requirement
+                        ),
+                    ))
+                }
+            };
+            let newer = match modules.get(path) {
+                Some(other) => Self::version_key(version) > Self::version_key(other),
+                None => true,
+            };
+            if newer {
+                modules.insert(path.to_string(), version.to_string());
+            }
+            Ok(())
+        };
+
+        if self.graphics {
+            require(Self::EBITEN)?;
+        }
+        if self.sqlite {
+            require(Self::SQLITE)?;
+        }
+        for line in code.lines() {
+            if let Some(requirement) = line.trim().strip_prefix(Self::REQUIRE) {
+                require(requirement)?;
+            }
+        }
+        Ok(modules
+            .into_iter()
+            .map(|(path, version)| format!("{} {}", path, version))
+            .collect())
+    }
+
+    /// The numbers of a module version such as `v1.29.0`, to compare it
+    /// with other versions. Anything after them, such as `-rc.1`, is left out.
+    fn version_key(version: &str) -> Vec<u64> {
+        version
+            .trim_start_matches('v')
+            .split(|ch| ch == '-' || ch == '+')
+            .next()
+            .unwrap_or("")
+            .split('.')
+            .map(|n| n.parse().unwrap_or(0))
+            .collect()
+    }
+
+    /// Rename the `main` package of an output file
+    fn rename_package(code: String, name: &str) -> String {
+        code.replacen("package main\n", &format!("package {}\n", name), 1)
+    }
+
+    /// Rename the `main` package of an output file, if
+    /// the program is written as a package of its own
+    fn name_package(&self, code: String) -> String {
+        match &self.package {
+            Some(name) => Self::rename_package(code, name),
+            None => code,
+        }
+    }
+
+    /// Write the output program to a directory as a Go module with
+    /// a `go.mod` and a `main.go`, and build it there with `go build`.
+    /// The runtime's packages are written to the module's `oakrt`
+    /// directory, such as `oakrt/core`, which `main.go` imports. The
+    /// standard library's foreign functions are written to the `std`
+    /// package's `builtins.go`, which the `oak_nostd` build tag swaps for
+    /// `nobuiltins.go`, where they stop the machine with an error instead.
+    fn write_module(&self, dir: &Path, code: String) -> Result<()> {
+        // The module is named after its directory
+        let path = dir.canonicalize()?;
+        let name = match path.file_name() {
+            Some(name) => name.to_string_lossy().replace(' ', "_"),
+            None => String::from("main"),
+        };
+
+        let requirements = self.requirements(&code)?;
+        if requirements.is_empty() {
+            write(dir.join("go.mod"), format!("module {}\n\ngo 1.16\n", name))?;
+        } else {
+            // The dependencies need a newer Go than the rest of the runtime
+            let mut go_mod = format!("module {}\n\ngo 1.20\n\n", name);
+            for requirement in &requirements {
+                go_mod += &format!("require {}\n", requirement);
+            }
+            write(dir.join("go.mod"), go_mod)?;
+        }
+
+        // Each file of the runtime dot imports the packages that it uses
+        let runtime_file = |package: &str, header: String, imports: &[&str], code: &str| {
+            let mut header = header + "\npackage main\n\nimport (\n";
+            for import in imports {
+                header += &format!(". \"{}/{}/{}\"\n", name, Self::RUNTIME_DIR, import);
+            }
+            let code = Self::format(Self::hoist_imports(header + ")\n" + code));
+            Self::rename_package(code, package)
+        };
+        let (code, runtime) = Self::split_section(&code, Self::RUNTIME_BEGIN, Self::RUNTIME_END);
+        // The runtime starts with its own package clause
+        let runtime = runtime
+            .unwrap_or_default()
+            .replacen("package main\n", "", 1);
+        let packages = Self::split_packages(&runtime);
+        for (package, imports) in Self::PACKAGES {
+            if let Some(code) = packages.get(package) {
+                let package_dir = dir.join(Self::RUNTIME_DIR).join(package);
+                create_dir_all(&package_dir)?;
+                write(
+                    package_dir.join(format!("{}.go", package)),
+                    runtime_file(package, String::new(), imports, code),
+                )?;
+            }
+        }
+        let (code, std) = Self::split_section(&code, Self::STD_BEGIN, Self::STD_END);
+        if let Some(std) = &std {
+            let std_dir = dir.join(Self::RUNTIME_DIR).join("std");
+            create_dir_all(&std_dir)?;
+            // The program can't see the standard library's unexported
+            // functions, so they register themselves by name instead
+            let file = |constraint: &str, code: &str| {
+                let header = format!("//go:build {}\n// +build {}\n", constraint, constraint);
+                let code = String::from(code) + &self.foreign_fns(code);
+                runtime_file("std", header, &["core", "ffi"], &code)
+            };
+            let no_std = format!("!{}", Self::NO_STD_TAG);
+            write(std_dir.join("builtins.go"), file(&no_std, std))?;
+            write(
+                std_dir.join("nobuiltins.go"),
+                file(Self::NO_STD_TAG, &Self::std_stubs(std)),
+            )?;
+        }
+
+        // The program uses the machine and registers its foreign functions.
+        // The debugging tools and the standard library register themselves,
+        // so they are only imported for their side effects, unless the
+        // program runs with the standard library's window.
+        let mut header = String::from("package main\n\nimport (\n");
+        let mut import = |alias: &str, package: &str| {
+            header += &format!("{} \"{}/{}/{}\"\n", alias, name, Self::RUNTIME_DIR, package);
+        };
+        import(".", "core");
+        import(".", "ffi");
+        import("_", "debug");
+        if self.runs_with_window() {
+            import(".", "std");
+        } else if std.is_some() || packages.contains_key("std") {
+            import("_", "std");
+        }
+        let code = header + ")\n" + &code + &self.foreign_fns(&code);
+        write(
+            dir.join("main.go"),
+            Self::reset_lines(
+                self.name_package(Self::format(Self::hoist_imports(code))),
+                "main.go",
+            ),
+        )?;
+        if self.emit_tests {
+            write(dir.join("main_test.go"), include_str!("core/golden.go"))?;
+            // Start with a test of the program without any input
+            let testdata = dir.join("testdata");
+            if !testdata.exists() {
+                create_dir_all(&testdata)?;
+                write(testdata.join("no_input.in"), "")?;
+            }
+        }
+        if !requirements.is_empty() {
+            // Download the dependencies and their own, and list them in `go.sum`
+            Self::check_build(
+                Command::new("go")
+                    .args(&["mod", "tidy"])
+                    .current_dir(dir)
+                    .output(),
+                &format!("the dependencies of the go module in {}", dir.display()),
+            )?;
+        }
+        self.build_or_run(dir, ".", &format!("the go module in {}", dir.display()))
+    }
+}
+
 impl Target for Go {
     fn get_name(&self) -> char {
         'g'
@@ -15,106 +805,360 @@ impl Target for Go {
         true
     }
 
+    fn generate_bindings(&self) -> Result<(String, String)> {
+        // Wrapped functions are called `package::name` in Oak, and their
+        // packages are imported by name in Go, so two packages whose paths
+        // end in the same name, like `math/rand` and `crypto/rand`, clash
+        let mut packages = BTreeMap::new();
+        for (path, package, _) in self.wrap.iter().filter_map(|name| wrap::split_name(name)) {
+            match packages.insert(package, path) {
+                Some(other) if other != path => {
+                    return Err(Error::new(
+                        ErrorKind::Other,
+                        format!(
+                            "cannot wrap go packages `{}` and `{}`, which are both called `{}`",
+                            other, path, package
+                        ),
+                    ))
+                }
+                _ => {}
+            }
+        }
+
+        let mut oak = String::new();
+        let mut go = String::new();
+        for name in &self.wrap {
+            let (oak_binding, go_binding) = wrap::wrap(name)?;
+            oak += &oak_binding;
+            go += &go_binding;
+        }
+        Ok((oak, go))
+    }
+
+    fn foreign_stubs(
+        &self,
+        filename: &str,
+        foreign_fns: &[TirForeignFn],
+        structs: &[TirForeignStruct],
+    ) -> Option<String> {
+        Some(wrap::stubs(filename, foreign_fns, structs))
+    }
+
     fn std(&self) -> String {
-        String::from(include_str!("std/std.go"))
+        let http = if self.tinygo {
+            include_str!("std/nohttp.go")
+        } else {
+            include_str!("std/http.go")
+        };
+        let graphics = if self.graphics {
+            include_str!("std/graphics.go")
+        } else {
+            include_str!("std/nographics.go")
+        };
+        let sqlite = if self.sqlite {
+            include_str!("std/sqlite.go")
+        } else {
+            include_str!("std/nosqlite.go")
+        };
+        String::from(Self::STD_BEGIN)
+            + include_str!("std/std.go")
+            + include_str!("std/terminal.go")
+            + include_str!("std/json.go")
+            + http
+            + graphics
+            + sqlite
+            + Self::STD_END
     }
 
     fn core_prelude(&self) -> String {
-        String::from(include_str!("core/core.go"))
+        String::from(Self::RUNTIME_BEGIN) + &self.runtime("") + Self::RUNTIME_END
     }
 
     fn core_postlude(&self) -> String {
-        String::new()
+        // Foreign functions are written against `machine`, which
+        // is the runtime's `VM` under the name they have always used
+        let mut result = String::from("\ntype machine = VM\n");
+        if self.package.is_some() {
+            result += include_str!("core/embed.go");
+        }
+        result
+    }
+
+    fn inline_calls(&self) -> bool {
+        true
+    }
+
+    fn finds_fns_by_name(&self) -> bool {
+        true
+    }
+
+    fn exports_fns(&self) -> bool {
+        // A package's `Machine` can call any function by its name
+        self.package.is_some()
+    }
+
+    fn data_segment(&self, data: &[f64]) -> String {
+        // The tables are declared by the runtime, and filled in here
+        let mut result = String::from("\nfunc init() {\nDATA = []float64{");
+        for (i, n) in data.iter().enumerate() {
+            // Keep the table readable by wrapping it every few cells
+            if i % 16 == 0 {
+                result += "\n";
+            }
+            result += &format!("{}, ", n);
+        }
+        result + "\n}\n}\n"
+    }
+
+    fn function_table(&self, names: &[(String, String)]) -> String {
+        let mut result = String::from("\nfunc init() {\nFN_NAMES = []string{\n");
+        for (_, name) in names {
+            result += &format!("{:?},\n", name);
+        }
+        result += "}\n";
+
+        // The functions refer to the table themselves when calling
+        // indirectly, so it can only be filled in from `init`
+        result += "FN_TABLE = []func(*machine){\n";
+        for (name, _) in names {
+            result += &format!("{},\n", name);
+        }
+        result + "}\nIndexFunctions()\n}\n"
+    }
+
+    fn file_table(&self, files: &[String]) -> String {
+        let mut result = String::from("\nfunc init() {\nFN_FILES = []string{\n");
+        for file in files {
+            result += &format!("{:?},\n", file);
+        }
+        result + "}\n}\n"
+    }
+
+    fn set_line(&self, file: &str, line: usize) -> String {
+        // The line directive makes Go attribute the code after it, such as
+        // in panics and profiles, to the line of the Oak source. The rest
+        // of the statement's code gets the same directive in `fn_definition`.
+        format!("/*line {}:{}:1*/vm.SetLine({})\n", file, line, line)
     }
 
     fn begin_entry_point(&self, global_scope_size: i32, memory_size: i32) -> String {
+        if self.plugin || self.emit_tests || self.package.is_some() {
+            // `Run` runs the program with any input and output, for plugin hosts,
+            // packages, and tests. Plugins and packages have no `main`, and
+            // leave the options to the host.
+            let main = if self.plugin {
+                String::new()
+            } else if self.package.is_some() {
+                // New machines for the package's API are the same size
+                format!(
+                    "const GLOBAL_SCOPE_SIZE = {}\nconst CAPACITY = {}\n\n",
+                    global_scope_size,
+                    global_scope_size + memory_size
+                )
+            } else {
+                String::from(
+                    "import \"os\"\n\nfunc main() {\nParseFlags()\nExitOnError(Run(os.Stdin, os.Stdout))\n}\n\n",
+                )
+            };
+            // The imports are gathered at the top of the output code
+            return format!(
+                "import \"io\"\n\n{}func Run(stdin io.Reader, stdout io.Writer) error {{\nreturn RunWithIO(stdin, stdout, {}, {}, func(vm *machine) {{\n",
+                main,
+                global_scope_size,
+                global_scope_size + memory_size,
+            );
+        }
+        let run = if self.runs_with_window() {
+            "RunWithWindow"
+        } else {
+            "RunMachine"
+        };
         format!(
-            "func main() {{\nvm := machine_new({}, {})\n",
+            "func main() {{\nParseFlags()\nerr := {}({}, {}, func(vm *machine) {{\n",
+            run,
             global_scope_size,
             global_scope_size + memory_size,
         )
     }
 
     fn end_entry_point(&self) -> String {
-        String::from("\nvm.drop()\n}")
+        if self.plugin || self.emit_tests || self.package.is_some() {
+            return String::from("\n})\n}");
+        }
+        String::from("\n})\nExitOnError(err)\n}")
     }
 
     fn establish_stack_frame(&self, arg_size: i32, local_scope_size: i32) -> String {
         format!(
-            "vm.establish_stack_frame({}, {})\n",
+            "vm.EstablishStackFrame({}, {})\n",
             arg_size, local_scope_size
         )
     }
 
     fn end_stack_frame(&self, return_size: i32, local_scope_size: i32) -> String {
-        format!(
-            "vm.end_stack_frame({}, {})\n",
-            return_size, local_scope_size
-        )
+        format!("vm.EndStackFrame({}, {})\n", return_size, local_scope_size)
     }
 
     fn load_base_ptr(&self) -> String {
-        String::from("vm.load_base_ptr()\n")
+        String::from("vm.LoadBasePtr()\n")
     }
 
     fn push(&self, n: f64) -> String {
-        format!("vm.push({})\n", n)
+        format!("vm.Push({})\n", n)
     }
 
     fn add(&self) -> String {
-        String::from("vm.add()\n")
+        String::from("vm.Add()\n")
     }
 
     fn subtract(&self) -> String {
-        String::from("vm.subtract()\n")
+        String::from("vm.Subtract()\n")
     }
 
     fn multiply(&self) -> String {
-        String::from("vm.multiply()\n")
+        String::from("vm.Multiply()\n")
     }
 
     fn divide(&self) -> String {
-        String::from("vm.divide()\n")
+        String::from("vm.Divide()\n")
     }
 
     fn sign(&self) -> String {
-        String::from("vm.sign()\n")
+        String::from("vm.Sign()\n")
     }
 
     fn allocate(&self) -> String {
-        String::from("vm.allocate()\n")
+        String::from("vm.Allocate()\n")
     }
 
     fn free(&self) -> String {
-        String::from("vm.free()\n")
+        String::from("vm.Free()\n")
     }
 
     fn store(&self, size: i32) -> String {
-        format!("vm.store({})\n", size)
+        format!("vm.Store({})\n", size)
     }
 
     fn load(&self, size: i32) -> String {
-        format!("vm.load({})\n", size)
+        format!("vm.Load({})\n", size)
+    }
+
+    fn store_data(&self, address: i32, data: &[f64]) -> String {
+        // The literal is copied from the `DATA` table in one operation
+        format!("vm.StoreData({}, {})\n", address, data.len())
+    }
+
+    fn fn_name(&self, id: i32, name: &str) -> String {
+        // Names such as `put_str` are used as they are. Other names, such as
+        // `Point::new`, are made valid in Go, and their ID keeps them unique.
+        // Those always have a `__` where the `::` was, so names with a `__`
+        // of their own get an ID too, and can't clash with them.
+        if !name.contains("__")
+            && name
+                .chars()
+                .all(|ch| ch.is_ascii_alphanumeric() || ch == '_')
+        {
+            format!("oak_{}", name)
+        } else {
+            let sanitized: String = name
+                .chars()
+                .map(|ch| if ch.is_ascii_alphanumeric() { ch } else { '_' })
+                .collect();
+            format!("oak_{}_{}", sanitized, id)
+        }
+    }
+
+    fn fn_comment(&self, signature: &str) -> String {
+        format!("\n\n// {}", signature)
     }
 
     fn fn_header(&self, name: String) -> String {
         String::new()
     }
 
+    fn enter_fn(&self, id: i32) -> String {
+        format!("vm.EnterFn({})\n", id)
+    }
+
+    fn exit_fn(&self, id: i32) -> String {
+        format!("vm.ExitFn({})\n", id)
+    }
+
     fn fn_definition(&self, name: String, body: String) -> String {
-        format!("\n\nfunc {}(vm *machine) {{\n{}\n}}\n", name, body)
+        format!(
+            "\nfunc {}(vm *machine) {{\n{}\n}}\n{}",
+            name,
+            Self::attribute_lines(&Self::peephole(&body)),
+            Self::LINE_RESET
+        )
     }
 
     fn call_fn(&self, name: String) -> String {
         format!("{}(vm);\n", name)
     }
 
-    fn call_foreign_fn(&self, name: String) -> String {
-        format!("{}(vm);\n", name)
+    fn call_indirect(&self) -> Option<String> {
+        Some(String::from("vm.CallIndirect()\n"))
+    }
+
+    fn make_closure(&self, id: i32, size: i32) -> Option<String> {
+        Some(format!("vm.MakeClosure({}, {})\n", id, size))
+    }
+
+    fn free_closure(&self) -> Option<String> {
+        Some(String::from("vm.FreeClosure()\n"))
+    }
+
+    fn begin_tail_calls(&self) -> String {
+        String::from("tail_call_entry := vm.StackPtr()\ntail_calls:\nfor {\n")
+    }
+
+    fn tail_call(&self, name: String, arg_size: i32) -> String {
+        format!(
+            "if vm.ReuseStackFrame(tail_call_entry, {}) {{\ncontinue tail_calls\n}}\n{}(vm);\n",
+            arg_size, name
+        )
+    }
+
+    fn mutual_tail_call(&self, name: String, own_arg_size: i32, arg_size: i32) -> String {
+        // The function's local scope ends where its own arguments began
+        format!(
+            "if vm.LeaveStackFrame(tail_call_entry-{}, {}) {{\nvm.Trampoline({})\nreturn\n}}\n{}(vm);\n",
+            own_arg_size, arg_size, name, name
+        )
+    }
+
+    fn end_tail_calls(&self) -> String {
+        String::from("break tail_calls\n}\n")
+    }
+
+    fn call_foreign_fn(&self, name: String, arg_size: i32, return_size: i32) -> String {
+        // Foreign functions are looked up by name, so that
+        // they can be replaced or supplied at runtime
+        self.use_foreign_fn(&name);
+        format!(
+            "vm.BeginForeignCall()\nvm.CallForeign({:?})\nvm.EndForeignCall({:?}, {}, {})\n",
+            name, name, arg_size, return_size
+        )
+    }
+
+    fn native_adapter(&self, native: &AsmNativeFn) -> Option<String> {
+        wrap::native_adapter(native)
+    }
+
+    fn foreign_file(&self, filename: &str, contents: String) -> Option<String> {
+        if !filename.ends_with(".c") {
+            Some(contents)
+        } else if self.tinygo || self.wasm {
+            // WebAssembly and TinyGo builds can't use cgo
+            None
+        } else {
+            Some(Self::cgo_bridge(&contents))
+        }
     }
 
     fn begin_while(&self) -> String {
-        String::from("for vm.pop() != 0.0 {\n")
+        String::from("for vm.Pop() != 0.0 {\n")
     }
 
     fn end_while(&self) -> String {
@@ -122,16 +1166,156 @@ impl Target for Go {
     }
 
     fn compile(&self, code: String) -> Result<()> {
-        if let Ok(_) = write("main.go", code) {
-            if let Ok(_) = Command::new("go").arg("build").arg("main.go").output() {
-                if let Ok(_) = remove_file("main.go") {
-                    return Result::Ok(());
-                }
-            }
+        if let Some(dir) = &self.module {
+            let dir = Path::new(dir);
+            create_dir_all(dir)?;
+            return self.write_module(dir, code);
         }
-        Result::Err(Error::new(
-            ErrorKind::Other,
-            "could not compile output golang code. is golang installed?",
-        ))
+        // Dependencies can only be downloaded for a module
+        let requirements = self.requirements(&code)?;
+        if !requirements.is_empty() {
+            return Err(Error::new(
+                ErrorKind::Other,
+                format!(
+                    "the program's foreign files require {}, so it must be built as a module with `--module`",
+                    requirements.join(", ")
+                ),
+            ));
+        }
+        let code = code
+            .replace(Self::RUNTIME_BEGIN, "")
+            .replace(Self::RUNTIME_END, "")
+            .replace(Self::STD_BEGIN, "")
+            .replace(Self::STD_END, "")
+            .lines()
+            .filter(|line| !line.starts_with(Self::PACKAGE))
+            .collect::<Vec<_>>()
+            .join("\n");
+        let code = code.clone() + &self.foreign_fns(&code);
+        write(
+            "main.go",
+            Self::reset_lines(Self::format(Self::hoist_imports(code)), "main.go"),
+        )?;
+        let result = self.build_or_run(Path::new("."), "main.go", "main.go");
+        if !self.keep_source {
+            remove_file("main.go")?;
+        }
+        result
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn plain_fn_names_are_kept() {
+        let go = Go::default();
+        assert_eq!(go.fn_name(3, "putstrln"), "oak_putstrln");
+        assert_eq!(go.fn_name(3, "put_str"), "oak_put_str");
+    }
+
+    #[test]
+    fn other_fn_names_are_made_unique() {
+        let go = Go::default();
+        assert_eq!(go.fn_name(4, "Point::new"), "oak_Point__new_4");
+        assert_eq!(go.fn_name(5, "Point__new_4"), "oak_Point__new_4_5");
+    }
+
+    #[test]
+    fn foreign_fns_are_found_with_any_spacing() {
+        let code = "func prn(vm *machine) {\n\
+                    func  add( m  *machine ){\n\
+                    func unnamed(*machine) { vm.Push(1) }\n\
+                    func getchar(vm *VM) {\n";
+        assert_eq!(
+            Go::defined_foreign_fns(code),
+            vec!["prn", "add", "unnamed", "getchar"]
+        );
+    }
+
+    #[test]
+    fn other_functions_are_not_foreign_fns() {
+        let code = "func (vm *machine) push(n float64) {\n\
+                    func helper(vm *machine, n int) {\n\
+                    func result(vm *machine) int {\n\
+                    \tfunc indented(vm *machine) {\n\
+                    x := func(vm *machine) {\n\
+                    func 9lives(vm *machine) {\n";
+        assert!(Go::defined_foreign_fns(code).is_empty());
+    }
+
+    #[test]
+    fn the_runtime_is_split_from_the_program() {
+        let code = "//oak:begin runtime\npackage main\ntype VM struct{}\n//oak:end runtime\n\
+                    type machine = VM\n";
+        assert_eq!(
+            Go::split_section(code, Go::RUNTIME_BEGIN, Go::RUNTIME_END),
+            (
+                String::from("type machine = VM\n"),
+                Some(String::from("package main\ntype VM struct{}\n"))
+            )
+        );
+    }
+
+    #[test]
+    fn the_runtime_is_split_into_packages() {
+        let runtime = "//oak:package core\ntype VM struct{}\n//oak:package debug\nfunc init() {}\n\
+                       //oak:package core\nfunc (vm *VM) Run() {}\n";
+        let packages = Go::split_packages(runtime);
+        assert_eq!(
+            packages["core"],
+            "type VM struct{}\nfunc (vm *VM) Run() {}\n"
+        );
+        assert_eq!(packages["debug"], "func init() {}\n");
+        assert!(!packages.contains_key("std"));
+    }
+
+    #[test]
+    fn local_loads_and_stores_are_collapsed() {
+        let body = "vm.Push(2)\nvm.LoadBasePtr()\nvm.Add()\nvm.Load(1)\n\
+                    vm.Push(3)\nvm.LoadBasePtr()\nvm.Add()\nvm.Store(2)";
+        assert_eq!(
+            Go::peephole(body),
+            "vm.LoadLocal(2, 1)\nvm.StoreLocal(3, 2)"
+        );
+    }
+
+    #[test]
+    fn constants_stored_in_one_cell_are_collapsed() {
+        let body = "vm.Push(5)\nvm.Push(0)\nvm.LoadBasePtr()\nvm.Add()\nvm.Store(1)";
+        assert_eq!(Go::peephole(body), "vm.SetLocal(0, 5)");
+    }
+
+    #[test]
+    fn each_line_gets_the_directive_of_its_statement() {
+        let body = "vm.EnterFn(0)\n/*line a.ok:2:1*/vm.SetLine(2)\nvm.Push(1)\n\
+                    vm.Push(2)\n/*line a.ok:3:1*/vm.SetLine(3)\nvm.Add()";
+        assert_eq!(
+            Go::attribute_lines(body),
+            "vm.EnterFn(0)\n/*line a.ok:2:1*/vm.SetLine(2)\n/*line a.ok:2:1*/vm.Push(1)\n\
+             /*line a.ok:2:1*/vm.Push(2)\n/*line a.ok:3:1*/vm.SetLine(3)\n/*line a.ok:3:1*/vm.Add()"
+        );
+    }
+
+    #[test]
+    fn code_after_functions_is_attributed_to_the_go_file() {
+        let code = String::from(
+            "func f(vm *machine) {\n}\n//oak:reset line\n\nvar FN_NAMES = []string{}\n",
+        );
+        assert_eq!(
+            Go::reset_lines(code, "main.go"),
+            "func f(vm *machine) {\n}\n//line main.go:4\n\nvar FN_NAMES = []string{}\n"
+        );
+    }
+
+    #[test]
+    fn other_sequences_are_left_alone() {
+        let body = "vm.Push(x)\nvm.LoadBasePtr()\nvm.Add()\n\
+                    vm.Push(1)\nvm.Push(2)\nvm.LoadBasePtr()\nvm.Add()\nvm.Store(2)";
+        assert_eq!(
+            Go::peephole(body),
+            "vm.Push(x)\nvm.LoadBasePtr()\nvm.Add()\nvm.Push(1)\nvm.StoreLocal(2, 2)"
+        );
     }
 }
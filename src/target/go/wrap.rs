@@ -0,0 +1,746 @@
+use crate::{
+    asm::{AsmNativeFn, AsmNativeType},
+    tir::{TirForeignFn, TirForeignStruct},
+};
+use std::{
+    collections::BTreeSet,
+    io::{Error, ErrorKind, Result},
+    process::Command,
+};
+
+/// The words that cannot be used as parameter names in Oak
+const OAK_KEYWORDS: &[&str] = &[
+    "fn", "let", "struct", "const", "extern", "as", "if", "else", "for", "in", "while", "return",
+    "free", "alloc", "move", "sizeof", "true", "false", "void", "num", "bool", "char",
+];
+
+/// The words that cannot be used as variable names in Go
+const GO_KEYWORDS: &[&str] = &[
+    "break",
+    "case",
+    "chan",
+    "const",
+    "continue",
+    "default",
+    "defer",
+    "else",
+    "fallthrough",
+    "for",
+    "func",
+    "go",
+    "goto",
+    "if",
+    "import",
+    "interface",
+    "map",
+    "package",
+    "range",
+    "return",
+    "select",
+    "struct",
+    "switch",
+    "type",
+    "var",
+    "vm",
+    "result",
+];
+
+/// A Go type that can be passed between Oak and Go
+#[derive(Clone, Debug, PartialEq)]
+enum WrapType {
+    /// Any of Go's numeric types, stored in a single cell as a `num`
+    Number(String),
+    /// A Go `rune` or `byte`, stored in a single cell as a `char`
+    Character(String),
+    /// A Go `bool`, stored in a single cell as a `bool`
+    Boolean,
+    /// A Go `string`, stored as a zero terminated `&char`
+    Str,
+}
+
+impl WrapType {
+    fn parse(go_type: &str) -> Option<Self> {
+        Some(match go_type {
+            "float64" | "float32" | "int" | "int8" | "int16" | "int32" | "int64" | "uint"
+            | "uint8" | "uint16" | "uint32" | "uint64" | "uintptr" => {
+                Self::Number(go_type.to_string())
+            }
+            "rune" | "byte" => Self::Character(go_type.to_string()),
+            "bool" => Self::Boolean,
+            "string" => Self::Str,
+            _ => return None,
+        })
+    }
+
+    /// The Go type for an Oak type such as `&char`, or `None` if the
+    /// Oak type can't be converted. Pointers other than strings are
+    /// passed as their addresses.
+    fn from_oak(oak_type: &str) -> Option<Self> {
+        Some(match oak_type {
+            "num" => Self::Number(String::from("float64")),
+            "char" => Self::Character(String::from("rune")),
+            "bool" => Self::Boolean,
+            "&char" => Self::Str,
+            t if t.starts_with('&') => Self::Number(String::from("int")),
+            _ => return None,
+        })
+    }
+
+    /// The name of the Go type
+    fn to_go(&self) -> &str {
+        match self {
+            Self::Number(t) | Self::Character(t) => t,
+            Self::Boolean => "bool",
+            Self::Str => "string",
+        }
+    }
+
+    /// The Go type that a native function's parameter or result
+    /// of the given type has, or `None` if it has no value
+    fn from_native(native_type: AsmNativeType) -> Option<Self> {
+        Some(match native_type {
+            AsmNativeType::Number => Self::Number(String::from("float64")),
+            AsmNativeType::Character => Self::Character(String::from("rune")),
+            AsmNativeType::Boolean => Self::Boolean,
+            AsmNativeType::String => Self::Str,
+            AsmNativeType::Void => return None,
+        })
+    }
+
+    /// The name of the corresponding Oak type
+    fn to_oak(&self) -> &'static str {
+        match self {
+            Self::Number(_) => "num",
+            Self::Character(_) => "char",
+            Self::Boolean => "bool",
+            Self::Str => "&char",
+        }
+    }
+
+    /// The Go expression that pops a value of this type off of the stack
+    fn pop(&self) -> String {
+        match self {
+            Self::Number(t) | Self::Character(t) => format!("{}(vm.Pop())", t),
+            Self::Boolean => String::from("vm.Pop() != 0"),
+            Self::Str => String::from("vm.ReadString(int(vm.Pop()))"),
+        }
+    }
+
+    /// The Go statement that pushes the value `name` of this type onto the stack
+    fn push(&self, name: &str) -> String {
+        match self {
+            Self::Number(_) | Self::Character(_) => format!("vm.Push(float64({}))", name),
+            Self::Boolean => format!("vm.Push(Bool({}))", name),
+            Self::Str => format!("vm.Push(float64(vm.AllocString({})))", name),
+        }
+    }
+}
+
+/// Generate the bindings for a Go function such as `strings.ToUpper`.
+/// The function's signature is looked up with `go doc`, and the result
+/// is the Oak `extern fn` declaration and the Go foreign function that
+/// adapts the Oak calling convention to the Go function.
+pub fn wrap(qualified_name: &str) -> Result<(String, String)> {
+    let error = |reason: &str| {
+        Error::new(
+            ErrorKind::Other,
+            format!("cannot wrap go function `{}`: {}", qualified_name, reason),
+        )
+    };
+
+    let (path, package, func) = match split_name(qualified_name) {
+        Some(parts) => parts,
+        None => return Err(error("expected a name like `strings.ToUpper`")),
+    };
+
+    let output = Command::new("go")
+        .args(&["doc", path, func])
+        .output()
+        .map_err(|_| error("could not run `go doc`. is golang installed?"))?;
+    let doc = String::from_utf8_lossy(&output.stdout);
+
+    // Find the function's signature in the documentation
+    let header = format!("func {}(", func);
+    let signature = match doc.lines().find(|line| line.starts_with(&header)) {
+        Some(line) => &line[header.len()..],
+        None => return Err(error("no such function")),
+    };
+    let close = match signature.find(')') {
+        Some(i) => i,
+        None => return Err(error("could not parse its signature")),
+    };
+
+    // Parse the parameters of the function. Only the
+    // last parameter of a Go function can be variadic.
+    let mut params = vec![];
+    let mut variadic = None;
+    for (name, go_type) in parse_params(&signature[..close]) {
+        let (is_variadic, go_type) = match go_type.strip_prefix("...") {
+            Some(go_type) => (true, go_type.to_string()),
+            None => (false, go_type),
+        };
+        match WrapType::parse(&go_type) {
+            Some(t) if is_variadic => variadic = Some((name, t)),
+            Some(t) => params.push((name, t)),
+            None => return Err(error(&format!("unsupported parameter type `{}`", go_type))),
+        }
+    }
+
+    // Parse the results of the function. An error as the last result
+    // is reported to the program with `ForeignError`, instead of being
+    // returned to it.
+    let results = signature[close + 1..]
+        .trim()
+        .trim_start_matches('(')
+        .trim_end_matches(')')
+        .trim();
+    // Named results are written as `(n int, err error)`
+    let mut result_types: Vec<&str> = results
+        .split(',')
+        .map(|result| result.trim().rsplit(' ').next().unwrap_or(""))
+        .filter(|go_type| !go_type.is_empty())
+        .collect();
+    let fails = result_types.last() == Some(&"error");
+    if fails {
+        result_types.pop();
+    }
+    let return_type = match result_types.as_slice() {
+        [] => None,
+        [go_type] => match WrapType::parse(go_type) {
+            Some(t) => Some(t),
+            None => return Err(error(&format!("unsupported return type `{}`", go_type))),
+        },
+        _ => return Err(error("multiple return values are not supported")),
+    };
+
+    let foreign_name = format!(
+        "__oak_go__{}_{}",
+        path.replace('/', "_").replace('.', "_"),
+        func
+    );
+
+    // Generate the Oak declaration, which is called `strings::ToUpper`
+    let mut oak_params = vec![];
+    for (i, (name, t)) in params.iter().enumerate() {
+        let name = match name {
+            Some(name) if !OAK_KEYWORDS.contains(&name.as_str()) => name.clone(),
+            _ => format!("arg{}", i),
+        };
+        oak_params.push(format!("{}: {}", name, t.to_oak()));
+    }
+    if let Some((name, t)) = &variadic {
+        let name = match name {
+            Some(name) if !OAK_KEYWORDS.contains(&name.as_str()) => name.clone(),
+            _ => format!("arg{}", params.len()),
+        };
+        oak_params.push(format!("{}: ...{}", name, t.to_oak()));
+    }
+    // Strings are copied onto the heap for the program, which owns them
+    let mut oak = if return_type == Some(WrapType::Str) {
+        format!(
+            "#[doc(\"Calls the Go function `{}.{}`. The string that it returns is allocated on the heap for the caller, which must free it with `free s: str_len(s) + 1`.\")]\n",
+            path, func
+        )
+    } else {
+        String::new()
+    };
+    oak += &format!(
+        "extern fn {} as {}::{}({})",
+        foreign_name,
+        package,
+        func,
+        oak_params.join(", ")
+    );
+    if let Some(t) = &return_type {
+        oak += &format!(" -> {}", t.to_oak());
+    }
+    oak += ";\n";
+
+    let param_types: Vec<WrapType> = params.into_iter().map(|(_, t)| t).collect();
+    let go = format!(
+        "import {:?}\n\n{}",
+        path,
+        adapter(
+            &foreign_name,
+            &format!("{}.{}", package, func),
+            &param_types,
+            &variadic.map(|(_, t)| t),
+            &return_type,
+            fails
+        )
+    );
+
+    Ok((oak, go))
+}
+
+/// Split a name like `encoding/hex.EncodeToString` into the package's
+/// import path `encoding/hex`, the name `hex` that the package is
+/// referred to by in Go code, and the function's name `EncodeToString`
+pub fn split_name(qualified_name: &str) -> Option<(&str, &str, &str)> {
+    let i = qualified_name.rfind('.')?;
+    let (path, func) = (&qualified_name[..i], &qualified_name[i + 1..]);
+    Some((path, path.rsplit('/').next().unwrap_or(path), func))
+}
+
+/// Generate the Go adapter for a native function bound with
+/// `extern fn native::name`, which is defined in a foreign file
+/// as a plain Go function like `func add(a, b float64) float64`.
+pub fn native_adapter(native: &AsmNativeFn) -> Option<String> {
+    let mut params = vec![];
+    for t in &native.params {
+        // Parameters must have a value
+        params.push(WrapType::from_native(*t)?);
+    }
+    let variadic = match native.variadic {
+        Some(t) => Some(WrapType::from_native(t)?),
+        None => None,
+    };
+    let return_type = WrapType::from_native(native.return_type);
+    Some(adapter(
+        &native.adapter_name(),
+        &native.name,
+        &params,
+        &variadic,
+        &return_type,
+        false,
+    ))
+}
+
+/// Generate the foreign function `foreign_name`, which pops the arguments
+/// for the Go function `go_func` off of the stack, calls it, and pushes
+/// its result. The first argument is on the top of the stack. The
+/// arguments of a variadic parameter follow a cell with their count,
+/// and are collected into a slice. If the Go function `fails`, it also
+/// returns an error, which is reported with `ForeignError`. When the
+/// program's trap handler recovers from it, the result that came with
+/// the error is pushed as usual.
+fn adapter(
+    foreign_name: &str,
+    go_func: &str,
+    params: &[WrapType],
+    variadic: &Option<WrapType>,
+    return_type: &Option<WrapType>,
+    fails: bool,
+) -> String {
+    let mut go = format!("func {}(vm *machine) {{\n", foreign_name);
+    let mut args = vec![];
+    for (i, t) in params.iter().enumerate() {
+        go += &format!("\targ{} := {}\n", i, t.pop());
+        args.push(format!("arg{}", i));
+    }
+    if let Some(t) = variadic {
+        go += &format!(
+            "\trest := make([]{}, int(vm.Pop()))\n\tfor i := range rest {{\n\t\trest[i] = {}\n\t}}\n",
+            t.to_go(),
+            t.pop()
+        );
+        args.push(String::from("rest..."));
+    }
+    let call = format!("{}({})", go_func, args.join(", "));
+    let report = "err != nil {\n\t\tvm.ForeignError(err)\n\t}\n";
+    match (return_type, fails) {
+        (Some(t), false) => go += &format!("\tresult := {}\n\t{}\n", call, t.push("result")),
+        (Some(t), true) => {
+            go += &format!(
+                "\tresult, err := {}\n\tif {}\t{}\n",
+                call,
+                report,
+                t.push("result")
+            )
+        }
+        (None, false) => go += &format!("\t{}\n", call),
+        (None, true) => go += &format!("\tif err := {}; {}", call, report),
+    }
+    go + "}\n"
+}
+
+/// Parse a Go parameter list such as `p, q float64` into a list
+/// of parameter names and types. Go allows parameters to share a
+/// type, and to leave out parameter names altogether.
+fn parse_params(params: &str) -> Vec<(Option<String>, String)> {
+    let items: Vec<&str> = params
+        .split(',')
+        .map(|item| item.trim())
+        .filter(|item| !item.is_empty())
+        .collect();
+
+    // If none of the parameters have names, each item is a type
+    if !items.iter().any(|item| item.contains(' ')) {
+        return items.iter().map(|t| (None, t.to_string())).collect();
+    }
+
+    let mut result = vec![];
+    let mut untyped = vec![];
+    for item in items {
+        match item.find(' ') {
+            Some(i) => {
+                let go_type = item[i + 1..].trim().to_string();
+                // The previous names without types share this type
+                for name in untyped.drain(..) {
+                    result.push((Some(name), go_type.clone()));
+                }
+                result.push((Some(item[..i].to_string()), go_type));
+            }
+            None => untyped.push(item.to_string()),
+        }
+    }
+    result
+}
+
+/// The structures that can be converted to and from Go structs: the
+/// ones whose members are all numbers, characters, booleans, pointers,
+/// or other structures that can be converted. Structures defined in
+/// other files can't be converted, since their members aren't known.
+fn marshaled_structs(structs: &[TirForeignStruct]) -> Vec<&TirForeignStruct> {
+    let mut result: Vec<&TirForeignStruct> = vec![];
+    loop {
+        let count = result.len();
+        for structure in structs {
+            if !result.iter().any(|other| other.name == structure.name)
+                && structure
+                    .members
+                    .iter()
+                    .all(|(_, t)| member_type(t, &result).is_some())
+            {
+                result.push(structure);
+            }
+        }
+        if result.len() == count {
+            return result;
+        }
+    }
+}
+
+/// The Go type of a structure's member. Pointers, including
+/// strings, are kept as their addresses, so that they can be
+/// written back to the structure unchanged.
+fn member_type(oak_type: &str, structs: &[&TirForeignStruct]) -> Option<String> {
+    if oak_type.starts_with('&') {
+        return Some(String::from("int"));
+    }
+    match WrapType::from_oak(oak_type) {
+        Some(wrap_type) => Some(wrap_type.to_go().to_string()),
+        None => find_struct(oak_type, structs).map(|structure| structure.name.clone()),
+    }
+}
+
+/// Find the structure with the given name
+fn find_struct<'a>(name: &str, structs: &[&'a TirForeignStruct]) -> Option<&'a TirForeignStruct> {
+    structs
+        .iter()
+        .find(|structure| structure.name == name)
+        .copied()
+}
+
+/// The number of cells that a value of the given type takes up
+fn cell_size(oak_type: &str, structs: &[&TirForeignStruct]) -> usize {
+    match find_struct(oak_type, structs) {
+        Some(structure) => structure
+            .members
+            .iter()
+            .map(|(_, t)| cell_size(t, structs))
+            .sum(),
+        None => 1,
+    }
+}
+
+/// The name of a structure's member as a field of its Go struct
+fn field_name(member: &str) -> String {
+    if GO_KEYWORDS.contains(&member) {
+        format!("{}_", member)
+    } else {
+        member.to_string()
+    }
+}
+
+/// Generate a Go struct for an Oak structure, and the functions that
+/// pop and push it, and that read and write it in memory. They aren't
+/// methods, because the machine's type belongs to the runtime package
+/// when the program is written as a module.
+fn struct_marshaling(structure: &TirForeignStruct, structs: &[&TirForeignStruct]) -> String {
+    let name = &structure.name;
+    let members: Vec<(String, &str, String)> = structure
+        .members
+        .iter()
+        .map(|(member, t)| {
+            let go_type = member_type(t, structs).unwrap();
+            (field_name(member), t.as_str(), go_type)
+        })
+        .collect();
+    let width = members
+        .iter()
+        .map(|(field, _, _)| field.len())
+        .max()
+        .unwrap_or(0);
+
+    let mut result = format!(
+        "\n// The Oak structure `{}`\ntype {} struct {{\n",
+        name, name
+    );
+    for (field, _, go_type) in &members {
+        result += &format!("\t{:width$} {}\n", field, go_type, width = width);
+    }
+    result += "}\n";
+
+    // The last member is on the top of the stack
+    result += &format!(
+        "\n// Pop a `{}` off of the stack\nfunc pop_{}(vm *machine) {} {{\n\tvar result {}\n",
+        name, name, name, name
+    );
+    for (field, t, go_type) in members.iter().rev() {
+        let value = match find_struct(t, structs) {
+            Some(_) => format!("pop_{}(vm)", go_type),
+            None => cell_to_go(go_type, "vm.Pop()"),
+        };
+        result += &format!("\tresult.{} = {}\n", field, value);
+    }
+    result += "\treturn result\n}\n";
+
+    result += &format!(
+        "\n// Push a `{}` onto the stack\nfunc push_{}(vm *machine, value {}) {{\n",
+        name, name, name
+    );
+    for (field, t, go_type) in &members {
+        let value = format!("value.{}", field);
+        result += &match find_struct(t, structs) {
+            Some(_) => format!("\tpush_{}(vm, {})\n", go_type, value),
+            None => format!("\tvm.Push({})\n", go_to_cell(go_type, &value)),
+        };
+    }
+    result += "}\n";
+
+    let size = cell_size(name, structs);
+    result += &format!(
+        "\n// Read the `{}` at the given address\nfunc load_{}(vm *machine, addr int) {} {{\n\tvm.CheckBounds(addr, {})\n\tvar result {}\n",
+        name, name, name, size, name
+    );
+    let mut offset = 0;
+    for (field, t, go_type) in &members {
+        let value = match find_struct(t, structs) {
+            Some(_) => format!("load_{}(vm, {})", go_type, address(offset)),
+            None => cell_to_go(go_type, &format!("vm.Memory()[{}]", address(offset))),
+        };
+        result += &format!("\tresult.{} = {}\n", field, value);
+        offset += cell_size(t, structs);
+    }
+    result += "\treturn result\n}\n";
+
+    result += &format!(
+        "\n// Write a `{}` to the given address\nfunc store_{}(vm *machine, addr int, value {}) {{\n\tvm.CheckBounds(addr, {})\n",
+        name, name, name, size
+    );
+    let mut offset = 0;
+    for (field, t, go_type) in &members {
+        let value = format!("value.{}", field);
+        result += &match find_struct(t, structs) {
+            Some(_) => format!("\tstore_{}(vm, {}, {})\n", go_type, address(offset), value),
+            None => format!(
+                "\tvm.Memory()[{}] = {}\n",
+                address(offset),
+                go_to_cell(go_type, &value)
+            ),
+        };
+        offset += cell_size(t, structs);
+    }
+    result + "}\n"
+}
+
+/// The address of the member `offset` cells into a structure at `addr`
+fn address(offset: usize) -> String {
+    match offset {
+        0 => String::from("addr"),
+        n => format!("addr+{}", n),
+    }
+}
+
+/// Convert a cell to a value of a Go type such as `int` or `bool`
+fn cell_to_go(go_type: &str, cell: &str) -> String {
+    match go_type {
+        "bool" => format!("{} != 0", cell),
+        "float64" => cell.to_string(),
+        t => format!("{}({})", t, cell),
+    }
+}
+
+/// Convert a value of a Go type such as `int` or `bool` to a cell
+fn go_to_cell(go_type: &str, value: &str) -> String {
+    match go_type {
+        "bool" => format!("Bool({})", value),
+        "float64" => value.to_string(),
+        _ => format!("float64({})", value),
+    }
+}
+
+/// Generate a Go file with a stub for each of the foreign functions that
+/// the file `filename` binds. Each stub pops its arguments into Go
+/// values and pushes a zero result, for the user to fill in. The
+/// structures that the foreign functions take or return by value, or
+/// point to, are converted to and from Go structs of the same name.
+pub fn stubs(filename: &str, foreign_fns: &[TirForeignFn], structs: &[TirForeignStruct]) -> String {
+    let mut result = format!(
+        "// The foreign functions that `{}` binds. Fill them in, and\n// include this file with `#[extern(...)]`. Report errors to the\n// program with `vm.ForeignError(err)`.\n",
+        filename
+    );
+
+    // Find the structures that the foreign functions use,
+    // along with the structures that those are made of
+    let marshaled = marshaled_structs(structs);
+    let mut used = BTreeSet::new();
+    let mut pending: Vec<&str> = vec![];
+    for foreign_fn in foreign_fns {
+        for t in foreign_fn
+            .params
+            .iter()
+            .chain(&foreign_fn.variadic)
+            .map(|(_, t)| t)
+            .chain(std::iter::once(&foreign_fn.return_type))
+        {
+            pending.push(t.strip_prefix('&').unwrap_or(t));
+        }
+    }
+    while let Some(name) = pending.pop() {
+        if let Some(structure) = find_struct(name, &marshaled) {
+            if used.insert(name) {
+                pending.extend(structure.members.iter().map(|(_, t)| t.as_str()));
+            }
+        }
+    }
+    for structure in &marshaled {
+        if used.contains(structure.name.as_str()) {
+            result += &struct_marshaling(structure, &marshaled);
+        }
+    }
+
+    for foreign_fn in foreign_fns {
+        let mut params: Vec<String> = foreign_fn
+            .params
+            .iter()
+            .map(|(name, t)| format!("{}: {}", name, t))
+            .collect();
+        if let Some((name, t)) = &foreign_fn.variadic {
+            params.push(format!("{}: ...{}", name, t));
+        }
+        result += &format!(
+            "\n// extern fn {} as {}({}) -> {}\nfunc {}(vm *machine) {{\n",
+            foreign_fn.foreign_name,
+            foreign_fn.name,
+            params.join(", "),
+            foreign_fn.return_type,
+            foreign_fn.foreign_name
+        );
+
+        // The first argument is on the top of the stack
+        let mut args = vec![];
+        for (i, (name, t)) in foreign_fn.params.iter().enumerate() {
+            let go_name = if GO_KEYWORDS.contains(&name.as_str()) {
+                format!("arg{}", i)
+            } else {
+                name.clone()
+            };
+            if let Some(structure) = find_struct(t, &marshaled) {
+                result += &format!("\t{} := pop_{}(vm)\n", go_name, structure.name);
+                args.push(go_name);
+            } else if let Some(wrap_type) = WrapType::from_oak(t) {
+                result += &format!("\t{} := {}\n", go_name, wrap_type.pop());
+                // Pointers to structures can be read and written as Go structs
+                if let Some(structure) =
+                    t.strip_prefix('&').and_then(|t| find_struct(t, &marshaled))
+                {
+                    result += &format!(
+                        "\t// `{}` points to a `{}`, which `load_{}` reads and `store_{}` writes\n",
+                        go_name, structure.name, structure.name, structure.name
+                    );
+                }
+                args.push(go_name);
+            } else {
+                result += &format!(
+                    "\t// `{}` is a `{}`, so pop each of its cells, last member first\n",
+                    name, t
+                )
+            }
+        }
+        // The variadic arguments follow a cell with their count
+        if let Some((name, t)) = &foreign_fn.variadic {
+            let go_name = if GO_KEYWORDS.contains(&name.as_str()) {
+                format!("arg{}", foreign_fn.params.len())
+            } else {
+                name.clone()
+            };
+            let element = match find_struct(t, &marshaled) {
+                Some(structure) => Some((
+                    structure.name.clone(),
+                    format!("pop_{}(vm)", structure.name),
+                )),
+                None => WrapType::from_oak(t)
+                    .map(|wrap_type| (wrap_type.to_go().to_string(), wrap_type.pop())),
+            };
+            match element {
+                Some((go_type, pop)) => {
+                    result += &format!(
+                        "\t{} := make([]{}, int(vm.Pop()))\n\tfor i := range {} {{\n\t\t{}[i] = {}\n\t}}\n",
+                        go_name, go_type, go_name, go_name, pop
+                    );
+                    args.push(go_name);
+                }
+                None => {
+                    result += &format!(
+                        "\t// `{}` is a count, followed by that many `{}`s, so pop the count, and then each of their cells\n",
+                        name, t
+                    )
+                }
+            }
+        }
+        result += &format!("\n\t// TODO: implement `{}`\n", foreign_fn.name);
+        // Go doesn't allow unused variables
+        if !args.is_empty() {
+            result += &format!(
+                "\t{} = {}\n",
+                vec!["_"; args.len()].join(", "),
+                args.join(", ")
+            );
+        }
+
+        match foreign_fn.return_type.as_str() {
+            "void" => {}
+            t => {
+                if let Some(structure) = find_struct(t, &marshaled) {
+                    result += &format!(
+                        "\tvar result {}\n\tpush_{}(vm, result)\n",
+                        structure.name, structure.name
+                    )
+                } else if let Some(wrap_type) = WrapType::from_oak(t) {
+                    result += &format!(
+                        "\tvar result {}\n\t{}\n",
+                        wrap_type.to_go(),
+                        wrap_type.push("result")
+                    )
+                } else {
+                    result += &format!(
+                        "\t// The result is a `{}`, so push each of its cells, first member first\n",
+                        t
+                    )
+                }
+            }
+        }
+        result += "}\n";
+    }
+    result
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn names_are_split_into_path_package_and_function() {
+        assert_eq!(
+            split_name("encoding/hex.EncodeToString"),
+            Some(("encoding/hex", "hex", "EncodeToString"))
+        );
+        assert_eq!(
+            split_name("strings.ToUpper"),
+            Some(("strings", "strings", "ToUpper"))
+        );
+        assert_eq!(split_name("ToUpper"), None);
+    }
+}
@@ -0,0 +1,502 @@
+use super::{Go, Target};
+use crate::{
+    asm::AsmNativeFn,
+    tir::{TirForeignFn, TirForeignStruct},
+};
+use std::{
+    cell::{Cell, RefCell},
+    collections::BTreeMap,
+    io::Result,
+};
+
+/// A variant of the Go target that compiles the program to bytecode for
+/// an interpreter in the runtime, instead of a Go function for each Oak
+/// function. The output program is slower, but it is much smaller, and
+/// `go build` compiles it much faster.
+///
+/// Each instruction is emitted as a line of Go cells, such as `OP_PUSH, 3,`.
+/// The instructions are collected into a single `CODE` table as each
+/// function is defined, and the table is emitted with the function table.
+///
+/// With `embed`, the tables are instead serialized as a JSON program
+/// image, which the output program loads when it starts. Because the
+/// interpreter doesn't depend on the image, the output program can also
+/// run the images of other programs.
+#[derive(Clone, Debug, Default)]
+pub struct GoVm {
+    /// The options of the Go target, which supplies
+    /// the runtime and builds the output program
+    pub go: Go,
+    /// Embed the program as an image for the interpreter,
+    /// instead of as Go tables
+    pub embed: bool,
+    /// The bytecode of the functions defined so far
+    code: RefCell<String>,
+    /// The number of cells in `code`
+    size: Cell<usize>,
+    /// The offset of each function's bytecode in `code`, by function ID
+    offsets: RefCell<BTreeMap<String, usize>>,
+    /// The foreign functions that the bytecode calls, by their index
+    foreign: RefCell<Vec<String>>,
+    /// The signature of the function being defined, for a comment in `code`
+    signature: RefCell<String>,
+    /// The tables saved for the program image, when embedding
+    data: RefCell<Vec<f64>>,
+    names: RefCell<Vec<(String, String)>>,
+    files: RefCell<Vec<String>>,
+}
+
+impl GoVm {
+    /// The instructions in the order of their opcodes in `core/interp.go`
+    const OPCODES: &'static [&'static str] = &[
+        "OP_RETURN",
+        "OP_PUSH",
+        "OP_ADD",
+        "OP_SUBTRACT",
+        "OP_MULTIPLY",
+        "OP_DIVIDE",
+        "OP_SIGN",
+        "OP_ALLOCATE",
+        "OP_FREE",
+        "OP_STORE",
+        "OP_LOAD",
+        "OP_LOAD_BASE_PTR",
+        "OP_ESTABLISH_STACK_FRAME",
+        "OP_END_STACK_FRAME",
+        "OP_ENTER_FN",
+        "OP_EXIT_FN",
+        "OP_SET_LINE",
+        "OP_CALL",
+        "OP_CALL_INDIRECT",
+        "OP_CALL_FOREIGN",
+        "OP_MAKE_CLOSURE",
+        "OP_FREE_CLOSURE",
+        "OP_BEGIN_TAIL_CALLS",
+        "OP_TAIL_CALL",
+        "OP_MUTUAL_TAIL_CALL",
+        "OP_WHILE",
+        "OP_END_WHILE",
+        "OP_STORE_DATA",
+    ];
+
+    /// Compile to bytecode with the given options of the Go target
+    pub fn new(go: Go) -> Self {
+        Self {
+            go,
+            ..Self::default()
+        }
+    }
+
+    /// Emit an instruction with its operands
+    fn op(name: &str, operands: &[f64]) -> String {
+        let mut result = format!("OP_{},", name);
+        for operand in operands {
+            result += &format!(" {},", operand);
+        }
+        result + "\n"
+    }
+
+    /// Replace the operands of the function's `OP_WHILE` and `OP_END_WHILE`
+    /// instructions with the offsets they jump to, given the offset that
+    /// the function's bytecode starts at.
+    fn resolve_jumps(lines: &mut Vec<String>, start: usize) {
+        let mut offset = start;
+        let mut loops = vec![];
+        for i in 0..lines.len() {
+            if lines[i].starts_with("OP_WHILE,") {
+                loops.push((i, offset));
+            } else if lines[i].starts_with("OP_END_WHILE,") {
+                if let Some((begin, begin_offset)) = loops.pop() {
+                    // `OP_WHILE` jumps past `OP_END_WHILE`, which jumps back to `OP_WHILE`
+                    lines[begin] = Self::op("WHILE", &[(offset + 2) as f64]);
+                    lines[i] = Self::op("END_WHILE", &[begin_offset as f64]);
+                }
+            }
+            offset += Self::cells(&lines[i]);
+        }
+    }
+
+    /// Serialize the program as a JSON image for `RunImage`
+    fn image(&self, global_scope_size: i32, capacity: i32) -> String {
+        fn numbers(cells: impl Iterator<Item = String>) -> String {
+            format!("[{}]", cells.collect::<Vec<_>>().join(","))
+        }
+        fn strings<'a>(strings: impl Iterator<Item = &'a String>) -> String {
+            numbers(strings.map(|s| GoVm::json_string(s)))
+        }
+
+        // Replace the names of the opcodes in the bytecode with their values
+        let code = self.code.borrow();
+        let cells = code
+            .lines()
+            .filter(|line| !line.starts_with("//"))
+            .flat_map(|line| line.split(','))
+            .map(str::trim)
+            .filter(|cell| !cell.is_empty())
+            .map(
+                |cell| match Self::OPCODES.iter().position(|op| *op == cell) {
+                    Some(opcode) => opcode.to_string(),
+                    None => cell.to_string(),
+                },
+            );
+
+        let names = self.names.borrow();
+        let offsets = self.offsets.borrow();
+        let entry = names.iter().position(|(_, name)| name == "main");
+        format!(
+            "{{\"global_scope_size\":{},\"capacity\":{},\"entry\":{},\"code\":{},\"data\":{},\"fn_names\":{},\"fn_files\":{},\"fn_offsets\":{},\"foreign_names\":{}}}",
+            global_scope_size,
+            capacity,
+            entry.unwrap_or(0),
+            numbers(cells),
+            numbers(self.data.borrow().iter().map(f64::to_string)),
+            strings(names.iter().map(|(_, name)| name)),
+            strings(self.files.borrow().iter()),
+            numbers(names.iter().map(|(name, _)| offsets[name].to_string())),
+            strings(self.foreign.borrow().iter()),
+        )
+    }
+
+    /// Quote a string for JSON
+    fn json_string(s: &str) -> String {
+        let mut result = String::from("\"");
+        for ch in s.chars() {
+            match ch {
+                '"' => result += "\\\"",
+                '\\' => result += "\\\\",
+                ch if (ch as u32) < 0x20 => result += &format!("\\u{:04x}", ch as u32),
+                ch => result.push(ch),
+            }
+        }
+        result + "\""
+    }
+
+    /// The number of cells in a line of bytecode
+    fn cells(line: &str) -> usize {
+        line.split(',')
+            .filter(|cell| !cell.trim().is_empty())
+            .count()
+    }
+}
+
+impl Target for GoVm {
+    fn get_name(&self) -> char {
+        'g'
+    }
+
+    fn is_standard(&self) -> bool {
+        true
+    }
+
+    fn generate_bindings(&self) -> Result<(String, String)> {
+        self.go.generate_bindings()
+    }
+
+    fn foreign_stubs(
+        &self,
+        filename: &str,
+        foreign_fns: &[TirForeignFn],
+        structs: &[TirForeignStruct],
+    ) -> Option<String> {
+        self.go.foreign_stubs(filename, foreign_fns, structs)
+    }
+
+    fn std(&self) -> String {
+        self.go.std()
+    }
+
+    fn core_prelude(&self) -> String {
+        // The interpreter is part of the machine, in the `core` package
+        let mut interpreter = String::from(include_str!("core/interp.go"));
+        if self.embed {
+            interpreter += include_str!("core/image.go");
+        }
+        String::from(Go::RUNTIME_BEGIN) + &self.go.runtime(&interpreter) + Go::RUNTIME_END
+    }
+
+    fn core_postlude(&self) -> String {
+        self.go.core_postlude()
+    }
+
+    fn inline_calls(&self) -> bool {
+        self.go.inline_calls()
+    }
+
+    fn finds_fns_by_name(&self) -> bool {
+        self.go.finds_fns_by_name()
+    }
+
+    fn exports_fns(&self) -> bool {
+        self.go.exports_fns()
+    }
+
+    fn data_segment(&self, data: &[f64]) -> String {
+        if self.embed {
+            self.data.replace(data.to_vec());
+            return String::new();
+        }
+        self.go.data_segment(data)
+    }
+
+    fn function_table(&self, names: &[(String, String)]) -> String {
+        if self.embed {
+            self.names.replace(names.to_vec());
+            return String::new();
+        }
+
+        // The tables are declared by the runtime, and filled in here
+        let mut result = String::from("\nfunc init() {\nFN_NAMES = []string{\n");
+        for (_, name) in names {
+            result += &format!("{:?},\n", name);
+        }
+        result += "}\n";
+
+        result += "FOREIGN_NAMES = []string{\n";
+        for name in self.foreign.borrow().iter() {
+            result += &format!("{:?},\n", name);
+        }
+        result += "}\n";
+
+        result += "CODE = []float64{\n";
+        result += &self.code.borrow();
+        result += "}\n";
+
+        // Tail calls to other functions jump straight to their offsets
+        let offsets = self.offsets.borrow();
+        result += "FN_OFFSETS = []int{\n";
+        for (name, _) in names {
+            result += &format!("{},\n", offsets[name]);
+        }
+        result += "}\n";
+
+        result += "FN_TABLE = []func(*machine){\n";
+        for (name, _) in names {
+            result += &format!("InterpretedFn({}),\n", offsets[name]);
+        }
+        result + "}\nIndexFunctions()\n}\n"
+    }
+
+    fn file_table(&self, files: &[String]) -> String {
+        if self.embed {
+            self.files.replace(files.to_vec());
+            return String::new();
+        }
+        self.go.file_table(files)
+    }
+
+    fn set_line(&self, file: &str, line: usize) -> String {
+        Self::op("SET_LINE", &[line as f64])
+    }
+
+    fn begin_entry_point(&self, global_scope_size: i32, memory_size: i32) -> String {
+        if self.embed {
+            // A raw string can't contain a backquote, so it is concatenated
+            let image = self.image(global_scope_size, global_scope_size + memory_size);
+            return format!(
+                "\nconst PROGRAM = `{}`\n\nfunc main() {{\nParseFlags()\nRunImage(PROGRAM)\n}}\n",
+                image.replace('`', "` + \"`\" + `")
+            );
+        }
+        // The entry point calls `main` from its own bytecode
+        self.go.begin_entry_point(global_scope_size, memory_size) + "vm.Interpret([]float64{\n"
+    }
+
+    fn end_entry_point(&self) -> String {
+        if self.embed {
+            return String::new();
+        }
+        String::from("OP_RETURN,\n}, 0)") + &self.go.end_entry_point()
+    }
+
+    fn establish_stack_frame(&self, arg_size: i32, local_scope_size: i32) -> String {
+        Self::op(
+            "ESTABLISH_STACK_FRAME",
+            &[arg_size as f64, local_scope_size as f64],
+        )
+    }
+
+    fn end_stack_frame(&self, return_size: i32, local_scope_size: i32) -> String {
+        Self::op(
+            "END_STACK_FRAME",
+            &[return_size as f64, local_scope_size as f64],
+        )
+    }
+
+    fn load_base_ptr(&self) -> String {
+        Self::op("LOAD_BASE_PTR", &[])
+    }
+
+    fn push(&self, n: f64) -> String {
+        Self::op("PUSH", &[n])
+    }
+
+    fn add(&self) -> String {
+        Self::op("ADD", &[])
+    }
+
+    fn subtract(&self) -> String {
+        Self::op("SUBTRACT", &[])
+    }
+
+    fn multiply(&self) -> String {
+        Self::op("MULTIPLY", &[])
+    }
+
+    fn divide(&self) -> String {
+        Self::op("DIVIDE", &[])
+    }
+
+    fn sign(&self) -> String {
+        Self::op("SIGN", &[])
+    }
+
+    fn allocate(&self) -> String {
+        Self::op("ALLOCATE", &[])
+    }
+
+    fn free(&self) -> String {
+        Self::op("FREE", &[])
+    }
+
+    fn store(&self, size: i32) -> String {
+        Self::op("STORE", &[size as f64])
+    }
+
+    fn load(&self, size: i32) -> String {
+        Self::op("LOAD", &[size as f64])
+    }
+
+    fn store_data(&self, address: i32, data: &[f64]) -> String {
+        Self::op("STORE_DATA", &[address as f64, data.len() as f64])
+    }
+
+    fn fn_name(&self, id: i32, name: &str) -> String {
+        // The bytecode refers to functions by their ID
+        id.to_string()
+    }
+
+    fn fn_comment(&self, signature: &str) -> String {
+        self.signature.replace(signature.to_string());
+        String::new()
+    }
+
+    fn fn_header(&self, name: String) -> String {
+        String::new()
+    }
+
+    fn enter_fn(&self, id: i32) -> String {
+        Self::op("ENTER_FN", &[id as f64])
+    }
+
+    fn exit_fn(&self, id: i32) -> String {
+        Self::op("EXIT_FN", &[id as f64])
+    }
+
+    fn fn_definition(&self, name: String, body: String) -> String {
+        // Add the function's bytecode to the table, instead of the output code
+        let start = self.size.get();
+        let mut lines: Vec<String> = body.lines().map(String::from).collect();
+        lines.push(Self::op("RETURN", &[]));
+        Self::resolve_jumps(&mut lines, start);
+
+        let mut code = self.code.borrow_mut();
+        let signature = self.signature.replace(String::new());
+        if !signature.is_empty() {
+            *code += &format!("// {}\n", signature);
+        }
+        for line in &lines {
+            *code += line.trim_end();
+            *code += "\n";
+            self.size.set(self.size.get() + Self::cells(line));
+        }
+        self.offsets.borrow_mut().insert(name, start);
+        String::new()
+    }
+
+    fn call_fn(&self, name: String) -> String {
+        format!("OP_CALL, {},\n", name)
+    }
+
+    fn call_entry_point(&self, name: String) -> String {
+        // The program image records the entry point itself
+        if self.embed {
+            return String::new();
+        }
+        self.call_fn(name)
+    }
+
+    fn call_indirect(&self) -> Option<String> {
+        Some(Self::op("CALL_INDIRECT", &[]))
+    }
+
+    fn make_closure(&self, id: i32, size: i32) -> Option<String> {
+        Some(Self::op("MAKE_CLOSURE", &[id as f64, size as f64]))
+    }
+
+    fn free_closure(&self) -> Option<String> {
+        Some(Self::op("FREE_CLOSURE", &[]))
+    }
+
+    fn begin_tail_calls(&self) -> String {
+        Self::op("BEGIN_TAIL_CALLS", &[])
+    }
+
+    fn tail_call(&self, name: String, arg_size: i32) -> String {
+        format!("OP_TAIL_CALL, {}, {},\n", arg_size, name)
+    }
+
+    fn mutual_tail_call(&self, name: String, own_arg_size: i32, arg_size: i32) -> String {
+        format!(
+            "OP_MUTUAL_TAIL_CALL, {}, {}, {},\n",
+            own_arg_size, arg_size, name
+        )
+    }
+
+    fn end_tail_calls(&self) -> String {
+        String::new()
+    }
+
+    fn call_foreign_fn(&self, name: String, arg_size: i32, return_size: i32) -> String {
+        self.go.use_foreign_fn(&name);
+        let mut foreign = self.foreign.borrow_mut();
+        let index = match foreign.iter().position(|other| *other == name) {
+            Some(index) => index,
+            None => {
+                foreign.push(name);
+                foreign.len() - 1
+            }
+        };
+        Self::op(
+            "CALL_FOREIGN",
+            &[index as f64, arg_size as f64, return_size as f64],
+        )
+    }
+
+    fn native_adapter(&self, native: &AsmNativeFn) -> Option<String> {
+        self.go.native_adapter(native)
+    }
+
+    fn foreign_file(&self, filename: &str, contents: String) -> Option<String> {
+        self.go.foreign_file(filename, contents)
+    }
+
+    fn begin_while(&self) -> String {
+        // The jump is resolved when the function is defined
+        Self::op("WHILE", &[0.0])
+    }
+
+    fn end_while(&self) -> String {
+        Self::op("END_WHILE", &[0.0])
+    }
+
+    fn compile(&self, code: String) -> Result<()> {
+        if self.embed {
+            // Program images may call any foreign function that the
+            // interpreter is built with, so they are all registered
+            for name in Go::defined_foreign_fns(&code) {
+                self.go.use_foreign_fn(name);
+            }
+        }
+        self.go.compile(code)
+    }
+}
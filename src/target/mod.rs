@@ -1,7 +1,14 @@
+use crate::{
+    asm::AsmNativeFn,
+    tir::{TirForeignFn, TirForeignStruct},
+};
+
 mod c;
 pub use c::C;
 mod go;
 pub use go::Go;
+mod go_vm;
+pub use go_vm::GoVm;
 mod ts;
 pub use ts::TS;
 
@@ -10,9 +17,70 @@ pub trait Target {
     fn is_standard(&self) -> bool;
 
     fn std(&self) -> String;
+    /// Generate Oak declarations and the foreign code that implements
+    /// them, for targets that can bind to their host language's libraries.
+    fn generate_bindings(&self) -> std::io::Result<(String, String)> {
+        Ok((String::new(), String::new()))
+    }
+    /// Generate a file of stubs for the foreign functions that the
+    /// `extern fn` declarations in the file `filename` bind, which
+    /// convert their arguments and results, for the user to fill in.
+    /// `structs` are the structures that the file defines, which the
+    /// stubs can convert to and from the target's own types.
+    /// Targets that can't generate stubs return `None`.
+    fn foreign_stubs(
+        &self,
+        filename: &str,
+        foreign_fns: &[TirForeignFn],
+        structs: &[TirForeignStruct],
+    ) -> Option<String> {
+        None
+    }
     fn core_prelude(&self) -> String;
     fn core_postlude(&self) -> String;
 
+    /// Replace calls to functions that only pass their arguments on to
+    /// another function with calls to that function, which saves setting
+    /// up a stack frame for each call. The inlined functions no longer
+    /// show up in stack traces, so this is off by default.
+    fn inline_calls(&self) -> bool {
+        false
+    }
+
+    /// Whether the runtime can look up a function by a name that the
+    /// program gives it as a string, such as the trap handler that is
+    /// set with `set_trap("on_error")`. If so, a function whose name is
+    /// used as a string literal is kept in the output code, even if the
+    /// program never calls it.
+    fn finds_fns_by_name(&self) -> bool {
+        false
+    }
+
+    /// Whether the output code exports all of the program's functions,
+    /// such as for other Go code to call, so none can be left out.
+    fn exports_fns(&self) -> bool {
+        false
+    }
+
+    /// Emit the program's data segment: the initial contents of the
+    /// global scope, such as the characters of string literals.
+    /// Targets that have no use for a data table emit nothing.
+    fn data_segment(&self, data: &[f64]) -> String {
+        String::new()
+    }
+
+    /// Emit a table of every function's output code name and its
+    /// original name in the source, indexed by function ID.
+    fn function_table(&self, names: &[(String, String)]) -> String {
+        String::new()
+    }
+
+    /// Emit a table of the file that each function is defined in, indexed
+    /// by function ID. A file is empty if it is not known.
+    fn file_table(&self, files: &[String]) -> String {
+        String::new()
+    }
+
     fn begin_entry_point(&self, global_scope_size: i32, memory_size: i32) -> String;
     fn end_entry_point(&self) -> String;
 
@@ -33,10 +101,107 @@ pub trait Target {
     fn store(&self, size: i32) -> String;
     fn load(&self, size: i32) -> String;
 
+    /// Store the cells of the data segment starting at `address` into
+    /// memory at the same address. By default, this pushes each cell
+    /// individually and stores them all at once. Targets that keep the
+    /// data segment in a table copy the cells from it instead.
+    fn store_data(&self, address: i32, data: &[f64]) -> String {
+        let mut result = String::new();
+        for n in data {
+            result += &self.push(*n);
+        }
+        result + &self.push(address as f64) + &self.store(data.len() as i32)
+    }
+
+    /// Record the file and line of the statement being run, for error messages
+    fn set_line(&self, file: &str, line: usize) -> String {
+        String::new()
+    }
+
+    /// The output code's name of the function with the given ID and name.
+    /// By default, only the ID is used, to prevent invalid output code function
+    /// names, or names that clash with standard library names such as "printf".
+    fn fn_name(&self, id: i32, name: &str) -> String {
+        format!("fn{}", id)
+    }
+    /// Describe a function's signature in the source code
+    /// before its definition, for targets that keep comments
+    fn fn_comment(&self, signature: &str) -> String {
+        String::new()
+    }
     fn fn_header(&self, name: String) -> String;
+    /// Mark the beginning of the function with the given ID
+    /// for targets that keep track of the functions being called.
+    fn enter_fn(&self, id: i32) -> String {
+        String::new()
+    }
+    /// Mark the end of the function with the given ID.
+    fn exit_fn(&self, id: i32) -> String {
+        String::new()
+    }
     fn fn_definition(&self, name: String, body: String) -> String;
     fn call_fn(&self, name: String) -> String;
-    fn call_foreign_fn(&self, name: String) -> String;
+    /// Call the entry point from the code between `begin_entry_point`
+    /// and `end_entry_point`. By default, this is a normal call.
+    fn call_entry_point(&self, name: String) -> String {
+        self.call_fn(name)
+    }
+    /// Pop a function's ID off of the stack, and call the function.
+    /// This is `None` for targets that can only call functions directly.
+    fn call_indirect(&self) -> Option<String> {
+        None
+    }
+    /// Pop `size` captured cells off of the stack into an environment
+    /// on the heap, and push the environment's address and the function's
+    /// ID. This is `None` for targets that cannot call functions indirectly.
+    fn make_closure(&self, id: i32, size: i32) -> Option<String> {
+        None
+    }
+    /// Pop a closure off of the stack, and free its environment.
+    fn free_closure(&self) -> Option<String> {
+        None
+    }
+    /// Begin the body of a function that contains a tail call.
+    fn begin_tail_calls(&self) -> String {
+        String::new()
+    }
+    /// Call the current function as the last thing it does, with
+    /// `arg_size` cells of arguments on top of the stack. Targets
+    /// that support it can reuse the current stack frame, and jump
+    /// back to the beginning of the function's body.
+    fn tail_call(&self, name: String, arg_size: i32) -> String {
+        self.call_fn(name)
+    }
+    /// Call another function, which returns as many cells as the current
+    /// one, as the last thing the current function does. Its arguments
+    /// take `arg_size` cells on top of the stack, and the current
+    /// function's take `own_arg_size`. Targets that support it can
+    /// replace the current stack frame with the callee's, so that
+    /// functions calling each other in tail position never overflow.
+    fn mutual_tail_call(&self, name: String, own_arg_size: i32, arg_size: i32) -> String {
+        self.call_fn(name)
+    }
+    /// End the body of a function that contains a tail call.
+    fn end_tail_calls(&self) -> String {
+        String::new()
+    }
+    /// Call a foreign function, which takes `arg_size` cells off
+    /// of the stack and pushes `return_size` cells in their place.
+    fn call_foreign_fn(&self, name: String, arg_size: i32, return_size: i32) -> String;
+    /// Define the foreign function that calls a native function bound
+    /// with `extern fn native::name`, converting its arguments and result
+    /// between cells and the target's types. Targets that can't call
+    /// native functions return `None`.
+    fn native_adapter(&self, native: &AsmNativeFn) -> Option<String> {
+        None
+    }
+    /// The code to include for the foreign file `filename`. Targets that
+    /// can bridge to foreign files written for another target, such as
+    /// the Go target with C files, convert them here. Targets that can't
+    /// use the file return `None`.
+    fn foreign_file(&self, filename: &str, contents: String) -> Option<String> {
+        Some(contents)
+    }
 
     fn begin_while(&self) -> String;
     fn end_while(&self) -> String;
@@ -0,0 +1,136 @@
+// The standard library's graphics functions, which draw to the window
+// in `window.go`. Programs compiled without `--graphics` use
+// `nographics.go` instead, so that they don't depend on ebiten.
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// The keys that `key_down` can check, by their numbers in Oak. Letters
+// and digits are their characters, and either case of a letter is the
+// same key. The arrow keys come after the characters.
+var KEY_CODES = map[int]ebiten.Key{
+	'\b': ebiten.KeyBackspace,
+	'\t': ebiten.KeyTab,
+	'\n': ebiten.KeyEnter,
+	27:   ebiten.KeyEscape,
+	' ':  ebiten.KeySpace,
+	256:  ebiten.KeyArrowLeft,
+	257:  ebiten.KeyArrowRight,
+	258:  ebiten.KeyArrowUp,
+	259:  ebiten.KeyArrowDown,
+}
+
+func init() {
+	letters := [...]ebiten.Key{
+		ebiten.KeyA, ebiten.KeyB, ebiten.KeyC, ebiten.KeyD, ebiten.KeyE,
+		ebiten.KeyF, ebiten.KeyG, ebiten.KeyH, ebiten.KeyI, ebiten.KeyJ,
+		ebiten.KeyK, ebiten.KeyL, ebiten.KeyM, ebiten.KeyN, ebiten.KeyO,
+		ebiten.KeyP, ebiten.KeyQ, ebiten.KeyR, ebiten.KeyS, ebiten.KeyT,
+		ebiten.KeyU, ebiten.KeyV, ebiten.KeyW, ebiten.KeyX, ebiten.KeyY,
+		ebiten.KeyZ,
+	}
+	for i, key := range letters {
+		KEY_CODES['a'+i] = key
+		KEY_CODES['A'+i] = key
+	}
+	digits := [...]ebiten.Key{
+		ebiten.KeyDigit0, ebiten.KeyDigit1, ebiten.KeyDigit2, ebiten.KeyDigit3,
+		ebiten.KeyDigit4, ebiten.KeyDigit5, ebiten.KeyDigit6, ebiten.KeyDigit7,
+		ebiten.KeyDigit8, ebiten.KeyDigit9,
+	}
+	for i, key := range digits {
+		KEY_CODES['0'+i] = key
+	}
+}
+
+// Get the color of a number like 0xRRGGBB
+func rgb(n float64) color.RGBA {
+	c := int(n)
+	return color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 255}
+}
+
+func __oak_std__open_window(vm *VM) {
+	width := int(vm.Pop())
+	height := int(vm.Pop())
+	title := vm.ReadString(int(vm.Pop()))
+	// There is only one window, and the size of a canvas can't be negative
+	if WINDOW != nil || width < 0 || height < 0 {
+		vm.Push(0)
+		return
+	}
+	WINDOW = window_new(title, width, height)
+	OPEN_WINDOW <- WINDOW
+	vm.Push(1)
+}
+
+func __oak_std__set_pixel(vm *VM) {
+	x := int(vm.Pop())
+	y := int(vm.Pop())
+	c := rgb(vm.Pop())
+	// Pixels outside of the window are ignored
+	get_window(vm).canvas.SetRGBA(x, y, c)
+}
+
+func __oak_std__draw_rect(vm *VM) {
+	x := int(vm.Pop())
+	y := int(vm.Pop())
+	width := int(vm.Pop())
+	height := int(vm.Pop())
+	c := rgb(vm.Pop())
+	canvas := get_window(vm).canvas
+	draw.Draw(canvas, image.Rect(x, y, x+width, y+height), &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func __oak_std__present(vm *VM) {
+	w := get_window(vm)
+	w.present()
+	if w.is_closed() {
+		vm.Exit(0)
+	}
+}
+
+func __oak_std__key_down(vm *VM) {
+	code := int(vm.Pop())
+	w := get_window(vm)
+	key, ok := KEY_CODES[code]
+	down := false
+	w.mutex.Lock()
+	for _, pressed := range w.keys {
+		if ok && pressed == key {
+			down = true
+		}
+	}
+	w.mutex.Unlock()
+	vm.Push(Bool(down))
+}
+
+func __oak_std__mouse_x(vm *VM) {
+	w := get_window(vm)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	vm.Push(float64(w.mouse_x))
+}
+
+func __oak_std__mouse_y(vm *VM) {
+	w := get_window(vm)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	vm.Push(float64(w.mouse_y))
+}
+
+func __oak_std__mouse_down(vm *VM) {
+	button := int(vm.Pop())
+	w := get_window(vm)
+	down := false
+	w.mutex.Lock()
+	if button >= 0 && button < len(w.buttons) {
+		down = w.buttons[button]
+	}
+	w.mutex.Unlock()
+	vm.Push(Bool(down))
+}
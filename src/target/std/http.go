@@ -0,0 +1,126 @@
+// The standard library's HTTP functions. TinyGo doesn't have
+// `net/http`, so its programs use `nohttp.go` instead.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Write the body of a response to the `size` cells at `addr` as a zero
+// terminated string, and get its status code, or -1 if the request failed.
+// The rest of a body that doesn't fit in the buffer is dropped.
+func http_response(vm *VM, response *http.Response, err error, addr, size int) float64 {
+	if err != nil {
+		return -1
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return -1
+	}
+	// Responses are a source of tainted data
+	vm.WriteBuffer(addr, size, string(data), true)
+	return float64(response.StatusCode)
+}
+
+func __oak_std__http_get(vm *VM) {
+	// Requesting a user controlled URL is a sensitive operation
+	url := vm.ReadSinkString("http_get", int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.CheckBounds(addr, size)
+
+	response, err := http.Get(url)
+	vm.Push(http_response(vm, response, err, addr, size))
+}
+
+func __oak_std__http_post(vm *VM) {
+	url := vm.ReadSinkString("http_post", int(vm.Pop()))
+	content_type := vm.ReadString(int(vm.Pop()))
+	body := vm.ReadString(int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.CheckBounds(addr, size)
+
+	response, err := http.Post(url, content_type, strings.NewReader(body))
+	vm.Push(http_response(vm, response, err, addr, size))
+}
+
+// Serve HTTP at an address, such as `localhost:8080`, by calling the Oak
+// function with the given name for each request. The machine can only
+// be used by one goroutine, so the server's goroutines hand the requests
+// to this one, which handles them one at a time. This only returns if
+// the server can't listen at the address.
+func __oak_std__http_serve(vm *VM) {
+	addr := vm.ReadString(int(vm.Pop()))
+	name := vm.ReadString(int(vm.Pop()))
+	handler, ok := FunctionNamed(name)
+	if !ok {
+		vm.Fail(INVALID_FUNCTION, fmt.Sprintf("no function named `%s` to handle HTTP requests", name))
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+
+	requests := make(chan *http_exchange)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exchange := &http_exchange{
+			method: r.Method,
+			path:   r.URL.RequestURI(),
+			body:   string(body),
+			status: http.StatusOK,
+			done:   make(chan struct{}),
+		}
+		requests <- exchange
+		<-exchange.done
+		w.WriteHeader(exchange.status)
+		io.WriteString(w, exchange.response)
+	}))
+	s := state(vm)
+	for exchange := range requests {
+		s.http_request = exchange
+		handler(vm)
+		s.http_request = nil
+		close(exchange.done)
+	}
+}
+
+// Copy part of the request being handled into a buffer, and push its
+// length. Outside of a handler, there is no request, so this is empty.
+func http_request_part(vm *VM, part func(*http_exchange) string) {
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	s := ""
+	if request := state(vm).http_request; request != nil {
+		s = part(request)
+	}
+	// Requests are a source of tainted data
+	vm.Push(float64(vm.WriteBuffer(addr, size, s, true)))
+}
+
+func __oak_std__http_method(vm *VM) {
+	http_request_part(vm, func(r *http_exchange) string { return r.method })
+}
+
+func __oak_std__http_path(vm *VM) {
+	http_request_part(vm, func(r *http_exchange) string { return r.path })
+}
+
+func __oak_std__http_body(vm *VM) {
+	http_request_part(vm, func(r *http_exchange) string { return r.body })
+}
+
+func __oak_std__http_respond(vm *VM) {
+	status := int(vm.Pop())
+	body := vm.ReadString(int(vm.Pop()))
+	if request := state(vm).http_request; request != nil {
+		request.status = status
+		request.response = body
+	}
+}
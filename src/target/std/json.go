@@ -0,0 +1,158 @@
+// The standard library's JSON functions. A JSON value is parsed into a
+// tree of nodes on the heap. Each node is three cells: a tag for the kind
+// of value, followed by two cells whose meaning depends on the tag.
+//
+//	null    JSON_NULL,   0,           0
+//	bool    JSON_BOOL,   0 or 1,      0
+//	number  JSON_NUM,    the number,  0
+//	string  JSON_STR,    a &char,     0
+//	array   JSON_ARRAY,  its length,  the address of its items' nodes
+//	object  JSON_OBJECT, its size,    the address of its keys and values,
+//	                                  alternating between a &char and a node
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	JSON_NULL = iota
+	JSON_BOOL
+	JSON_NUM
+	JSON_STR
+	JSON_ARRAY
+	JSON_OBJECT
+)
+
+const JSON_NODE_SIZE = 3
+
+// Parse the next JSON value from the decoder into a node on the
+// heap, and return the node's address. The decoder's input must be
+// valid, so that nothing is left allocated if this can't finish.
+func json_decode(vm *VM, decoder *json.Decoder) int {
+	token, _ := decoder.Token()
+	node := []float64{JSON_NULL, 0, 0}
+	switch value := token.(type) {
+	case bool:
+		node = []float64{JSON_BOOL, Bool(value), 0}
+	case float64:
+		node = []float64{JSON_NUM, value, 0}
+	case string:
+		node = []float64{JSON_STR, float64(vm.AllocString(value)), 0}
+	case json.Delim:
+		// Objects and arrays are read in order, unlike with a map
+		items := []float64{}
+		size := 0
+		for decoder.More() {
+			if value == '{' {
+				key, _ := decoder.Token()
+				items = append(items, float64(vm.AllocString(key.(string))))
+			}
+			items = append(items, float64(json_decode(vm, decoder)))
+			size += 1
+		}
+		// Skip the closing bracket
+		decoder.Token()
+
+		tag := JSON_ARRAY
+		if value == '{' {
+			tag = JSON_OBJECT
+		}
+		addr := 0
+		if len(items) > 0 {
+			addr = vm.CopyIn(items)
+		}
+		node = []float64{float64(tag), float64(size), float64(addr)}
+	}
+	return vm.CopyIn(node)
+}
+
+// Write the JSON for the node at `addr`
+func json_encode(vm *VM, addr int, out *strings.Builder) {
+	vm.CheckBounds(addr, JSON_NODE_SIZE)
+	tag, value, items := int(vm.Memory()[addr]), vm.Memory()[addr+1], int(vm.Memory()[addr+2])
+	switch tag {
+	case JSON_BOOL:
+		out.WriteString(strconv.FormatBool(value != 0))
+	case JSON_NUM:
+		// JSON has no infinity or NaN
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			out.WriteString("null")
+		} else {
+			out.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	case JSON_STR:
+		s, _ := json.Marshal(vm.ReadString(int(value)))
+		out.Write(s)
+	case JSON_ARRAY, JSON_OBJECT:
+		open, close, step := "[", "]", 1
+		if tag == JSON_OBJECT {
+			open, close, step = "{", "}", 2
+		}
+		out.WriteString(open)
+		for i := 0; i < int(value); i += 1 {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			item := items + i*step
+			if tag == JSON_OBJECT {
+				key, _ := json.Marshal(vm.ReadString(int(vm.Memory()[item])))
+				out.Write(key)
+				out.WriteString(":")
+				item += 1
+			}
+			json_encode(vm, int(vm.Memory()[item]), out)
+		}
+		out.WriteString(close)
+	default:
+		out.WriteString("null")
+	}
+}
+
+// Free the node at `addr`, and everything it refers to
+func json_free(vm *VM, addr int) {
+	vm.CheckBounds(addr, JSON_NODE_SIZE)
+	tag, value, items := int(vm.Memory()[addr]), vm.Memory()[addr+1], int(vm.Memory()[addr+2])
+	switch tag {
+	case JSON_STR:
+		free_string(vm, int(value))
+	case JSON_ARRAY:
+		for i := 0; i < int(value); i += 1 {
+			json_free(vm, int(vm.Memory()[items+i]))
+		}
+		vm.FreeCells(items, int(value))
+	case JSON_OBJECT:
+		for i := 0; i < int(value); i += 1 {
+			free_string(vm, int(vm.Memory()[items+2*i]))
+			json_free(vm, int(vm.Memory()[items+2*i+1]))
+		}
+		vm.FreeCells(items, 2*int(value))
+	}
+	vm.FreeCells(addr, JSON_NODE_SIZE)
+}
+
+// Free a zero terminated string on the heap
+func free_string(vm *VM, addr int) {
+	vm.FreeCells(addr, len([]rune(vm.ReadString(addr)))+1)
+}
+
+func __oak_std__json_parse(vm *VM) {
+	data := vm.ReadString(int(vm.Pop()))
+	if !json.Valid([]byte(data)) {
+		vm.Push(0)
+		return
+	}
+	vm.Push(float64(json_decode(vm, json.NewDecoder(strings.NewReader(data)))))
+}
+
+func __oak_std__json_stringify(vm *VM) {
+	var out strings.Builder
+	json_encode(vm, int(vm.Pop()), &out)
+	vm.Push(float64(vm.AllocString(out.String())))
+}
+
+func __oak_std__json_free(vm *VM) {
+	json_free(vm, int(vm.Pop()))
+}
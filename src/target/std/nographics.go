@@ -0,0 +1,41 @@
+// Programs compiled without `--graphics` use these instead of
+// `graphics.go`, so that they don't depend on ebiten. There is
+// no window to draw to, so each of them stops the machine.
+
+import "fmt"
+
+func no_graphics(vm *VM, name string) {
+	vm.Fail(NO_SUCH_BUILTIN, fmt.Sprintf("`%s` needs the program to be compiled with `--graphics`", name))
+}
+
+func __oak_std__open_window(vm *VM) {
+	no_graphics(vm, "open_window")
+}
+
+func __oak_std__set_pixel(vm *VM) {
+	no_graphics(vm, "set_pixel")
+}
+
+func __oak_std__draw_rect(vm *VM) {
+	no_graphics(vm, "draw_rect")
+}
+
+func __oak_std__present(vm *VM) {
+	no_graphics(vm, "present")
+}
+
+func __oak_std__key_down(vm *VM) {
+	no_graphics(vm, "key_down")
+}
+
+func __oak_std__mouse_x(vm *VM) {
+	no_graphics(vm, "mouse_x")
+}
+
+func __oak_std__mouse_y(vm *VM) {
+	no_graphics(vm, "mouse_y")
+}
+
+func __oak_std__mouse_down(vm *VM) {
+	no_graphics(vm, "mouse_down")
+}
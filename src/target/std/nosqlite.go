@@ -0,0 +1,45 @@
+// Programs compiled without `--sqlite` use these instead of
+// `sqlite.go`, so that they don't depend on the driver. There
+// are no databases to use, so each of them stops the machine.
+
+import "fmt"
+
+func no_sqlite(vm *VM, name string) {
+	vm.Fail(NO_SUCH_BUILTIN, fmt.Sprintf("`%s` needs the program to be compiled with `--sqlite`", name))
+}
+
+func __oak_std__sqlite_open(vm *VM) {
+	no_sqlite(vm, "sqlite_open")
+}
+
+func __oak_std__sqlite_close(vm *VM) {
+	no_sqlite(vm, "sqlite_close")
+}
+
+func __oak_std__sqlite_exec(vm *VM) {
+	no_sqlite(vm, "sqlite_exec")
+}
+
+func __oak_std__sqlite_query(vm *VM) {
+	no_sqlite(vm, "sqlite_query")
+}
+
+func __oak_std__sqlite_step(vm *VM) {
+	no_sqlite(vm, "sqlite_step")
+}
+
+func __oak_std__sqlite_column_count(vm *VM) {
+	no_sqlite(vm, "sqlite_column_count")
+}
+
+func __oak_std__sqlite_column_num(vm *VM) {
+	no_sqlite(vm, "sqlite_column_num")
+}
+
+func __oak_std__sqlite_column_text(vm *VM) {
+	no_sqlite(vm, "sqlite_column_text")
+}
+
+func __oak_std__sqlite_finalize(vm *VM) {
+	no_sqlite(vm, "sqlite_finalize")
+}
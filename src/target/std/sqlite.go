@@ -0,0 +1,211 @@
+// The standard library's SQLite functions, with the pure Go driver
+// from `modernc.org/sqlite`. Programs compiled without `--sqlite` use
+// `nosqlite.go` instead, so that they don't depend on the driver.
+// Databases and queries are referred to by handles, like files.
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// A query's rows, and the values of the row that it is on
+type sqlite_rows struct {
+	rows   *sql.Rows
+	values []interface{}
+}
+
+// The open databases and queries, indexed by their handles. The
+// handle of a closed one is nil until it is reused. They are shared by
+// every machine in the program, so they are guarded by a mutex.
+var SQLITE_MUTEX sync.Mutex
+var SQLITE_DATABASES []*sql.DB
+var SQLITE_QUERIES []*sqlite_rows
+
+func sqlite_database(vm *VM, handle int) *sql.DB {
+	SQLITE_MUTEX.Lock()
+	defer SQLITE_MUTEX.Unlock()
+	if handle < 0 || handle >= len(SQLITE_DATABASES) || SQLITE_DATABASES[handle] == nil {
+		vm.Fail(INVALID_HANDLE, fmt.Sprintf("invalid database handle %d", handle))
+	}
+	return SQLITE_DATABASES[handle]
+}
+
+func sqlite_query(vm *VM, handle int) *sqlite_rows {
+	SQLITE_MUTEX.Lock()
+	defer SQLITE_MUTEX.Unlock()
+	if handle < 0 || handle >= len(SQLITE_QUERIES) || SQLITE_QUERIES[handle] == nil {
+		vm.Fail(INVALID_HANDLE, fmt.Sprintf("invalid query handle %d", handle))
+	}
+	return SQLITE_QUERIES[handle]
+}
+
+// Get the value of a column of the row that a query is on,
+// or nil if the query isn't on a row or has no such column
+func sqlite_column(vm *VM) interface{} {
+	query := sqlite_query(vm, int(vm.Pop()))
+	column := int(vm.Pop())
+	if column < 0 || column >= len(query.values) {
+		return nil
+	}
+	return query.values[column]
+}
+
+// Running user controlled SQL is a sensitive operation
+func sqlite_sql(vm *VM, sink string) string {
+	addr := int(vm.Pop())
+	vm.TaintSink(sink, vm.IsTaintedString(addr))
+	return vm.ReadString(addr)
+}
+
+func __oak_std__sqlite_open(vm *VM) {
+	path := vm.ReadString(int(vm.Pop()))
+	db, err := sql.Open("sqlite", path)
+	if err == nil {
+		// Opening a database is lazy, so make sure that it works
+		err = db.Ping()
+	}
+	if err != nil {
+		vm.Push(-1)
+		return
+	}
+
+	SQLITE_MUTEX.Lock()
+	defer SQLITE_MUTEX.Unlock()
+	for handle, open := range SQLITE_DATABASES {
+		if open == nil {
+			SQLITE_DATABASES[handle] = db
+			vm.Push(float64(handle))
+			return
+		}
+	}
+	SQLITE_DATABASES = append(SQLITE_DATABASES, db)
+	vm.Push(float64(len(SQLITE_DATABASES) - 1))
+}
+
+func __oak_std__sqlite_close(vm *VM) {
+	handle := int(vm.Pop())
+	err := sqlite_database(vm, handle).Close()
+	SQLITE_MUTEX.Lock()
+	SQLITE_DATABASES[handle] = nil
+	SQLITE_MUTEX.Unlock()
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__sqlite_exec(vm *VM) {
+	db := sqlite_database(vm, int(vm.Pop()))
+	statement := sqlite_sql(vm, "sqlite_exec")
+	_, err := db.Exec(statement)
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__sqlite_query(vm *VM) {
+	db := sqlite_database(vm, int(vm.Pop()))
+	statement := sqlite_sql(vm, "sqlite_query")
+	rows, err := db.Query(statement)
+	if err != nil {
+		vm.Push(-1)
+		return
+	}
+	query := &sqlite_rows{rows: rows}
+
+	SQLITE_MUTEX.Lock()
+	defer SQLITE_MUTEX.Unlock()
+	for handle, open := range SQLITE_QUERIES {
+		if open == nil {
+			SQLITE_QUERIES[handle] = query
+			vm.Push(float64(handle))
+			return
+		}
+	}
+	SQLITE_QUERIES = append(SQLITE_QUERIES, query)
+	vm.Push(float64(len(SQLITE_QUERIES) - 1))
+}
+
+// Move a query to its next row, and push whether there is one
+func __oak_std__sqlite_step(vm *VM) {
+	query := sqlite_query(vm, int(vm.Pop()))
+	query.values = nil
+	if !query.rows.Next() {
+		vm.Push(0)
+		return
+	}
+	columns, err := query.rows.Columns()
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := query.rows.Scan(pointers...); err != nil {
+		vm.Push(0)
+		return
+	}
+	query.values = values
+	vm.Push(1)
+}
+
+func __oak_std__sqlite_column_count(vm *VM) {
+	query := sqlite_query(vm, int(vm.Pop()))
+	columns, err := query.rows.Columns()
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+	vm.Push(float64(len(columns)))
+}
+
+// Get a column as a number. Text is parsed as one, and
+// anything that isn't a number, such as NULL, is zero.
+func __oak_std__sqlite_column_num(vm *VM) {
+	var n float64
+	switch value := sqlite_column(vm).(type) {
+	case int64:
+		n = float64(value)
+	case float64:
+		n = value
+	case bool:
+		n = Bool(value)
+	case string:
+		n, _ = strconv.ParseFloat(value, 64)
+	case []byte:
+		n, _ = strconv.ParseFloat(string(value), 64)
+	}
+	vm.Push(n)
+}
+
+// Copy a column as text into a buffer, and push its length.
+// NULL is empty, and numbers are written like SQLite would.
+func __oak_std__sqlite_column_text(vm *VM) {
+	value := sqlite_column(vm)
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	var text string
+	switch value := value.(type) {
+	case nil:
+	case []byte:
+		text = string(value)
+	case float64:
+		text = strconv.FormatFloat(value, 'g', -1, 64)
+	default:
+		text = fmt.Sprint(value)
+	}
+	// Databases are a source of tainted data
+	vm.Push(float64(vm.WriteBuffer(addr, size, text, true)))
+}
+
+// Close a query before it has run out of rows
+func __oak_std__sqlite_finalize(vm *VM) {
+	handle := int(vm.Pop())
+	err := sqlite_query(vm, handle).rows.Close()
+	SQLITE_MUTEX.Lock()
+	SQLITE_QUERIES[handle] = nil
+	SQLITE_MUTEX.Unlock()
+	vm.Push(Bool(err == nil))
+}
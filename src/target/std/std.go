@@ -1,30 +1,844 @@
 
-func prn(vm *machine) {
-	n := vm.pop()
-	fmt.Printf("%g", n)
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The standard library's state for each machine
+type std_state struct {
+	// When the machine was created, and when the program last called `bench_start`
+	started     time.Time
+	bench_start time.Time
+	// The request that the program's HTTP server is handling, if any
+	http_request *http_exchange
+	// The files that the program has opened, indexed by their handles.
+	// The handle of a closed file is nil until it is reused.
+	files []*os.File
+	// The regular expressions that the program has compiled, indexed
+	// by their handles, like files
+	regexes []*regexp.Regexp
+}
+
+// A request to the program's HTTP server, and the response that
+// its handler gives. The handler closes `done` when it's finished.
+type http_exchange struct {
+	method, path, body string
+	status             int
+	response           string
+	done               chan struct{}
+}
+
+// The key of the standard library's state on each machine
+type std_key struct{}
+
+func init() {
+	OnNewVM(func(vm *VM) {
+		now := time.Now()
+		s := &std_state{started: now, bench_start: now}
+		vm.SetValue(std_key{}, s)
+		vm.AddHooks(Hooks{Close: func(vm *VM) {
+			s.close_files()
+			// Don't leave the terminal in raw mode when the program stops
+			set_raw_terminal(false)
+		}})
+	})
+}
+
+// Get the standard library's state for a machine
+func state(vm *VM) *std_state {
+	return vm.Value(std_key{}).(*std_state)
+}
+
+// Open a file with a mode like C's `fopen`, such as "r", "w", "a",
+// or "r+", and return its handle, or -1 if it can't be opened
+func (s *std_state) open_file(path, mode string) int {
+	var flags int
+	switch mode {
+	case "r":
+		flags = os.O_RDONLY
+	case "w":
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case "a":
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	case "r+":
+		flags = os.O_RDWR
+	case "w+":
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	case "a+":
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	default:
+		return -1
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return -1
+	}
+
+	// Reuse the handle of a closed file, if there is one
+	for handle, open := range s.files {
+		if open == nil {
+			s.files[handle] = file
+			return handle
+		}
+	}
+	s.files = append(s.files, file)
+	return len(s.files) - 1
+}
+
+// Close every file that the program left open
+func (s *std_state) close_files() {
+	for handle, file := range s.files {
+		if file != nil {
+			file.Close()
+			s.files[handle] = nil
+		}
+	}
 }
 
-func prs(vm *machine) {
-	addr := int(vm.pop())
-	for i := addr; vm.memory[i] != 0.0; i += 1 {
-		fmt.Printf("%c", rune(vm.memory[i]))
+// Get the open file with the given handle
+func get_file(vm *VM, handle int) *os.File {
+	files := state(vm).files
+	if handle < 0 || handle >= len(files) || files[handle] == nil {
+		vm.Fail(INVALID_FILE, fmt.Sprintf("invalid file handle %d", handle))
 	}
+	return files[handle]
+}
+
+// Close the file with the given handle, and free the handle
+func close_file(vm *VM, handle int) error {
+	err := get_file(vm, handle).Close()
+	state(vm).files[handle] = nil
+	return err
+}
+
+func prn(vm *VM) {
+	n := vm.Pop()
+	vm.Print(strconv.FormatFloat(n, 'g', -1, 64))
+}
+
+func prs(vm *VM) {
+	addr := int(vm.Pop())
+	vm.Print(vm.ReadString(addr))
 }
 
-func prc(vm *machine) {
-	n := vm.pop()
-	fmt.Printf("%c", rune(n))
+func prc(vm *VM) {
+	n := vm.Pop()
+	vm.Print(string(rune(n)))
 }
 
-func prend(vm *machine) {
-	fmt.Print("\n")
+func prend(vm *VM) {
+	vm.Print("\n")
 }
 
-func getch(vm *machine) {
-	ch, _ := READER.ReadByte()
+func getch(vm *VM) {
+	ch := vm.InputByte()
 	if ch == '\r' {
-		ch, _ = READER.ReadByte()
+		ch = vm.InputByte()
+	}
+
+	vm.Push(float64(ch))
+	// Characters read from the user are a source of tainted data
+	vm.SetTainted(vm.StackPtr()-1, true)
+}
+
+func __oak_std__poll_key(vm *VM) {
+	if ch, ok := vm.PollInput(); ok {
+		vm.Push(float64(ch))
+		// Characters read from the user are a source of tainted data
+		vm.SetTainted(vm.StackPtr()-1, true)
+	} else {
+		vm.Push(-1)
+	}
+}
+
+func __oak_std__is_eof(vm *VM) {
+	vm.Push(Bool(vm.AtEOF()))
+}
+
+func __oak_std__term_raw_on(vm *VM) {
+	vm.Push(Bool(set_raw_terminal(true) == nil))
+}
+
+func __oak_std__term_raw_off(vm *VM) {
+	vm.Push(Bool(set_raw_terminal(false) == nil))
+}
+
+func __oak_std__term_width(vm *VM) {
+	width, _ := terminal_size()
+	vm.Push(float64(width))
+}
+
+func __oak_std__term_height(vm *VM) {
+	_, height := terminal_size()
+	vm.Push(float64(height))
+}
+
+func __oak_std__term_clear(vm *VM) {
+	write_ansi(vm, "2J")
+	write_ansi(vm, "H")
+}
+
+func __oak_std__term_move(vm *VM) {
+	x := int(vm.Pop())
+	y := int(vm.Pop())
+	// The terminal counts rows and columns from one
+	write_ansi(vm, fmt.Sprintf("%d;%dH", y+1, x+1))
+}
+
+func __oak_std__term_fg(vm *VM) {
+	write_ansi(vm, ansi_color(30, int(vm.Pop())))
+}
+
+func __oak_std__term_bg(vm *VM) {
+	write_ansi(vm, ansi_color(40, int(vm.Pop())))
+}
+
+func __oak_std__term_reset(vm *VM) {
+	write_ansi(vm, "0m")
+}
+
+func __oak_std__getline(vm *VM) {
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+
+	// Characters read from the user are a source of tainted data
+	line, _ := vm.InputLine()
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	vm.Push(float64(vm.WriteBuffer(addr, size, line, true)))
+}
+
+func __oak_std__get_num(vm *VM) {
+	ok := int(vm.Pop())
+	vm.CheckBounds(ok, 1)
+
+	// Skip the whitespace before the number, and read up to the next
+	ch := vm.InputByte()
+	for ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n' {
+		ch = vm.InputByte()
+	}
+	token := []byte{}
+	for ch != 0 && ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+		token = append(token, ch)
+		ch = vm.InputByte()
+	}
+
+	n, err := strconv.ParseFloat(string(token), 64)
+	if err != nil {
+		n = 0
+	}
+	vm.Memory()[ok] = Bool(err == nil)
+	vm.Push(n)
+	// Numbers read from the user are a source of tainted data
+	vm.SetTainted(vm.StackPtr()-1, true)
+}
+
+func __oak_std__memcpy(vm *VM) {
+	dst := vm.Pop()
+	src := vm.Pop()
+	size := vm.Pop()
+	vm.Push(src)
+	vm.Push(dst)
+	vm.Copy(int(size))
+}
+
+func __oak_std__memset(vm *VM) {
+	dst := vm.Pop()
+	n := vm.Pop()
+	size := vm.Pop()
+	vm.Push(n)
+	vm.Push(dst)
+	vm.Fill(int(size))
+}
+
+func __oak_std__strlen(vm *VM) {
+	vm.Strlen()
+}
+
+func __oak_std__strcmp(vm *VM) {
+	a := vm.Pop()
+	b := vm.Pop()
+	vm.Push(a)
+	vm.Push(b)
+	vm.Strcmp()
+}
+
+func __oak_std__set_trap(vm *VM) {
+	name := vm.ReadString(int(vm.Pop()))
+	if handler, ok := FunctionNamed(name); ok {
+		vm.SetTrapHandler(handler)
+		return
+	}
+	vm.Fail(INVALID_FUNCTION, fmt.Sprintf("no function named `%s` to handle errors", name))
+}
+
+func __oak_std__assert(vm *VM) {
+	condition := vm.Pop()
+	message := vm.ReadString(int(vm.Pop()))
+	if condition == 0 {
+		vm.Fail(ASSERTION_FAILED, fmt.Sprintf("assertion failed: %s", message))
+	}
+}
+
+func __oak_std__watch(vm *VM) {
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.Watch(addr, size)
+}
+
+func __oak_std__debug_break(vm *VM) {
+	vm.Break()
+}
+
+func __oak_std__snapshot(vm *VM) {
+	path := vm.ReadSinkString("save_snapshot", int(vm.Pop()))
+	file, err := os.Create(path)
+	if err == nil {
+		err = vm.Snapshot(file)
+		if close_err := file.Close(); err == nil {
+			err = close_err
+		}
+	}
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__restore(vm *VM) {
+	path := vm.ReadSinkString("load_snapshot", int(vm.Pop()))
+	file, err := os.Open(path)
+	if err == nil {
+		err = vm.RestoreHeap(file)
+		file.Close()
+	}
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__exit(vm *VM) {
+	vm.Exit(int(vm.Pop()))
+}
+
+func __oak_std__fopen(vm *VM) {
+	path := vm.ReadSinkString("file_open", int(vm.Pop()))
+	mode := vm.ReadString(int(vm.Pop()))
+	vm.Push(float64(state(vm).open_file(path, mode)))
+}
+
+func __oak_std__fread(vm *VM) {
+	file := get_file(vm, int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.CheckBounds(addr, size)
+
+	// Fill as much of the buffer as the file has left
+	data := make([]byte, size)
+	n, err := io.ReadFull(file, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		vm.Push(-1)
+		return
+	}
+	for i := 0; i < n; i += 1 {
+		vm.Memory()[addr+i] = float64(data[i])
+		// The contents of files are a source of tainted data
+		vm.SetTainted(addr+i, true)
+	}
+	vm.Push(float64(n))
+}
+
+func __oak_std__fwrite(vm *VM) {
+	file := get_file(vm, int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.CheckBounds(addr, size)
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(vm.Memory()[addr+i])
+	}
+	if n, err := file.Write(data); err != nil {
+		vm.Push(-1)
+	} else {
+		vm.Push(float64(n))
+	}
+}
+
+func __oak_std__fseek(vm *VM) {
+	file := get_file(vm, int(vm.Pop()))
+	offset := int64(vm.Pop())
+	whence := int(vm.Pop())
+	if position, err := file.Seek(offset, whence); err != nil {
+		vm.Push(-1)
+	} else {
+		vm.Push(float64(position))
+	}
+}
+
+func __oak_std__fclose(vm *VM) {
+	vm.Push(Bool(close_file(vm, int(vm.Pop())) == nil))
+}
+
+func __oak_std__read_file(vm *VM) {
+	path := vm.ReadSinkString("read_file", int(vm.Pop()))
+	length := int(vm.Pop())
+	vm.CheckBounds(length, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+
+	// The contents are zero terminated, so they can be used as a string
+	cells := make([]float64, len(data)+1)
+	for i, b := range data {
+		cells[i] = float64(b)
+	}
+	addr := vm.CopyIn(cells)
+	for i := range data {
+		// The contents of files are a source of tainted data
+		vm.SetTainted(addr+i, true)
+	}
+	vm.Memory()[length] = float64(len(data))
+	vm.Push(float64(addr))
+}
+
+// Read a whole file onto the heap with a byte in each cell. Unlike
+// `read_file`, there is no zero at the end, since binary files may
+// have zeros of their own. An empty file still gets a cell, so that
+// its buffer can be freed like any other.
+func __oak_std__read_bytes(vm *VM) {
+	path := vm.ReadSinkString("read_bytes", int(vm.Pop()))
+	length := int(vm.Pop())
+	vm.CheckBounds(length, 1)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		vm.Push(0)
+		return
 	}
 
-	vm.push(float64(ch))
+	cells := make([]float64, len(data))
+	if len(cells) == 0 {
+		cells = make([]float64, 1)
+	}
+	for i, b := range data {
+		cells[i] = float64(b)
+	}
+	addr := vm.CopyIn(cells)
+	for i := range data {
+		// The contents of files are a source of tainted data
+		vm.SetTainted(addr+i, true)
+	}
+	vm.Memory()[length] = float64(len(data))
+	vm.Push(float64(addr))
+}
+
+// Write `size` cells starting at `addr` to a file, as one byte each.
+// A cell that doesn't hold a byte stops the machine.
+func __oak_std__write_bytes(vm *VM) {
+	path := vm.ReadSinkString("write_bytes", int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	data := vm.Bytes(addr, size)
+	vm.Push(Bool(os.WriteFile(path, data, 0644) == nil))
+}
+
+// Write `size` cells starting at `addr` to a file as bytes,
+// opened with the given flags, and push whether it worked
+func write_file(vm *VM, builtin string, flags int) {
+	path := vm.ReadSinkString(builtin, int(vm.Pop()))
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.CheckBounds(addr, size)
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(vm.Memory()[addr+i])
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err == nil {
+		_, err = file.Write(data)
+		if close_err := file.Close(); err == nil {
+			err = close_err
+		}
+	}
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__write_file(vm *VM) {
+	write_file(vm, "write_file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+func __oak_std__append_file(vm *VM) {
+	write_file(vm, "append_file", os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+}
+
+func __oak_std__list_dir(vm *VM) {
+	path := vm.ReadSinkString("list_dir", int(vm.Pop()))
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+
+	// The names of the entries are followed by a null pointer
+	vm.Push(float64(len(entries) + 1))
+	addr := vm.Allocate()
+	vm.Pop()
+	for i, entry := range entries {
+		vm.Memory()[addr+i] = float64(vm.AllocString(entry.Name()))
+	}
+	vm.Memory()[addr+len(entries)] = 0
+	vm.Push(float64(addr))
+}
+
+func __oak_std__is_dir(vm *VM) {
+	info, err := os.Stat(vm.ReadString(int(vm.Pop())))
+	vm.Push(Bool(err == nil && info.IsDir()))
+}
+
+func __oak_std__is_file(vm *VM) {
+	info, err := os.Stat(vm.ReadString(int(vm.Pop())))
+	vm.Push(Bool(err == nil && info.Mode().IsRegular()))
+}
+
+func __oak_std__getcwd(vm *VM) {
+	if dir, err := os.Getwd(); err != nil {
+		vm.Push(0)
+	} else {
+		vm.Push(float64(vm.AllocString(dir)))
+	}
+}
+
+func __oak_std__chdir(vm *VM) {
+	vm.Push(Bool(os.Chdir(vm.ReadSinkString("change_dir", int(vm.Pop()))) == nil))
+}
+
+// Make a directory, along with any of its parents that don't exist yet.
+// A directory that already exists is fine.
+func __oak_std__mkdir(vm *VM) {
+	vm.Push(Bool(os.MkdirAll(vm.ReadSinkString("make_dir", int(vm.Pop())), 0755) == nil))
+}
+
+// Remove a file, or a directory if it is empty
+func __oak_std__remove(vm *VM) {
+	vm.Push(Bool(os.Remove(vm.ReadSinkString("remove_path", int(vm.Pop()))) == nil))
+}
+
+func __oak_std__rename(vm *VM) {
+	from := vm.ReadSinkString("rename_path", int(vm.Pop()))
+	to := vm.ReadSinkString("rename_path", int(vm.Pop()))
+	vm.Push(Bool(os.Rename(from, to) == nil))
+}
+
+func __oak_std__getenv(vm *VM) {
+	name := vm.ReadString(int(vm.Pop()))
+	out := int(vm.Pop())
+	value, ok := os.LookupEnv(name)
+	if ok {
+		vm.CheckBounds(out, 1)
+		addr := vm.AllocString(value)
+		vm.Memory()[out] = float64(addr)
+		// The environment is a source of tainted data
+		for i := range []rune(value) {
+			vm.SetTainted(addr+i, true)
+		}
+	}
+	vm.Push(Bool(ok))
+}
+
+func __oak_std__setenv(vm *VM) {
+	name := vm.ReadString(int(vm.Pop()))
+	value := vm.ReadString(int(vm.Pop()))
+	vm.Push(Bool(os.Setenv(name, value) == nil))
+}
+
+func __oak_std__time_unix(vm *VM) {
+	vm.Push(float64(time.Now().Unix()))
+}
+
+// Milliseconds since the Unix epoch. Cells are float64s, which hold
+// whole numbers exactly up to 2^53, so this is exact for the next few
+// hundred thousand years.
+func __oak_std__time_millis(vm *VM) {
+	vm.Push(float64(time.Now().UnixMilli()))
+}
+
+func __oak_std__bench_start(vm *VM) {
+	state(vm).bench_start = time.Now()
+}
+
+func __oak_std__bench_elapsed_ns(vm *VM) {
+	vm.Push(float64(time.Since(state(vm).bench_start).Nanoseconds()))
+}
+
+func __oak_std__time_monotonic_ms(vm *VM) {
+	// The time the machine started has a monotonic clock reading,
+	// so this isn't affected by changes to the wall clock
+	vm.Push(float64(time.Since(state(vm).started).Milliseconds()))
+}
+
+// The number of cells that the fields of a date take up
+const DATE_FIELDS = 6
+
+// Get the local time of a Unix timestamp
+func unix_time(t float64) time.Time {
+	return time.Unix(int64(t), 0)
+}
+
+// Write the year, month, day, hour, minute, and second
+// of a time to the cells starting at `addr`
+func write_date(vm *VM, addr int, t time.Time, tainted bool) {
+	vm.CheckBounds(addr, DATE_FIELDS)
+	fields := [DATE_FIELDS]int{t.Year(), int(t.Month()), t.Day(), t.Hour(), t.Minute(), t.Second()}
+	for i, field := range fields {
+		vm.Memory()[addr+i] = float64(field)
+		vm.SetTainted(addr+i, tainted)
+	}
+}
+
+func __oak_std__date_fields(vm *VM) {
+	t := unix_time(vm.Pop())
+	write_date(vm, int(vm.Pop()), t, false)
+}
+
+// Sunday is 0, and Saturday is 6
+func __oak_std__day_of_week(vm *VM) {
+	vm.Push(float64(unix_time(vm.Pop()).Weekday()))
+}
+
+// The first of January is 1
+func __oak_std__day_of_year(vm *VM) {
+	vm.Push(float64(unix_time(vm.Pop()).YearDay()))
+}
+
+// Write a time as ISO 8601 to a buffer, such as `2024-03-09T14:05:00+01:00`,
+// and push the number of characters written
+func __oak_std__format_iso(vm *VM) {
+	t := unix_time(vm.Pop())
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	vm.Push(float64(vm.WriteBuffer(addr, size, t.Format(time.RFC3339), false)))
+}
+
+// The forms of ISO 8601 dates that `parse_date` understands
+var DATE_LAYOUTS = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Parse a date into its fields, as written, and push whether it could be
+func __oak_std__parse_date(vm *VM) {
+	addr := int(vm.Pop())
+	s := vm.ReadString(addr)
+	out := int(vm.Pop())
+	for _, layout := range DATE_LAYOUTS {
+		if t, err := time.Parse(layout, s); err == nil {
+			write_date(vm, out, t, vm.IsTaintedString(addr))
+			vm.Push(1)
+			return
+		}
+	}
+	vm.Push(0)
+}
+
+func __oak_std__sin(vm *VM) {
+	vm.Push(math.Sin(vm.Pop()))
+}
+
+func __oak_std__cos(vm *VM) {
+	vm.Push(math.Cos(vm.Pop()))
+}
+
+func __oak_std__tan(vm *VM) {
+	vm.Push(math.Tan(vm.Pop()))
+}
+
+func __oak_std__asin(vm *VM) {
+	vm.Push(math.Asin(vm.Pop()))
+}
+
+func __oak_std__atan2(vm *VM) {
+	y := vm.Pop()
+	x := vm.Pop()
+	vm.Push(math.Atan2(y, x))
+}
+
+func __oak_std__exp(vm *VM) {
+	vm.Push(math.Exp(vm.Pop()))
+}
+
+func __oak_std__log(vm *VM) {
+	vm.Push(math.Log(vm.Pop()))
+}
+
+func __oak_std__log2(vm *VM) {
+	vm.Push(math.Log2(vm.Pop()))
+}
+
+func __oak_std__abs(vm *VM) {
+	vm.Push(math.Abs(vm.Pop()))
+}
+
+func __oak_std__min(vm *VM) {
+	a := vm.Pop()
+	b := vm.Pop()
+	vm.Push(math.Min(a, b))
+}
+
+func __oak_std__max(vm *VM) {
+	a := vm.Pop()
+	b := vm.Pop()
+	vm.Push(math.Max(a, b))
+}
+
+func __oak_std__getpid(vm *VM) {
+	vm.Push(float64(os.Getpid()))
+}
+
+func __oak_std__getppid(vm *VM) {
+	vm.Push(float64(os.Getppid()))
+}
+
+func __oak_std__hostname(vm *VM) {
+	if name, err := os.Hostname(); err != nil {
+		vm.Push(0)
+	} else {
+		vm.Push(float64(vm.AllocString(name)))
+	}
+}
+
+func __oak_std__foreign_error(vm *VM) {
+	vm.Push(float64(vm.AllocString(vm.LastForeignError())))
+}
+
+func __oak_std__foreign_global(vm *VM) {
+	name := vm.ReadString(int(vm.Pop()))
+	addr, ok := vm.ForeignGlobalAddr(name)
+	if !ok {
+		vm.Fail(NO_SUCH_BUILTIN, fmt.Sprintf("no foreign global named `%s`", name))
+	}
+	vm.Push(float64(addr))
+}
+
+func __oak_std__clipboard_get(vm *VM) {
+	text, err := run_clipboard(false, "")
+	if err != nil {
+		vm.Push(0)
+		return
+	}
+	addr := vm.AllocString(text)
+	// The clipboard is a source of tainted data
+	for i := range []rune(text) {
+		vm.SetTainted(addr+i, true)
+	}
+	vm.Push(float64(addr))
+}
+
+func __oak_std__clipboard_set(vm *VM) {
+	text := vm.ReadString(int(vm.Pop()))
+	_, err := run_clipboard(true, text)
+	vm.Push(Bool(err == nil))
+}
+
+func __oak_std__system(vm *VM) {
+	// Running a user controlled command is a sensitive operation
+	command := vm.ReadSinkString("run_command", int(vm.Pop()))
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// Keep the program's output in order with the command's
+	vm.Flush()
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		vm.Push(float64(exit.ExitCode()))
+	} else if err != nil {
+		vm.Push(-1)
+	} else {
+		vm.Push(0)
+	}
+}
+
+func __oak_std__regex_compile(vm *VM) {
+	re, err := regexp.Compile(vm.ReadString(int(vm.Pop())))
+	if err != nil {
+		vm.Push(-1)
+		return
+	}
+	// Reuse the handle of a freed regular expression, if there is one
+	s := state(vm)
+	for handle, compiled := range s.regexes {
+		if compiled == nil {
+			s.regexes[handle] = re
+			vm.Push(float64(handle))
+			return
+		}
+	}
+	s.regexes = append(s.regexes, re)
+	vm.Push(float64(len(s.regexes) - 1))
+}
+
+// Get the compiled regular expression with the given handle
+func regex(vm *VM, handle int) *regexp.Regexp {
+	regexes := state(vm).regexes
+	if handle < 0 || handle >= len(regexes) || regexes[handle] == nil {
+		vm.Fail(INVALID_HANDLE, fmt.Sprintf("invalid regex handle %d", handle))
+	}
+	return regexes[handle]
+}
+
+func __oak_std__regex_free(vm *VM) {
+	handle := int(vm.Pop())
+	regex(vm, handle)
+	state(vm).regexes[handle] = nil
+}
+
+func __oak_std__regex_match(vm *VM) {
+	re := regex(vm, int(vm.Pop()))
+	s := vm.ReadString(int(vm.Pop()))
+	vm.Push(Bool(re.MatchString(s)))
+}
+
+// Copy the first match in a string into a buffer, and push the
+// index of the character that it starts at, or -1 if there is none
+func __oak_std__regex_find(vm *VM) {
+	re := regex(vm, int(vm.Pop()))
+	subject := int(vm.Pop())
+	addr := int(vm.Pop())
+	size := int(vm.Pop())
+	s := vm.ReadString(subject)
+	match := re.FindStringIndex(s)
+	if match == nil {
+		vm.Push(-1)
+		return
+	}
+	vm.WriteBuffer(addr, size, s[match[0]:match[1]], vm.IsTaintedString(subject))
+	vm.Push(float64(utf8.RuneCountInString(s[:match[0]])))
+}
+
+// Replace every match in a string, and push the result as a new string
+// on the heap. The replacement can use groups of the match, like `$1`.
+func __oak_std__regex_replace(vm *VM) {
+	re := regex(vm, int(vm.Pop()))
+	subject := int(vm.Pop())
+	replacement := int(vm.Pop())
+	result := re.ReplaceAllString(vm.ReadString(subject), vm.ReadString(replacement))
+	addr := vm.AllocString(result)
+	if vm.IsTaintedString(subject) || vm.IsTaintedString(replacement) {
+		for i := range []rune(result) {
+			vm.SetTainted(addr+i, true)
+		}
+	}
+	vm.Push(float64(addr))
 }
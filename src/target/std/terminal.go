@@ -0,0 +1,145 @@
+// The standard library's terminal functions, and the system
+// clipboard, which is read and written with the system's commands.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The settings of the terminal from before it was put in raw mode,
+// or empty if it isn't in raw mode
+var TERMINAL_SETTINGS = ""
+
+// Run `stty` on the terminal that the program reads from
+func stty(args ...string) (string, error) {
+	command := exec.Command("stty", args...)
+	command.Stdin = os.Stdin
+	output, err := command.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// Put the terminal in raw mode, where each character is read as soon
+// as it is typed and isn't echoed, or restore its previous settings.
+// Output and signals such as Ctrl-C still work as usual in raw mode.
+func set_raw_terminal(raw bool) error {
+	if raw == (TERMINAL_SETTINGS != "") {
+		return nil
+	}
+	if !raw {
+		_, err := stty(TERMINAL_SETTINGS)
+		if err == nil {
+			TERMINAL_SETTINGS = ""
+		}
+		return err
+	}
+
+	settings, err := stty("-g")
+	if err == nil {
+		_, err = stty("-icanon", "-echo", "min", "1")
+	}
+	if err == nil {
+		TERMINAL_SETTINGS = settings
+	}
+	return err
+}
+
+// Get the width and height of the terminal in characters. If the program
+// isn't run in a terminal, this uses `COLUMNS` and `LINES`, or 80 by 24.
+func terminal_size() (int, int) {
+	width, height := 80, 24
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		width = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+		height = n
+	}
+	if size, err := stty("size"); err == nil {
+		var rows, columns int
+		if _, err := fmt.Sscan(size, &rows, &columns); err == nil && rows > 0 && columns > 0 {
+			width, height = columns, rows
+		}
+	}
+	return width, height
+}
+
+// The commands that read or write the system clipboard, in the order
+// that they are tried. Which of them works on Linux depends on whether
+// the desktop uses Wayland or X11.
+func clipboard_commands(write bool) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		if write {
+			return [][]string{{"pbcopy"}}
+		}
+		return [][]string{{"pbpaste"}}
+	case "windows":
+		if write {
+			return [][]string{{"powershell", "-NoProfile", "-Command", "Set-Clipboard -Value ([Console]::In.ReadToEnd())"}}
+		}
+		return [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"}}
+	}
+	if write {
+		return [][]string{
+			{"wl-copy"},
+			{"xclip", "-selection", "clipboard"},
+			{"xsel", "--clipboard", "--input"},
+		}
+	}
+	return [][]string{
+		{"wl-paste", "--no-newline"},
+		{"xclip", "-selection", "clipboard", "-o"},
+		{"xsel", "--clipboard", "--output"},
+	}
+}
+
+// Run the first clipboard command that works, with `input` as its
+// input, and get its output. This is the clipboard's text when reading.
+func run_clipboard(write bool, input string) (string, error) {
+	err := errors.New("there is no command to use the clipboard with")
+	for _, args := range clipboard_commands(write) {
+		if _, lookup_err := exec.LookPath(args[0]); lookup_err != nil {
+			continue
+		}
+		command := exec.Command(args[0], args[1:]...)
+		command.Stdin = strings.NewReader(input)
+		var output []byte
+		if output, err = command.Output(); err == nil {
+			// PowerShell ends its output with a newline of its own
+			if runtime.GOOS == "windows" && !write {
+				output = []byte(strings.TrimSuffix(string(output), "\r\n"))
+			}
+			return string(output), nil
+		}
+	}
+	return "", err
+}
+
+var NO_ANSI = FLAGS.Bool("no-ansi", false, "don't write the ANSI escape sequences that control the terminal, such as colors")
+
+// Write the ANSI escape sequence `ESC [ code`, unless the terminal
+// is too dumb to understand it or the program was told not to
+func write_ansi(vm *VM, code string) {
+	if *NO_ANSI || os.Getenv("TERM") == "dumb" {
+		return
+	}
+	vm.Print("\x1b[" + code)
+}
+
+// The ANSI code for a color: 0 through 7 are the standard colors, 8
+// through 15 are their bright versions, and the rest of the 256 colors
+// are the terminal's extended palette. `base` is 30 for the foreground,
+// and 40 for the background.
+func ansi_color(base, color int) string {
+	if color >= 0 && color < 8 {
+		return strconv.Itoa(base+color) + "m"
+	} else if color >= 8 && color < 16 {
+		return strconv.Itoa(base+60+color-8) + "m"
+	}
+	return fmt.Sprintf("%d;5;%dm", base+8, color)
+}
+
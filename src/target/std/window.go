@@ -0,0 +1,165 @@
+// The window that the standard library's graphics functions draw to,
+// which is shown with ebiten. This is only included when the program
+// is compiled with `--graphics`. Ebiten must run on the main goroutine,
+// so the machine runs on another one, and the main goroutine shows
+// the window once the program opens it.
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+)
+
+// The mouse buttons that `mouse_down` can check, by their numbers in Oak
+var MOUSE_BUTTONS = [...]ebiten.MouseButton{
+	ebiten.MouseButtonLeft,
+	ebiten.MouseButtonRight,
+	ebiten.MouseButtonMiddle,
+}
+
+type window struct {
+	title         string
+	width, height int
+	// The frame that the program draws to. Only the machine's
+	// goroutine uses it, so it isn't guarded by the mutex.
+	canvas *image.RGBA
+	mutex  sync.Mutex
+	// The pixels of the last frame that the program presented
+	shown []byte
+	// The input as of the last update
+	keys             []ebiten.Key
+	mouse_x, mouse_y int
+	buttons          [len(MOUSE_BUTTONS)]bool
+	// Signalled each time the window is drawn, for `present` to wait for
+	drawn chan struct{}
+	// Closed when the user closes the window
+	closed chan struct{}
+	// The result of the program, once it has stopped
+	done     chan error
+	result   error
+	finished bool
+}
+
+// The program's window, once it has opened one
+var WINDOW *window
+
+// The window that the program opens is sent to the main goroutine
+var OPEN_WINDOW = make(chan *window)
+
+func window_new(title string, width, height int) *window {
+	return &window{
+		title:  title,
+		width:  width,
+		height: height,
+		canvas: image.NewRGBA(image.Rect(0, 0, width, height)),
+		shown:  make([]byte, 4*width*height),
+		drawn:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Run the function `entry` on a new machine on another goroutine, and
+// show the window on this one if the program opens it. If the program
+// stops without an error, its window stays open until the user closes
+// it. If the user closes the window first, the program stops the next
+// time that it uses the window.
+func RunWithWindow(global_scope_size, capacity int, entry func(*VM)) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- RunMachine(global_scope_size, capacity, entry)
+	}()
+
+	var w *window
+	select {
+	case err := <-done:
+		return err
+	case w = <-OPEN_WINDOW:
+	}
+	w.done = done
+	ebiten.SetWindowTitle(w.title)
+	ebiten.SetWindowSize(w.width, w.height)
+	if err := ebiten.RunGame(w); err != nil && err != ebiten.Termination {
+		fmt.Fprintln(os.Stderr, "could not show the window:", err)
+		os.Exit(1)
+	}
+	if w.finished {
+		return w.result
+	}
+	close(w.closed)
+	return <-done
+}
+
+func (w *window) Update() error {
+	select {
+	case err := <-w.done:
+		w.result = err
+		w.finished = true
+	default:
+	}
+	if w.finished && w.result != nil {
+		return ebiten.Termination
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.keys = inpututil.AppendPressedKeys(w.keys[:0])
+	w.mouse_x, w.mouse_y = ebiten.CursorPosition()
+	for i, button := range MOUSE_BUTTONS {
+		w.buttons[i] = ebiten.IsMouseButtonPressed(button)
+	}
+	return nil
+}
+
+func (w *window) Draw(screen *ebiten.Image) {
+	w.mutex.Lock()
+	screen.WritePixels(w.shown)
+	w.mutex.Unlock()
+	// Let the program draw its next frame, if it's waiting to
+	select {
+	case w.drawn <- struct{}{}:
+	default:
+	}
+}
+
+// The window is as big as the canvas, and ebiten scales it to fit
+func (w *window) Layout(outside_width, outside_height int) (int, int) {
+	return w.width, w.height
+}
+
+// Show the canvas in the window, and wait until it has been drawn,
+// so that programs that present a frame in a loop run once per frame
+func (w *window) present() {
+	w.mutex.Lock()
+	copy(w.shown, w.canvas.Pix)
+	w.mutex.Unlock()
+	select {
+	case <-w.drawn:
+	case <-w.closed:
+	}
+}
+
+func (w *window) is_closed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get the window that the program opened. Using the window before
+// it is open is an error, and using it after the user closed it
+// stops the program, since there is nothing left for it to show.
+func get_window(vm *VM) *window {
+	if WINDOW == nil {
+		vm.Fail(NO_WINDOW, ErrorMessage(NO_WINDOW))
+	}
+	if WINDOW.is_closed() {
+		vm.Exit(0)
+	}
+	return WINDOW
+}
@@ -110,7 +110,7 @@ impl Target for TS {
         format!("await {}(vm);\n", name)
     }
 
-    fn call_foreign_fn(&self, name: String) -> String {
+    fn call_foreign_fn(&self, name: String, arg_size: i32, return_size: i32) -> String {
         format!("await {}(vm);\n", name)
     }
 
@@ -7,9 +7,10 @@ use std::{
 };
 
 use crate::{
+    asm::{AsmNativeFn, AsmNativeType},
     hir::{
         HirConstant, HirDeclaration, HirExpression, HirFunction, HirProgram, HirStatement,
-        HirStructure, HirType,
+        HirStructure, HirType, HirVariadicExtern,
     },
     parse, Identifier, StringLiteral, Target,
 };
@@ -33,6 +34,9 @@ pub enum TirError {
     /// The compiler is only allowed to call this method.
     /// This is to prevent memory leaks.
     ExplicitCopy,
+    /// Native functions bound with `extern fn native::name` can
+    /// only take and return values that fit in a single cell.
+    UnsupportedNativeType(Identifier),
 }
 
 impl Display for TirError {
@@ -52,6 +56,11 @@ impl Display for TirError {
                 write!(f, "type '{}' is not defined", type_name)
             }
             Self::ExplicitCopy => write!(f, "cannot explicitly call copy constructors"),
+            Self::UnsupportedNativeType(name) => write!(
+                f,
+                "native function '{}' cannot take or return structures",
+                name
+            ),
         }
     }
 }
@@ -59,6 +68,32 @@ impl Display for TirError {
 #[derive(Clone, Debug)]
 pub struct TirProgram(Vec<TirDeclaration>, i32);
 
+/// A foreign function bound by an `extern fn` declaration, with
+/// its parameter and return types written as in Oak, such as `&char`
+#[derive(Clone, Debug)]
+pub struct TirForeignFn {
+    /// The name of the foreign function
+    pub foreign_name: String,
+    /// The name of the Oak function that calls it
+    pub name: String,
+    /// The names and types of the Oak function's parameters
+    pub params: Vec<(Identifier, String)>,
+    /// The name and type of the trailing variadic parameter, if there is one
+    pub variadic: Option<(Identifier, String)>,
+    /// The Oak function's return type
+    pub return_type: String,
+}
+
+/// A structure that a foreign function may take or return, with
+/// its members' types written as in Oak
+#[derive(Clone, Debug)]
+pub struct TirForeignStruct {
+    /// The name of the structure
+    pub name: Identifier,
+    /// The names and types of the structure's members, in order
+    pub members: Vec<(Identifier, String)>,
+}
+
 impl TirProgram {
     pub fn new(decls: Vec<TirDeclaration>, memory_size: i32) -> Self {
         Self(decls, memory_size)
@@ -68,6 +103,76 @@ impl TirProgram {
         &mut self.0
     }
 
+    /// The foreign functions that this program's `extern fn` declarations
+    /// bind, including the ones in conditional compilation statements.
+    /// Included files are left out, since they have their own foreign
+    /// functions, and so are natives and builtins from extensions,
+    /// which aren't defined as foreign functions.
+    pub fn foreign_fns(&self) -> Vec<TirForeignFn> {
+        let mut result = vec![];
+        for decl in &self.0 {
+            match decl {
+                TirDeclaration::ExternFunction(
+                    _,
+                    foreign_name,
+                    name,
+                    params,
+                    variadic,
+                    return_type,
+                ) => {
+                    if !foreign_name.contains("::") {
+                        result.push(TirForeignFn {
+                            foreign_name: foreign_name.clone(),
+                            name: name.clone(),
+                            params: params
+                                .iter()
+                                .map(|(param, t)| (param.clone(), t.to_hir_type().to_string()))
+                                .collect(),
+                            variadic: variadic
+                                .as_ref()
+                                .map(|(param, t)| (param.clone(), t.to_hir_type().to_string())),
+                            return_type: return_type.to_hir_type().to_string(),
+                        })
+                    }
+                }
+                TirDeclaration::If(_, prog) => result.extend(prog.foreign_fns()),
+                TirDeclaration::IfElse(_, then_prog, else_prog) => {
+                    result.extend(then_prog.foreign_fns());
+                    result.extend(else_prog.foreign_fns());
+                }
+                _ => {}
+            }
+        }
+        result
+    }
+
+    /// The structures that this program defines, including the ones in
+    /// conditional compilation statements, for the foreign functions
+    /// that take or return them. Like `foreign_fns`, this leaves out
+    /// included files.
+    pub fn foreign_structs(&self) -> Vec<TirForeignStruct> {
+        let mut result = vec![];
+        for decl in &self.0 {
+            match decl {
+                TirDeclaration::Structure(structure) => result.push(TirForeignStruct {
+                    name: structure.name.clone(),
+                    members: structure
+                        .members
+                        .iter()
+                        .map(|(member, t)| (member.clone(), t.to_hir_type().to_string()))
+                        .collect(),
+                }),
+                TirDeclaration::If(_, prog) => result.extend(prog.foreign_structs()),
+                TirDeclaration::IfElse(_, then_prog, else_prog) => {
+                    result.extend(then_prog.foreign_structs());
+                    result.extend(else_prog.foreign_structs());
+                }
+                _ => {}
+            }
+        }
+        result
+    }
+
     /// Add a prefix to every include statement in this program.
     /// This is used to include files in other directories.
     pub fn set_include_dir(&mut self, include_dir: &PathBuf) -> &mut Self {
@@ -75,7 +180,7 @@ impl TirProgram {
             match decl {
                 /// Both the include and extern directives look in their working directories
                 /// for files, so their filenames must be adjusted.
-                TirDeclaration::Include(filename) | TirDeclaration::Extern(filename) => {
+                TirDeclaration::Include(filename) | TirDeclaration::Extern(filename, _) => {
                     // Join the include directive argument with the include directory
                     let new_path = include_dir.join(filename.clone());
                     // Replace the directive's argument with the new path
@@ -96,6 +201,50 @@ impl TirProgram {
         self
     }
 
+    /// Add the symbol prefix of each `#[extern(file, prefix)]` directive
+    /// to the foreign functions of the `extern fn` declarations after it,
+    /// up to the next `#[extern]` directive in the same file. This lets
+    /// foreign files that are used together define functions with the
+    /// same Oak names, such as `json_parse` and `toml_parse` for `parse`.
+    /// Natives are prefixed too, but builtins from extensions are not,
+    /// since their families already keep them apart.
+    pub fn prefix_foreign_fns(&mut self) -> &mut Self {
+        self.prefix_foreign_fns_with(&mut None)
+    }
+
+    fn prefix_foreign_fns_with(&mut self, prefix: &mut Option<String>) -> &mut Self {
+        for decl in self.get_declarations() {
+            match decl {
+                TirDeclaration::Extern(_, file_prefix) => *prefix = file_prefix.clone(),
+                TirDeclaration::ExternFunction(_, foreign_name, _, _, _, _) => {
+                    if let Some(prefix) = prefix {
+                        if foreign_name.starts_with(AsmNativeFn::PREFIX) {
+                            *foreign_name = format!(
+                                "{}{}{}",
+                                AsmNativeFn::PREFIX,
+                                prefix,
+                                &foreign_name[AsmNativeFn::PREFIX.len()..]
+                            )
+                        } else if !foreign_name.contains("::") {
+                            *foreign_name = format!("{}{}", prefix, foreign_name)
+                        }
+                    }
+                }
+                // The directives in conditional compilation
+                // statements only apply inside of them
+                TirDeclaration::If(_, prog) => {
+                    prog.prefix_foreign_fns_with(&mut prefix.clone());
+                }
+                TirDeclaration::IfElse(_, then_prog, else_prog) => {
+                    then_prog.prefix_foreign_fns_with(&mut prefix.clone());
+                    else_prog.prefix_foreign_fns_with(&mut prefix.clone());
+                }
+                _ => {}
+            }
+        }
+        self
+    }
+
     pub fn compile(
         &mut self,
         cwd: &PathBuf,
@@ -208,6 +357,20 @@ impl TirProgram {
         for decl in &self.0 {
             match decl {
                 TirDeclaration::Constant(_, _, _) => {}
+                TirDeclaration::ExternFunction(
+                    _,
+                    foreign_name,
+                    _,
+                    params,
+                    variadic,
+                    return_type,
+                ) => {
+                    // The target must generate an adapter for a native function
+                    if let Some(native) = native_fn(foreign_name, params, variadic, return_type)? {
+                        hir_decls.push(HirDeclaration::Native(native))
+                    }
+                    hir_decls.push(decl.to_hir_decl(cwd, &self.0)?)
+                }
                 _ => hir_decls.push(decl.to_hir_decl(cwd, &self.0)?),
             }
         }
@@ -216,6 +379,44 @@ impl TirProgram {
     }
 }
 
+/// Get the native function that an `extern fn` binds,
+/// if its foreign name is like `native::add`
+fn native_fn(
+    foreign_name: &str,
+    params: &Vec<(Identifier, TirType)>,
+    variadic: &Option<(Identifier, TirType)>,
+    return_type: &TirType,
+) -> Result<Option<AsmNativeFn>, TirError> {
+    if !foreign_name.starts_with(AsmNativeFn::PREFIX) {
+        return Ok(None);
+    }
+    let name = foreign_name[AsmNativeFn::PREFIX.len()..].to_string();
+
+    let mut native_params = vec![];
+    for (_, t) in params {
+        match t.to_native_type() {
+            Some(t) => native_params.push(t),
+            None => return Err(TirError::UnsupportedNativeType(name)),
+        }
+    }
+    let native_variadic = match variadic {
+        Some((_, t)) => match t.to_native_type() {
+            Some(t) => Some(t),
+            None => return Err(TirError::UnsupportedNativeType(name)),
+        },
+        None => None,
+    };
+    match return_type.to_native_type() {
+        Some(t) => Ok(Some(AsmNativeFn::new(
+            name,
+            native_params,
+            native_variadic,
+            t,
+        ))),
+        None => Err(TirError::UnsupportedNativeType(name)),
+    }
+}
+
 /// This is purely a standin for HIR's declaration
 /// type. However, if a `macro` flag is added, it
 /// should be added here.
@@ -233,21 +434,27 @@ pub enum TirDeclaration {
     /// to use conditional compilation.
     IfElse(TirConstant, TirProgram, TirProgram),
     Error(String),
-    Extern(String),
+    /// Include a foreign file. The symbol prefix, if it has one, is
+    /// added to the foreign functions of the `extern fn` declarations
+    /// that follow it.
+    Extern(String, Option<String>),
     /// This is the first kind of flag computed in TIR.
     /// It creates a typed binding to a foreign function in an `extern` file.
-    /// This variant has 5 values,
+    /// This variant has 6 values,
     /// 1. The doc string
     /// 2. The foreign function name to bind
     /// 3. The name of the bound Oak function. This is the name that
     ///    the function will be called with.
     /// 4. The typed parameters of the function
-    /// 5. The return type of the function
+    /// 5. The trailing variadic parameter, such as `args: ...num`,
+    ///    if the function has one
+    /// 6. The return type of the function
     ExternFunction(
         Option<String>,
         String,
         String,
         Vec<(Identifier, TirType)>,
+        Option<(Identifier, TirType)>,
         TirType,
     ),
     /// This is the only other flag that is computed in TIR. This
@@ -259,6 +466,30 @@ pub enum TirDeclaration {
 }
 
 impl TirDeclaration {
+    /// Create an `extern fn` declaration from its parameters, which
+    /// are marked if they are variadic. Only the last parameter
+    /// can be variadic.
+    pub fn extern_fn(
+        doc: Option<String>,
+        foreign_name: String,
+        name: String,
+        mut params: Vec<(Identifier, TirType, bool)>,
+        return_type: TirType,
+    ) -> Self {
+        let variadic = match params.last() {
+            Some((_, _, true)) => params.pop().map(|(param, t, _)| (param, t)),
+            _ => None,
+        };
+        if let Some((param, _, _)) = params.iter().find(|(_, _, is_variadic)| *is_variadic) {
+            return Self::Error(format!(
+                "the variadic parameter '{}' of '{}' must be its last parameter",
+                param, name
+            ));
+        }
+        let params = params.into_iter().map(|(param, t, _)| (param, t)).collect();
+        Self::ExternFunction(doc, foreign_name, name, params, variadic, return_type)
+    }
+
     fn to_hir_decl(
         &self,
         cwd: &PathBuf,
@@ -278,9 +509,30 @@ impl TirDeclaration {
 
             Self::Error(msg) => HirDeclaration::Error(msg.clone()),
 
-            Self::Extern(file) => HirDeclaration::Extern(file.clone()),
-
-            Self::ExternFunction(doc, foreign_name, name, params, return_type) => {
+            Self::Extern(file, _) => HirDeclaration::Extern(file.clone()),
+
+            Self::ExternFunction(doc, foreign_name, name, params, variadic, return_type) => {
+                // Native functions are called through their adapters
+                let foreign_name = match native_fn(foreign_name, params, variadic, return_type)? {
+                    Some(native) => native.adapter_name(),
+                    None => foreign_name.clone(),
+                };
+
+                // Calls to variadic functions are replaced with foreign calls,
+                // since Oak functions take a fixed number of arguments
+                if let Some((variadic_param, variadic_type)) = variadic {
+                    return Ok(HirDeclaration::VariadicExtern(HirVariadicExtern::new(
+                        doc.clone(),
+                        foreign_name,
+                        name.clone(),
+                        params
+                            .iter()
+                            .map(|(param, t)| (param.clone(), t.to_hir_type()))
+                            .collect(),
+                        (variadic_param.clone(), variadic_type.to_hir_type()),
+                        return_type.to_hir_type(),
+                    )));
+                }
                 let mut hir_return_type = return_type.to_hir_type();
                 let mut hir_params = vec![];
                 let mut hir_args = vec![];
@@ -380,6 +632,20 @@ impl TirType {
         Self::Pointer(Box::new(self.clone()))
     }
 
+    /// The type that a native function receives or returns for this
+    /// type. Pointers are passed as their addresses, except for `&char`,
+    /// which is passed as a string. Structures can't be passed at all.
+    fn to_native_type(&self) -> Option<AsmNativeType> {
+        Some(match self {
+            Self::Pointer(inner) if **inner == Self::Character => AsmNativeType::String,
+            Self::Pointer(_) | Self::Float => AsmNativeType::Number,
+            Self::Void => AsmNativeType::Void,
+            Self::Boolean => AsmNativeType::Boolean,
+            Self::Character => AsmNativeType::Character,
+            Self::Structure(_) => return None,
+        })
+    }
+
     /// Convert this type to an HIR type
     pub fn to_hir_type(&self) -> HirType {
         match self {
@@ -827,6 +1093,9 @@ pub enum TirStatement {
 
     /// Any expression
     Expression(TirExpression),
+
+    /// The file and line of the statement that follows
+    Location(String, usize),
 }
 
 impl TirStatement {
@@ -1000,6 +1269,7 @@ impl TirStatement {
             }),
 
             Self::Expression(expr) => HirStatement::Expression(expr.to_hir_expr(decls)?),
+            Self::Location(file, line) => HirStatement::Location(file.clone(), *line),
         })
     }
 }
@@ -0,0 +1,224 @@
+// Test that every example program behaves the same way when it is
+// compiled with the Golang backend as it did when its golden file
+// was recorded. For each example, this compares the program's output,
+// its exit status, and a checksum of the memory that it used. Examples
+// that fail to compile are compared by the compiler's exit status and
+// its output instead. Each example is also compiled with a reference
+// backend, the Golang bytecode interpreter by default, which must
+// behave the same way as the Golang backend.
+//
+// Usage, from the root of the repository after running `cargo build`:
+//
+//	go run tests/golden.go                 compare every example
+//	go run tests/golden.go -update         record new golden files
+//	go run tests/golden.go -v              print the output of failed tests
+//	go run tests/golden.go -reference cc   compare with the C backend
+//	go run tests/golden.go -reference ""   skip the reference backend
+//
+// The input for an example is read from `tests/golden/<example>.in`
+// if it exists, and its golden file is `tests/golden/<example>.golden`.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var UPDATE = flag.Bool("update", false, "record the current behavior of each example as its golden file")
+var VERBOSE = flag.Bool("v", false, "print the expected and actual results of failed tests")
+var REFERENCE = flag.String("reference", "go-vm", "the backend that each example must behave the same way with, such as `cc`, or nothing to skip it")
+
+const EXAMPLES = "examples"
+const GOLDEN = "tests/golden"
+const OAK = "target/debug/oak"
+
+// The examples that behave differently each time they are compiled
+// or run, so they have no golden file
+var SKIPPED = map[string]string{
+	"predef/predef_const.ok": "prints the date that it was compiled on",
+	"ffi/uuid.ok":            "prints a random UUID, and must be built with `--module`",
+}
+
+// The escape codes that the compiler colors its errors with
+var COLORS = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func main() {
+	flag.Parse()
+
+	oak, err := filepath.Abs(OAK)
+	if err == nil {
+		_, err = os.Stat(oak)
+	}
+	if err != nil {
+		fmt.Println("Build Oak with 'cargo build' before running the test script")
+		os.Exit(1)
+	}
+
+	// Compile and run each program in a scratch directory,
+	// because the compiler writes its output to the current directory
+	scratch, err := os.MkdirTemp("", "oak-golden")
+	if err != nil {
+		fmt.Println("could not create a scratch directory:", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(scratch)
+
+	examples := []string{}
+	filepath.Walk(EXAMPLES, func(path string, info os.FileInfo, err error) error {
+		// Files in `lib` directories are included by other examples
+		if err == nil && !info.IsDir() && filepath.Ext(path) == ".ok" && filepath.Base(filepath.Dir(path)) != "lib" {
+			examples = append(examples, path)
+		}
+		return nil
+	})
+
+	failed, skipped := 0, 0
+	for _, example := range examples {
+		name, _ := filepath.Rel(EXAMPLES, example)
+		golden := filepath.Join(GOLDEN, name+".golden")
+		input := filepath.Join(GOLDEN, name+".in")
+
+		if reason, ok := SKIPPED[filepath.ToSlash(name)]; ok {
+			fmt.Printf("skip   %s: %s\n", name, reason)
+			skipped += 1
+			continue
+		}
+
+		actual, err := run(oak, scratch, "--go", example, input)
+		if err != nil {
+			fmt.Printf("error  %s: %s\n", name, err)
+			failed += 1
+			continue
+		}
+
+		if *UPDATE {
+			os.MkdirAll(filepath.Dir(golden), 0755)
+			if err := os.WriteFile(golden, []byte(actual), 0644); err != nil {
+				fmt.Printf("error  %s: %s\n", name, err)
+				failed += 1
+			} else {
+				fmt.Printf("update %s\n", name)
+			}
+			continue
+		}
+
+		expected, err := os.ReadFile(golden)
+		if err != nil {
+			fmt.Printf("fail   %s: no golden file, record one with -update\n", name)
+			failed += 1
+			continue
+		} else if string(expected) != actual {
+			fmt.Printf("fail   %s\n", name)
+			if *VERBOSE {
+				fmt.Printf("expected:\n%s\nactual:\n%s\n", expected, actual)
+			}
+			failed += 1
+			continue
+		}
+
+		if *REFERENCE != "" {
+			reference, err := run(oak, scratch, "--"+*REFERENCE, example, input)
+			if err != nil {
+				fmt.Printf("error  %s: %s: %s\n", name, *REFERENCE, err)
+				failed += 1
+				continue
+			}
+			// The C backend's programs don't print a heap checksum
+			if line := checksum_line(actual); *REFERENCE == "cc" && line != "" {
+				actual = strings.Replace(actual, line, "heap checksum: none", 1)
+			}
+			if reference != actual {
+				fmt.Printf("differ %s: %s\n", name, *REFERENCE)
+				if *VERBOSE {
+					fmt.Printf("go:\n%s\n%s:\n%s\n", actual, *REFERENCE, reference)
+				}
+				failed += 1
+				continue
+			}
+		}
+		fmt.Printf("ok     %s\n", name)
+	}
+
+	fmt.Printf("\n%d passed, %d failed, %d skipped\n", len(examples)-failed-skipped, failed, skipped)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// Compile an example with the backend given by the compiler flag, such
+// as `--go`, and run it with the input file, if there is one. The result
+// describes everything the golden file records about the program's behavior.
+func run(oak, scratch, backend, example, input string) (string, error) {
+	example, err := filepath.Abs(example)
+	if err != nil {
+		return "", err
+	}
+
+	executable := filepath.Join(scratch, "main")
+	os.Remove(executable)
+	compiler := exec.Command(oak, backend, "c", example)
+	compiler.Dir = scratch
+	compiler_output, err := compiler.CombinedOutput()
+	compiler_status := 0
+	if err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			return "", err
+		}
+		compiler_status = exit.ExitCode()
+	}
+	// Examples that are meant to fail to compile only record the error.
+	// The error names the example by its absolute path, so make it
+	// relative to the repository to keep the golden file portable.
+	if _, err := os.Stat(executable); err != nil || compiler_status != 0 {
+		root, _ := os.Getwd()
+		output := strings.ReplaceAll(string(compiler_output), root+string(filepath.Separator), "")
+		output = COLORS.ReplaceAllString(output, "")
+		return fmt.Sprintf("compile status: %d\ncompile output:\n%s", compiler_status, output), nil
+	}
+
+	var stdout, stderr bytes.Buffer
+	program := exec.Command(executable, "-heap-checksum")
+	program.Dir = scratch
+	program.Stdout = &stdout
+	program.Stderr = &stderr
+	if data, err := os.ReadFile(input); err == nil {
+		program.Stdin = bytes.NewReader(data)
+	}
+
+	status := 0
+	if err := program.Run(); err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			return "", err
+		}
+		status = exit.ExitCode()
+	}
+
+	// The checksum is only printed when the program exits normally
+	checksum := "none"
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if strings.HasPrefix(line, "heap checksum: ") {
+			checksum = strings.TrimPrefix(line, "heap checksum: ")
+		}
+	}
+
+	return fmt.Sprintf("exit status: %d\nheap checksum: %s\nstdout:\n%s", status, checksum, stdout.String()), nil
+}
+
+// Get the line of a result from `run` with the heap checksum
+func checksum_line(result string) string {
+	for _, line := range strings.Split(result, "\n") {
+		if strings.HasPrefix(line, "heap checksum: ") {
+			return line
+		}
+	}
+	return ""
+}